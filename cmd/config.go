@@ -1,16 +1,65 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ish-xyz/registry-cache/pkg/admin"
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/gc"
 	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/ish-xyz/registry-cache/pkg/quota"
+	"github.com/ish-xyz/registry-cache/pkg/token"
+	"github.com/ish-xyz/registry-cache/pkg/worker"
 	"github.com/go-playground/validator"
 	"github.com/inhies/go-bytesize"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	INDEX_MEMORY = "memory"
+	INDEX_REDIS  = "redis"
+	INDEX_BOLT   = "bolt"
+
+	DEFAULT_REDIS_PREFIX = "registry-cache"
+
+	STORAGE_LOCAL = "local"
+	STORAGE_S3    = "s3"
+
+	DEFAULT_S3_REGION = "us-east-1"
+
+	DEFAULT_MEMORY_MAX_OBJECT_SIZE = "1MB"
+
+	// low watermark of the cache size if gc.disk.targetSize isn't set
+	DEFAULT_TARGET_SIZE_PERCENT = 85
+
+	// how often the config file is checked for changes
+	CONFIG_CHECK_INTERVAL = 10 * time.Second
+
+	// fragments merged over the config file, in lexical order, e.g.: /etc/registry-cache/conf.d/*.yaml
+	CONFIG_DIR = "conf.d"
+	// e.g.: REGISTRY_CACHE_INDEX_REDIS_PASSWORD overrides index.redis.password
+	ENV_PREFIX = "REGISTRY_CACHE"
+	// values read from a file, e.g.: password: file:///run/secrets/redis-password
+	SECRET_FILE_PREFIX = "file://"
+	REDACTED           = "<redacted>"
 )
 
 type Config struct {
 	DataPath string `mapstructure:"dataPath" validate:"required"`
+	// overridden by --debug and --trace
+	LogLevel string `mapstructure:"logLevel" validate:"omitempty,oneof=panic fatal error warn warning info debug trace" yaml:"logLevel"`
 	Server   struct {
 		Address         string              `mapstructure:"address" validate:"required" yaml:"address"`
 		UpstreamTimeout time.Duration       `mapstructure:"upstreamTimeout" validate:"valid-time,required" yaml:"upstreamTimeout"`
@@ -26,17 +75,125 @@ type Config struct {
 			CertPath string `mapstructure:"certPath" validate:"required" yaml:"certPath"`
 			KeyPath  string `mapstructure:"keyPath" validate:"required" yaml:"keyPath"`
 		} `mapstructure:"tls" validate:"required" yaml:"tls"`
+		// authentication of the clients, disabled if no method is configured
+		ClientAuth struct {
+			Htpasswd string `mapstructure:"htpasswd" yaml:"htpasswd"`
+			// CA of the client certificates (mTLS)
+			CAPath string `mapstructure:"caPath" yaml:"caPath"`
+			JWKS   struct {
+				Path     string `mapstructure:"path" yaml:"path"`
+				Issuer   string `mapstructure:"issuer" yaml:"issuer"`
+				Audience string `mapstructure:"audience" yaml:"audience"`
+			} `mapstructure:"jwks" yaml:"jwks"`
+			AllowAnonymous bool `mapstructure:"allowAnonymous" yaml:"allowAnonymous"`
+		} `mapstructure:"clientAuth" yaml:"clientAuth"`
 	}
 
+	Index struct {
+		Type  string `mapstructure:"type" validate:"omitempty,oneof=memory redis bolt,valid-shared-storage" yaml:"type"`
+		Redis struct {
+			Addresses  []string `mapstructure:"addresses" validate:"valid-redis-addresses" yaml:"addresses"`
+			MasterName string   `mapstructure:"masterName" yaml:"masterName"`
+			Username   string   `mapstructure:"username" yaml:"username"`
+			Password   string   `mapstructure:"password" yaml:"password"`
+			DB         int      `mapstructure:"db" yaml:"db"`
+			Prefix     string   `mapstructure:"prefix" yaml:"prefix"`
+			// the data path is a filesystem shared by the replicas, required with the local storage
+			SharedDataPath bool `mapstructure:"sharedDataPath" yaml:"sharedDataPath"`
+		} `mapstructure:"redis" yaml:"redis"`
+		Bolt struct {
+			Path string `mapstructure:"path" yaml:"path"`
+		} `mapstructure:"bolt" yaml:"bolt"`
+	} `mapstructure:"index" yaml:"index"`
+
+	Storage struct {
+		Type string `mapstructure:"type" validate:"omitempty,oneof=local s3" yaml:"type"`
+		S3   struct {
+			Endpoint        string        `mapstructure:"endpoint" validate:"required-with-s3" yaml:"endpoint"`
+			Bucket          string        `mapstructure:"bucket" validate:"required-with-s3" yaml:"bucket"`
+			Prefix          string        `mapstructure:"prefix" yaml:"prefix"`
+			Region          string        `mapstructure:"region" yaml:"region"`
+			AccessKeyID     string        `mapstructure:"accessKeyID" yaml:"accessKeyID"`
+			SecretAccessKey string        `mapstructure:"secretAccessKey" yaml:"secretAccessKey"`
+			Insecure        bool          `mapstructure:"insecure" yaml:"insecure"`
+			PathStyle       bool          `mapstructure:"pathStyle" yaml:"pathStyle"`
+			PresignExpiry   time.Duration `mapstructure:"presignExpiry" yaml:"presignExpiry"`
+		} `mapstructure:"s3" yaml:"s3"`
+		Memory struct {
+			MaxSize       string `mapstructure:"maxSize" validate:"omitempty,valid-bsize" yaml:"maxSize"`
+			MaxObjectSize string `mapstructure:"maxObjectSize" validate:"omitempty,valid-bsize" yaml:"maxObjectSize"`
+		} `mapstructure:"memory" yaml:"memory"`
+		L2 struct {
+			Path      string        `mapstructure:"path" yaml:"path"`
+			MaxSize   string        `mapstructure:"maxSize" validate:"omitempty,valid-bsize" yaml:"maxSize"`
+			MaxUnused time.Duration `mapstructure:"maxUnused" yaml:"maxUnused"`
+		} `mapstructure:"l2" yaml:"l2"`
+	} `mapstructure:"storage" yaml:"storage"`
+
+	Auth struct {
+		// results of the permission checks sent to the upstream, disabled if 0
+		CacheTTL         time.Duration `mapstructure:"cacheTTL" yaml:"cacheTTL"`
+		NegativeCacheTTL time.Duration `mapstructure:"negativeCacheTTL" yaml:"negativeCacheTTL"`
+	} `mapstructure:"auth" yaml:"auth"`
+
+	// access rules of the requests, reloaded when the file changes. Disabled if empty
+	Policy struct {
+		Path string `mapstructure:"path" yaml:"path"`
+		// external authorization of the pulls, disabled if the url is empty
+		Webhook struct {
+			URL      string        `mapstructure:"url" validate:"omitempty,url" yaml:"url"`
+			Timeout  time.Duration `mapstructure:"timeout" yaml:"timeout"`
+			CacheTTL time.Duration `mapstructure:"cacheTTL" yaml:"cacheTTL"`
+			// allow the pulls when the webhook is unreachable
+			FailOpen bool `mapstructure:"failOpen" yaml:"failOpen"`
+		} `mapstructure:"webhook" yaml:"webhook"`
+	} `mapstructure:"policy" yaml:"policy"`
+
+	Tags struct {
+		// tags are served from the cache for ttl, then revalidated with the upstream. Disabled if 0
+		TTL time.Duration `mapstructure:"ttl" yaml:"ttl"`
+	} `mapstructure:"tags" yaml:"tags"`
+
+	// fetch in background what the cached manifests reference
+	Prefetch struct {
+		Enabled     bool `mapstructure:"enabled" yaml:"enabled"`
+		Concurrency int  `mapstructure:"concurrency" validate:"min=0" yaml:"concurrency"`
+		// os/architecture[/variant] of the manifests of image indexes, all if empty
+		Platforms []string `mapstructure:"platforms" yaml:"platforms"`
+	} `mapstructure:"prefetch" yaml:"prefetch"`
+
 	Metrics struct {
 		Address string `mapstructure:"address" validate:"required" yaml:"address"`
 	} `mapstructure:"metrics" validate:"required" yaml:"metrics"`
 
+	// admin APIs (pins, prefetch), served with the certificate of the proxy
+	Admin struct {
+		Address string `mapstructure:"address" yaml:"address"`
+		// identities of the authenticated clients allowed to use the admin APIs
+		Users []string `mapstructure:"users" yaml:"users"`
+	} `mapstructure:"admin" yaml:"admin"`
+
 	GC struct {
 		Interval time.Duration `mapstructure:"interval" validate:"required,valid-min-time" yaml:"interval"`
+		// files never removed by the gc: sha256:<digest>, <repository> or <repository>:<tag> (glob patterns)
+		Pins []string `mapstructure:"pins" yaml:"pins"`
+		// per upstream host and repository limits, the owners above their quota are evicted first
+		Quotas []struct {
+			Name       string `mapstructure:"name" validate:"required" yaml:"name"`
+			Host       string `mapstructure:"host" yaml:"host"`
+			Repository string `mapstructure:"repository" yaml:"repository"`
+			MaxSize    string `mapstructure:"maxSize" validate:"required,valid-bsize" yaml:"maxSize"`
+			TargetSize string `mapstructure:"targetSize" validate:"omitempty,valid-bsize" yaml:"targetSize"`
+		} `mapstructure:"quotas" validate:"dive" yaml:"quotas"`
 
 		Disk struct {
-			MaxSize string `mapstructure:"maxSize" validate:"required,valid-bsize" yaml:"maxSize"`
+			MaxSize          string  `mapstructure:"maxSize" validate:"required,valid-bsize" yaml:"maxSize"`
+			TargetSize       string  `mapstructure:"targetSize" validate:"omitempty,valid-bsize" yaml:"targetSize"`
+			MinFree          string  `mapstructure:"minFree" validate:"omitempty,valid-bsize" yaml:"minFree"`
+			TargetFree       string  `mapstructure:"targetFree" validate:"omitempty,valid-bsize" yaml:"targetFree"`
+			MinFreeInodes    float64 `mapstructure:"minFreeInodes" validate:"min=0,max=100" yaml:"minFreeInodes"`
+			TargetFreeInodes float64 `mapstructure:"targetFreeInodes" validate:"min=0,max=100" yaml:"targetFreeInodes"`
+			Policy           string  `mapstructure:"policy" validate:"omitempty,oneof=lru lfu arc gdsf" yaml:"policy"`
 		} `mapstructure:"disk" validate:"required" yaml:"disk"`
 
 		Layers struct {
@@ -48,9 +205,18 @@ type Config struct {
 			MaxAge    time.Duration `mapstructure:"maxAge" validate:"valid-min-time,required" yaml:"maxAge"`
 			MaxUnused time.Duration ` mapstructure:"maxUnused" validate:"valid-min-time,required" yaml:"maxUnused"`
 		} `mapstructure:"manifests" validate:"required" yaml:"manifests"`
+		// partial files of the interrupted downloads, kept to resume them
+		Partials struct {
+			MaxUnused time.Duration `mapstructure:"maxUnused" validate:"omitempty,valid-min-time" yaml:"maxUnused"`
+		} `mapstructure:"partials" yaml:"partials"`
 	} `mapstructure:"gc" validate:"required" yaml:"gc"`
+
+	// paths of the values read from secret files, redacted when the config is printed
+	secrets map[string]bool
 }
 
+// The config file is merged with the fragments of conf.d and the environment variables,
+// then the values referencing secret files are read
 func LoadAndValidateConfig(configFile string) (*Config, error) {
 
 	var c Config
@@ -62,11 +228,36 @@ func LoadAndValidateConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files[1:] {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		err = viper.MergeConfig(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid config fragment %s: %v", f, err)
+		}
+		logrus.Debugln("merged config fragment", f)
+	}
+
+	viper.SetEnvPrefix(ENV_PREFIX)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnv(reflect.TypeOf(c), "")
+
 	err = viper.Unmarshal(&c)
 	if err != nil {
 		return nil, err
 	}
 
+	err = c.readSecrets()
+	if err != nil {
+		return nil, err
+	}
+
 	val := NewValidator()
 
 	if err := val.Struct(c); err != nil {
@@ -76,6 +267,136 @@ func LoadAndValidateConfig(configFile string) (*Config, error) {
 	return &c, nil
 }
 
+// The config file followed by the fragments of the conf.d directory next to it, in lexical order
+func ConfigFiles(configFile string) ([]string, error) {
+	fragments, err := filepath.Glob(filepath.Join(filepath.Dir(configFile), CONFIG_DIR, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{configFile}, fragments...), nil
+}
+
+// Bind an environment variable to each setting, so that it can be set even if the files don't have it.
+// Lists of rules (e.g.: upstreamRules, quotas) can't be set with environment variables
+func bindEnv(t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		key := joinKey(prefix, fieldKey(f))
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			bindEnv(f.Type, key)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.String:
+			continue
+		default:
+			viper.BindEnv(key)
+		}
+	}
+}
+
+// Replace the values referencing a secret file with its content
+func (c *Config) readSecrets() error {
+	c.secrets = make(map[string]bool)
+	return walkStrings(reflect.ValueOf(c).Elem(), "", func(path, value string) (string, error) {
+		if !strings.HasPrefix(value, SECRET_FILE_PREFIX) {
+			return value, nil
+		}
+		content, err := os.ReadFile(strings.TrimPrefix(value, SECRET_FILE_PREFIX))
+		if err != nil {
+			return "", fmt.Errorf("can't read secret of %s: %v", path, err)
+		}
+		c.secrets[path] = true
+		return strings.TrimRight(string(content), "\r\n"), nil
+	})
+}
+
+// The config as yaml, with the passwords, the secret keys and the values read from secret files redacted
+func RedactedConfig(cfg *Config) ([]byte, error) {
+
+	// the maps and the lists of the config are copied by the round trip
+	content, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := Config{}
+	err = yaml.Unmarshal(content, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	walkStrings(reflect.ValueOf(&c).Elem(), "", func(path, value string) (string, error) {
+		name := strings.ToLower(path[strings.LastIndex(path, ".")+1:])
+		secret := strings.Contains(name, "password") || strings.Contains(name, "secret")
+		if value != "" && (secret || cfg.secrets[path]) {
+			return REDACTED, nil
+		}
+		return value, nil
+	})
+	return yaml.Marshal(c)
+}
+
+// Call fn with the path (e.g.: index.redis.password, server.upstreamRules.0.password) of the strings
+// of the config, including the values of the rules, and replace them with the value returned
+func walkStrings(v reflect.Value, path string, fn func(path, value string) (string, error)) error {
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			err := walkStrings(v.Field(i), joinKey(path, fieldKey(f)), fn)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := walkStrings(v.Index(i), joinKey(path, strconv.Itoa(i)), fn)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, k := range v.MapKeys() {
+			value, err := fn(joinKey(path, k.String()), v.MapIndex(k).String())
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(k, reflect.ValueOf(value))
+		}
+	case reflect.String:
+		value, err := fn(path, v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+	}
+	return nil
+}
+
+// Key of a field as in the config files
+func fieldKey(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
 func NewValidator() *validator.Validate {
 
 	validate := validator.New()
@@ -85,6 +406,9 @@ func NewValidator() *validator.Validate {
 	validate.RegisterValidation("valid-bsize", ValidateBSize)
 	validate.RegisterValidation("valid-upstream-rules", ValidateUpstreamRules)
 	validate.RegisterValidation("valid-workers-number", ValidateMinWorkers)
+	validate.RegisterValidation("valid-redis-addresses", ValidateRedisAddresses)
+	validate.RegisterValidation("required-with-s3", ValidateRequiredWithS3)
+	validate.RegisterValidation("valid-shared-storage", ValidateSharedStorage)
 
 	return validate
 }
@@ -93,7 +417,26 @@ func getUpstreamRules(rules []map[string]string) ([]*proxy.UpstreamRule, error)
 	var urules = make([]*proxy.UpstreamRule, 0)
 	for _, r := range rules {
 
-		u, err := proxy.NewUpstreamRule(r["host"], r["scheme"], r["regex"])
+		// keys of the rules are lowercased by viper
+		rewriteRealm := false
+		if value, ok := r["rewriterealm"]; ok {
+			var err error
+			rewriteRealm, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewriteRealm '%s' in rule '%s': %v", value, r["regex"], err)
+			}
+		}
+
+		credentials, err := getCredentials(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials in rule '%s': %v", r["regex"], err)
+		}
+		// the token endpoint would issue the tokens of the proxy to any client
+		if rewriteRealm && credentials != nil {
+			return nil, fmt.Errorf("rewriteRealm can't be used with the credentials of the proxy in rule '%s'", r["regex"])
+		}
+
+		u, err := proxy.NewUpstreamRule(r["host"], r["scheme"], r["regex"], rewriteRealm, credentials)
 		if err != nil {
 			return nil, err
 		}
@@ -102,6 +445,223 @@ func getUpstreamRules(rules []map[string]string) ([]*proxy.UpstreamRule, error)
 	return urules, nil
 }
 
+// Credentials of an upstream rule: basic auth, a token file or a credential helper, nil if not set
+func getCredentials(r map[string]string) (token.Credentials, error) {
+
+	sources := 0
+	for _, key := range []string{"password", "tokenfile", "credentialhelper"} {
+		if r[key] != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("password, tokenFile and credentialHelper are mutually exclusive")
+	}
+
+	switch {
+	case r["password"] != "":
+		if r["username"] == "" {
+			return nil, fmt.Errorf("password requires username")
+		}
+		return token.NewBasicCredentials(r["username"], r["password"]), nil
+	case r["tokenfile"] != "":
+		return token.NewFileCredentials(r["tokenfile"], r["username"]), nil
+	case r["credentialhelper"] != "":
+		return token.NewHelperCredentials(r["credentialhelper"]), nil
+	case r["username"] != "":
+		return nil, fmt.Errorf("username requires password or tokenFile")
+	}
+	return nil, nil
+}
+
+// Settings of the gc in the config
+func getGCSettings(cfg *Config) (gc.Settings, error) {
+
+	watermarks, err := getWatermarks(cfg)
+	if err != nil {
+		return gc.Settings{}, err
+	}
+	return gc.Settings{
+		Interval:           cfg.GC.Interval,
+		Disk:               watermarks,
+		CheckSHA:           cfg.GC.Layers.CheckSHA,
+		ManifestsMaxAge:    cfg.GC.Manifests.MaxAge,
+		ManifestsMaxUnused: cfg.GC.Manifests.MaxUnused,
+		LayersMaxAge:       cfg.GC.Layers.MaxAge,
+		LayersMaxUnused:    cfg.GC.Layers.MaxUnused,
+		PartialsMaxUnused:  cfg.GC.Partials.MaxUnused,
+	}, nil
+}
+
+// Disk watermarks of the gc, low watermarks default to the high ones
+// except for the size, so that the gc doesn't evict a file at a time
+func getWatermarks(cfg *Config) (gc.Watermarks, error) {
+
+	parse := func(value string) int64 {
+		if value == "" {
+			return 0
+		}
+		size, _ := bytesize.Parse(value)
+		return int64(size)
+	}
+
+	disk := cfg.GC.Disk
+	w := gc.Watermarks{
+		MaxSize:          parse(disk.MaxSize),
+		TargetSize:       parse(disk.TargetSize),
+		MinFree:          parse(disk.MinFree),
+		TargetFree:       parse(disk.TargetFree),
+		MinFreeInodes:    disk.MinFreeInodes,
+		TargetFreeInodes: disk.TargetFreeInodes,
+	}
+
+	// evicting files from the bucket doesn't free the local disk
+	if cfg.Storage.Type != STORAGE_S3 {
+		w.Path = cfg.DataPath
+	}
+
+	if disk.TargetSize == "" {
+		w.TargetSize = w.MaxSize / 100 * DEFAULT_TARGET_SIZE_PERCENT
+	}
+	if disk.TargetFree == "" {
+		w.TargetFree = w.MinFree
+	}
+	if w.TargetFreeInodes == 0 {
+		w.TargetFreeInodes = w.MinFreeInodes
+	}
+
+	if w.TargetSize > w.MaxSize {
+		return w, fmt.Errorf("gc.disk.targetSize must not be greater than gc.disk.maxSize")
+	}
+	if w.TargetFree < w.MinFree {
+		return w, fmt.Errorf("gc.disk.targetFree must not be less than gc.disk.minFree")
+	}
+	if w.TargetFreeInodes < w.MinFreeInodes {
+		return w, fmt.Errorf("gc.disk.targetFreeInodes must not be less than gc.disk.minFreeInodes")
+	}
+
+	return w, nil
+}
+
+func getQuotas(cfg *Config) ([]*quota.Quota, error) {
+
+	quotas := make([]*quota.Quota, 0, len(cfg.GC.Quotas))
+	names := make(map[string]bool)
+	for _, q := range cfg.GC.Quotas {
+		if names[q.Name] {
+			return nil, fmt.Errorf("duplicated quota %s", q.Name)
+		}
+		names[q.Name] = true
+
+		if q.Host == "" && q.Repository == "" {
+			return nil, fmt.Errorf("quota %s must set a host or a repository", q.Name)
+		}
+
+		maxSize, _ := bytesize.Parse(q.MaxSize)
+		targetSize := maxSize / 100 * DEFAULT_TARGET_SIZE_PERCENT
+		if q.TargetSize != "" {
+			targetSize, _ = bytesize.Parse(q.TargetSize)
+		}
+		if targetSize > maxSize {
+			return nil, fmt.Errorf("targetSize of quota %s must not be greater than maxSize", q.Name)
+		}
+
+		quotas = append(quotas, &quota.Quota{
+			Name:       q.Name,
+			Host:       q.Host,
+			Repository: q.Repository,
+			MaxSize:    int64(maxSize),
+			TargetSize: int64(targetSize),
+		})
+	}
+
+	return quotas, nil
+}
+
+// Background prefetch of the worker, nil if disabled
+func getPrefetch(cfg *Config) (*worker.Prefetch, error) {
+
+	if !cfg.Prefetch.Enabled {
+		return nil, nil
+	}
+
+	prefetch := &worker.Prefetch{
+		Concurrency: cfg.Prefetch.Concurrency,
+		Platforms:   make([]*cache.Platform, 0, len(cfg.Prefetch.Platforms)),
+	}
+	for _, platform := range cfg.Prefetch.Platforms {
+		p, err := cache.ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		prefetch.Platforms = append(prefetch.Platforms, p)
+	}
+
+	return prefetch, nil
+}
+
+// Authentication of the clients, nil if disabled
+func getClientAuth(cfg *Config) (*auth.Authenticator, error) {
+
+	ca := cfg.Server.ClientAuth
+	if ca.Htpasswd == "" && ca.CAPath == "" && ca.JWKS.Path == "" {
+		return nil, nil
+	}
+
+	var err error
+	var htpasswd *auth.Htpasswd
+	if ca.Htpasswd != "" {
+		htpasswd, err = auth.NewHtpasswd(ca.Htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid htpasswd: %v", err)
+		}
+	}
+
+	var jwks *auth.JWKS
+	if ca.JWKS.Path != "" {
+		jwks, err = auth.NewJWKS(ca.JWKS.Path, ca.JWKS.Issuer, ca.JWKS.Audience)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwks: %v", err)
+		}
+	}
+
+	var clientCAs *x509.CertPool
+	if ca.CAPath != "" {
+		pem, err := os.ReadFile(ca.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca.CAPath)
+		}
+	}
+
+	return auth.NewAuthenticator(htpasswd, jwks, clientCAs, ca.AllowAnonymous), nil
+}
+
+// Admin server of the pins and prefetch APIs, without client authentication it must be reachable only from the host
+func getAdmin(cfg *Config, clientAuth *auth.Authenticator) (*admin.Server, error) {
+
+	address := cfg.Admin.Address
+	if address == "" {
+		address = admin.DEFAULT_ADDRESS
+	}
+
+	if clientAuth == nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin address %s: %v", address, err)
+		}
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("admin.address must be a loopback address when server.clientAuth is disabled")
+		}
+	}
+
+	return admin.NewServer(address, cfg.Server.TLS.CertPath, cfg.Server.TLS.KeyPath, clientAuth, cfg.Admin.Users), nil
+}
+
 // Validators
 
 func ValidateTime(fl validator.FieldLevel) bool {
@@ -163,3 +723,45 @@ func ValidateMinWorkers(fl validator.FieldLevel) bool {
 
 	return wn >= 1
 }
+
+// Redis addresses are required only when the redis index is enabled
+func ValidateRedisAddresses(fl validator.FieldLevel) bool {
+	cfg, ok := fl.Top().Interface().(Config)
+	if !ok {
+		return false
+	}
+	if cfg.Index.Type != INDEX_REDIS {
+		return true
+	}
+
+	addresses, ok := fl.Field().Interface().([]string)
+	return ok && len(addresses) > 0
+}
+
+// S3 settings are required only when the s3 storage is enabled
+func ValidateRequiredWithS3(fl validator.FieldLevel) bool {
+	cfg, ok := fl.Top().Interface().(Config)
+	if !ok {
+		return false
+	}
+	if cfg.Storage.Type != STORAGE_S3 {
+		return true
+	}
+
+	value, ok := fl.Field().Interface().(string)
+	return ok && value != ""
+}
+
+// The status of the files in the redis index is shared by the replicas, so must be the files.
+// Otherwise the replicas would see files available that they don't have
+func ValidateSharedStorage(fl validator.FieldLevel) bool {
+	cfg, ok := fl.Top().Interface().(Config)
+	if !ok {
+		return false
+	}
+	if cfg.Index.Type != INDEX_REDIS {
+		return true
+	}
+
+	return cfg.Storage.Type == STORAGE_S3 || cfg.Index.Redis.SharedDataPath
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+dataPath: /tmp/registry-cache
+logLevel: info
+server:
+  address: 127.0.0.1:7000
+  upstreamTimeout: 30s
+  workers: 2
+  upstreamRules:
+  - host: registry-1.docker.io
+    scheme: https
+    regex: docker.io
+  defaultBackend:
+    host: registry-1.docker.io
+    scheme: https
+  tls:
+    caPath: ca.crt
+    certPath: localhost.crt
+    keyPath: localhost.key
+metrics:
+  address: 127.0.0.1:9090
+gc:
+  interval: 60s
+  disk:
+    maxSize: 10GB
+  layers:
+    maxAge: 24h
+    maxUnused: 1h
+  manifests:
+    maxAge: 24h
+    maxUnused: 1h
+`
+
+// Config file in a temporary directory, with the fragments of conf.d by name
+func writeConfig(t *testing.T, content string, fragments map[string]string) string {
+	viper.Reset()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	os.WriteFile(file, []byte(content), 0600)
+
+	os.Mkdir(filepath.Join(dir, CONFIG_DIR), 0700)
+	for name, fragment := range fragments {
+		os.WriteFile(filepath.Join(dir, CONFIG_DIR, name), []byte(fragment), 0600)
+	}
+	return file
+}
+
+func TestConfigFragments(t *testing.T) {
+	file := writeConfig(t, testConfig, map[string]string{
+		"20-log.yaml":  "logLevel: warn\n",
+		"10-tags.yaml": "logLevel: debug\ntags:\n  ttl: 5m\n",
+		"ignored.yml":  "logLevel: trace\n",
+	})
+
+	files, err := ConfigFiles(file)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		file,
+		filepath.Join(filepath.Dir(file), CONFIG_DIR, "10-tags.yaml"),
+		filepath.Join(filepath.Dir(file), CONFIG_DIR, "20-log.yaml"),
+	}, files)
+
+	// merged in lexical order, the last fragment wins
+	cfg, err := LoadAndValidateConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", cfg.LogLevel)
+	assert.Equal(t, "5m0s", cfg.Tags.TTL.String())
+	assert.Equal(t, "127.0.0.1:7000", cfg.Server.Address)
+}
+
+func TestConfigEnv(t *testing.T) {
+	file := writeConfig(t, testConfig, nil)
+	t.Setenv("REGISTRY_CACHE_LOGLEVEL", "error")
+	t.Setenv("REGISTRY_CACHE_SERVER_ADDRESS", "0.0.0.0:7000")
+	// not in the file
+	t.Setenv("REGISTRY_CACHE_INDEX_REDIS_PASSWORD", "from-env")
+	t.Setenv("REGISTRY_CACHE_GC_DISK_MAXSIZE", "20GB")
+
+	cfg, err := LoadAndValidateConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "error", cfg.LogLevel)
+	assert.Equal(t, "0.0.0.0:7000", cfg.Server.Address)
+	assert.Equal(t, "from-env", cfg.Index.Redis.Password)
+	assert.Equal(t, "20GB", cfg.GC.Disk.MaxSize)
+}
+
+func TestConfigSecrets(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(secret, []byte("redis-password\n"), 0600)
+	token := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(token, []byte("upstream-token\n"), 0600)
+
+	file := writeConfig(t, testConfig, map[string]string{
+		"secrets.yaml": "index:\n  redis:\n    password: file://" + secret + "\n" +
+			"server:\n  upstreamRules:\n  - host: myregistry.com\n    scheme: https\n    regex: myregistry\n" +
+			"    username: robot\n    password: file://" + token + "\n",
+	})
+	cfg, err := LoadAndValidateConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "redis-password", cfg.Index.Redis.Password)
+	assert.Equal(t, "upstream-token", cfg.Server.UpstreamRules[0]["password"])
+	assert.Equal(t, map[string]bool{"index.redis.password": true, "server.upstreamRules.0.password": true}, cfg.secrets)
+
+	// missing secret files are errors
+	file = writeConfig(t, testConfig, map[string]string{
+		"secrets.yaml": "index:\n  redis:\n    password: file:///missing/password\n",
+	})
+	_, err = LoadAndValidateConfig(file)
+	assert.NotNil(t, err)
+}
+
+func TestRedactedConfig(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "key-id")
+	os.WriteFile(secret, []byte("AKIA"), 0600)
+
+	file := writeConfig(t, testConfig, map[string]string{
+		"secrets.yaml": "storage:\n  s3:\n    accessKeyID: file://" + secret + "\n    secretAccessKey: s3-secret\n" +
+			"index:\n  redis:\n    username: default\n    password: redis-password\n" +
+			"server:\n  upstreamRules:\n  - host: myregistry.com\n    scheme: https\n    regex: myregistry\n" +
+			"    username: robot\n    password: rule-password\n",
+	})
+	cfg, err := LoadAndValidateConfig(file)
+	assert.Nil(t, err)
+
+	content, err := RedactedConfig(cfg)
+	assert.Nil(t, err)
+	for _, value := range []string{"AKIA", "s3-secret", "redis-password", "rule-password"} {
+		assert.NotContains(t, string(content), value)
+	}
+	assert.Contains(t, string(content), "robot")
+	assert.Contains(t, string(content), "default")
+
+	// the config itself is unchanged
+	assert.Equal(t, "rule-password", cfg.Server.UpstreamRules[0]["password"])
+	assert.Equal(t, "AKIA", cfg.Storage.S3.AccessKeyID)
+}
+
+func TestUpstreamRulesCredentials(t *testing.T) {
+	rule := map[string]string{"host": "myregistry.com", "scheme": "https", "regex": "myregistry", "username": "robot", "password": "secret"}
+	urules, err := getUpstreamRules([]map[string]string{rule})
+	assert.Nil(t, err)
+	assert.NotNil(t, urules[0].Credentials())
+
+	// the tokens of the proxy would be served to the clients
+	rule["rewriterealm"] = "true"
+	_, err = getUpstreamRules([]map[string]string{rule})
+	assert.ErrorContains(t, err, "rewriteRealm")
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	policyClientIP string
+	policyIdentity string
+	policyGroups   []string
+	policyHost     string
+	policyMethod   string
+	policyCmd      = &cobra.Command{
+		Use:   "policy",
+		Short: "Access policy tools",
+	}
+	policyTestCmd = &cobra.Command{
+		Use:   "test <policy file> <path>",
+		Short: "Show which rule of a policy file matches a request, e.g.: test policy.yaml /v2/library/alpine/manifests/latest",
+		Args:  cobra.ExactArgs(2),
+		Run:   policyTest,
+	}
+)
+
+func init() {
+	policyTestCmd.Flags().StringVarP(&policyClientIP, "client-ip", "i", "127.0.0.1", "IP address of the client")
+	policyTestCmd.Flags().StringVarP(&policyIdentity, "identity", "u", "", "identity of the authenticated client")
+	policyTestCmd.Flags().StringSliceVarP(&policyGroups, "groups", "g", nil, "groups of the authenticated client")
+	policyTestCmd.Flags().StringVarP(&policyHost, "host", "H", "", "Host header of the request")
+	policyTestCmd.Flags().StringVarP(&policyMethod, "method", "X", "GET", "method of the request")
+
+	policyCmd.AddCommand(policyTestCmd)
+	rootCmd.AddCommand(policyCmd)
+}
+
+func policyTest(c *cobra.Command, args []string) {
+
+	p, err := policy.LoadPolicy(args[0])
+	if err != nil {
+		logrus.Fatalln("invalid policy:", err)
+	}
+
+	ip := net.ParseIP(policyClientIP)
+	if ip == nil {
+		logrus.Fatalf("invalid client IP '%s'", policyClientIP)
+	}
+
+	req := &policy.Request{
+		ClientIP:   ip,
+		Identity:   policyIdentity,
+		Groups:     policyGroups,
+		Host:       policyHost,
+		Repository: cache.ComputeRepository(args[1]),
+		Method:     strings.ToUpper(policyMethod),
+		ItemType:   cache.ComputeItemType(args[1]),
+	}
+	d := p.Evaluate(req)
+
+	fmt.Printf("request: %s %s%s (repository: '%s', item type: '%s') from %s, identity: '%s'\n",
+		req.Method, req.Host, args[1], req.Repository, req.ItemType, req.ClientIP, req.Identity)
+	if d.Rule == policy.DEFAULT_RULE {
+		fmt.Printf("no rule matched, default action: %s\n", d.Action)
+		return
+	}
+	fmt.Printf("rule '%s' matched, action: %s\n", d.Rule, d.Action)
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	DEFAULT_ADMIN_ADDRESS = "https://localhost:3001"
+
+	// how often the progress of a prefetch is polled
+	PREFETCH_POLL_INTERVAL = time.Second
+)
+
+var (
+	adminAddresses   []string
+	adminCAPath      string
+	adminServerName  string
+	adminInsecure    bool
+	prefetchPlatform string
+	prefetchUser     string
+	prefetchCmd      = &cobra.Command{
+		Use:   "prefetch <image:tag>",
+		Short: "Pull an image into the cache of running registry caches",
+		Args:  cobra.ExactArgs(1),
+		Run:   prefetch,
+	}
+)
+
+func init() {
+	prefetchCmd.Flags().StringSliceVarP(&adminAddresses, "address", "a", []string{DEFAULT_ADMIN_ADDRESS}, "admin address of the registry cache, repeated to prefetch on every replica")
+	prefetchCmd.Flags().StringVar(&adminCAPath, "ca", "", "CA of the certificate of the registry cache, the system ones if empty")
+	prefetchCmd.Flags().StringVar(&adminServerName, "server-name", "", "name verified in the certificate of the registry cache, the host of the address if empty")
+	prefetchCmd.Flags().BoolVar(&adminInsecure, "insecure", false, "skip the verification of the certificate of the registry cache")
+	prefetchCmd.Flags().StringVarP(&prefetchPlatform, "platform", "p", "", "only prefetch this platform of image indexes (os/architecture[/variant])")
+	prefetchCmd.Flags().StringVarP(&prefetchUser, "user", "u", "", "credentials (username:password) of the client authentication, or of the upstream if it's disabled")
+
+	rootCmd.AddCommand(prefetchCmd)
+}
+
+// Client of the admin API, the certificate of the proxy is usually issued for its public name and not for the address of a replica
+func getAdminClient(caPath, serverName string, insecure bool) (*http.Client, error) {
+
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+	if caPath != "" {
+		caCert, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+func getPrefetchJob(resp *http.Response) (*proxy.PrefetchJob, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		msg := make([]byte, 1024)
+		n, _ := resp.Body.Read(msg)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg[:n])))
+	}
+
+	job := &proxy.PrefetchJob{}
+	err := json.NewDecoder(resp.Body).Decode(job)
+	return job, err
+}
+
+func sendPrefetchRequest(client *http.Client, method, url string) (*proxy.PrefetchJob, error) {
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prefetchUser != "" {
+		username, password, _ := strings.Cut(prefetchUser, ":")
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return getPrefetchJob(resp)
+}
+
+// Start the prefetch of the image on the registry cache at address and poll its progress until it's finished
+func prefetchImage(client *http.Client, address, image string, interval time.Duration) (*proxy.PrefetchJob, error) {
+
+	address = strings.TrimSuffix(address, "/")
+	query := url.Values{"image": []string{image}}
+	if prefetchPlatform != "" {
+		query.Set("platform", prefetchPlatform)
+	}
+
+	job, err := sendPrefetchRequest(client, http.MethodPost, address+"/prefetch?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start prefetch: %v", err)
+	}
+
+	for job.Status == proxy.PREFETCH_RUNNING {
+		time.Sleep(interval)
+
+		job, err = sendPrefetchRequest(client, http.MethodGet, fmt.Sprintf("%s/prefetch?id=%d", address, job.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get prefetch progress: %v", err)
+		}
+
+		fmt.Printf("%s %s: %d manifests, %d/%d blobs, %d failed, %d bytes\n",
+			address, job.Image, job.Manifests, job.Done, job.Blobs, job.Failed, job.Bytes)
+	}
+	return job, nil
+}
+
+func prefetch(c *cobra.Command, args []string) {
+
+	client, err := getAdminClient(adminCAPath, adminServerName, adminInsecure)
+	if err != nil {
+		logrus.Fatalln("error loading CA:", err)
+	}
+
+	// the replicas don't share their caches, the image is prefetched on each of them
+	failed := int32(0)
+	wg := &sync.WaitGroup{}
+	for _, address := range adminAddresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			log := logrus.WithField("address", address)
+			job, err := prefetchImage(client, address, args[0], PREFETCH_POLL_INTERVAL)
+			if err != nil {
+				log.Errorln(err)
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			for _, e := range job.Errors {
+				log.Errorln(e)
+			}
+			if job.Status != proxy.PREFETCH_DONE {
+				log.Errorf("prefetch of %s failed", job.Image)
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			log.Infof("prefetch of %s done in %s", job.Image, job.Finished.Sub(job.Started).Round(time.Millisecond))
+		}(address)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		logrus.Fatalf("prefetch of %s failed on %d/%d registry caches", args[0], failed, len(adminAddresses))
+	}
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchServerName(t *testing.T) {
+	admin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusAccepted
+		job := proxy.PrefetchJob{ID: 1, Image: r.URL.Query().Get("image"), Status: proxy.PREFETCH_RUNNING}
+		if r.Method == http.MethodGet {
+			status = http.StatusOK
+			job.Image, job.Status = "app:v1", proxy.PREFETCH_DONE
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(job)
+	}))
+	defer admin.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: admin.Certificate().Raw}), 0600)
+	// the certificate of the test server is issued for example.com
+	address := strings.Replace(admin.URL, "127.0.0.1", "localhost", 1)
+
+	client, err := getAdminClient(ca, "", false)
+	assert.Nil(t, err)
+	_, err = prefetchImage(client, address, "app:v1", time.Millisecond)
+	assert.ErrorContains(t, err, "certificate")
+
+	client, err = getAdminClient(ca, "example.com", false)
+	assert.Nil(t, err)
+	job, err := prefetchImage(client, address, "app:v1", time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, proxy.PREFETCH_DONE, job.Status)
+
+	client, err = getAdminClient("", "", true)
+	assert.Nil(t, err)
+	_, err = prefetchImage(client, address, "app:v1", time.Millisecond)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/gc"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/ish-xyz/registry-cache/pkg/token"
+	"github.com/ish-xyz/registry-cache/pkg/worker"
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader applies the changes of the config files to the running proxy, gc and worker.
+// Upstream rules, gc intervals and limits, ttls and the log level are reloaded, the other settings require a restart.
+// The policy, htpasswd, JWKS and upstream token files are reloaded too when they change
+// Optional dependencies of the reloader, their files aren't reloaded if nil
+type ReloaderOptions struct {
+	ClientAuth *auth.Authenticator
+	Policy     *policy.Engine
+	// the token cache is created at startup only if an upstream needs it
+	Tokens bool
+}
+
+type Reloader struct {
+	path    string
+	current *Config
+	// modification times and sizes of the config files
+	state  string
+	proxy  *proxy.Proxy
+	gc     *gc.GarbageCollector
+	worker *worker.Worker
+	// upstream rules applied to the proxy, for their token files
+	rules []*proxy.UpstreamRule
+	// nil if disabled
+	clientAuth *auth.Authenticator
+	policy     *policy.Engine
+	// the token cache is created at startup only if an upstream needs it
+	tokens bool
+	log    *logrus.Entry
+}
+
+func NewReloader(path string, cfg *Config, p *proxy.Proxy, g *gc.GarbageCollector, w *worker.Worker, urules []*proxy.UpstreamRule, opts ReloaderOptions) *Reloader {
+	rl := &Reloader{
+		path:       path,
+		current:    cfg,
+		proxy:      p,
+		gc:         g,
+		worker:     w,
+		rules:      urules,
+		clientAuth: opts.ClientAuth,
+		policy:     opts.Policy,
+		tokens:     opts.Tokens,
+		log:        logrus.WithField("name", "reloader"),
+	}
+	rl.changed()
+	return rl
+}
+
+// Reload the config on the signals of hup and when the files change
+func (rl *Reloader) Watch(hup <-chan os.Signal) {
+
+	ticker := time.NewTicker(CONFIG_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			rl.ReloadFiles()
+			// the files changed since the last check aren't reloaded again by the next one
+			rl.changed()
+			rl.log.Infoln("reloading config on signal")
+		case <-ticker.C:
+			rl.ReloadFiles()
+			if !rl.changed() {
+				continue
+			}
+			rl.log.Infoln("reloading config, the files changed")
+		}
+
+		err := rl.Reload()
+		if err != nil {
+			metrics.ConfigReloads.WithLabelValues("failed").Inc()
+			rl.log.Errorf("failed to reload config, keeping the previous one: %v", err)
+			continue
+		}
+		metrics.ConfigReloads.WithLabelValues("applied").Inc()
+		metrics.ConfigLastReload.SetToCurrentTime()
+		rl.log.Infoln("config reloaded")
+	}
+}
+
+// The files are compared by modification time and size, e.g.: configmaps are replaced by a symlink swap.
+// Secret files aren't watched, they're read again on SIGHUP
+func (rl *Reloader) changed() bool {
+	files, err := ConfigFiles(rl.path)
+	if err != nil {
+		return false
+	}
+	state := ""
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		state += fmt.Sprintf("%s %d %d\n", f, info.ModTime().UnixNano(), info.Size())
+	}
+	if state == rl.state {
+		return false
+	}
+	rl.state = state
+	return true
+}
+
+// Load the files referenced by the config again if they changed, the requests read them from memory only
+func (rl *Reloader) ReloadFiles() {
+	if rl.policy != nil {
+		rl.policy.Reload()
+	}
+	if rl.clientAuth != nil {
+		rl.clientAuth.Reload()
+	}
+	for _, u := range rl.rules {
+		if c, ok := u.Credentials().(*token.FileCredentials); ok {
+			err := c.Reload()
+			if err != nil {
+				rl.log.Errorf("failed to reload the upstream token, keeping the previous one: %v", err)
+			}
+		}
+	}
+}
+
+// Load, validate and apply the config file. Nothing is applied if it's invalid
+func (rl *Reloader) Reload() error {
+
+	cfg, err := LoadAndValidateConfig(rl.path)
+	if err != nil {
+		return err
+	}
+
+	urules, err := getUpstreamRules(cfg.Server.UpstreamRules)
+	if err != nil {
+		return err
+	}
+	if !rl.tokens {
+		for _, u := range urules {
+			if u.RewriteRealm() || u.Credentials() != nil {
+				return fmt.Errorf("rewriteRealm and upstream credentials require a restart when no upstream used them at startup")
+			}
+		}
+	}
+	gcSettings, err := getGCSettings(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid gc disk watermarks: %v", err)
+	}
+
+	if !reflect.DeepEqual(restartOnly(cfg), restartOnly(rl.current)) {
+		rl.log.Warningln("the config has changes that are applied only after a restart")
+	}
+	if (cfg.Tags.TTL > 0) != (rl.current.Tags.TTL > 0) {
+		rl.log.Warningln("enabling or disabling the tags cache requires a restart")
+	}
+	if (cfg.Auth.CacheTTL > 0 || cfg.Auth.NegativeCacheTTL > 0) != (rl.current.Auth.CacheTTL > 0 || rl.current.Auth.NegativeCacheTTL > 0) {
+		rl.log.Warningln("enabling or disabling the authorization cache requires a restart")
+	}
+
+	setLogLevel(cfg.LogLevel)
+	rl.proxy.SetUpstreamRules(urules, cfg.Server.DefaultBackend.Host, cfg.Server.DefaultBackend.Scheme)
+	rl.gc.Update(gcSettings)
+	rl.worker.SetTTLs(cfg.Tags.TTL, cfg.Auth.CacheTTL, cfg.Auth.NegativeCacheTTL)
+
+	rl.rules = urules
+	rl.current = cfg
+	return nil
+}
+
+// Settings of the config that aren't reloaded
+func restartOnly(cfg *Config) Config {
+	c := *cfg
+	c.secrets = nil
+	c.LogLevel = ""
+	c.Server.UpstreamRules = nil
+	c.Server.DefaultBackend.Host = ""
+	c.Server.DefaultBackend.Scheme = ""
+	c.GC.Interval = 0
+	c.GC.Disk.MaxSize = ""
+	c.GC.Disk.TargetSize = ""
+	c.GC.Disk.MinFree = ""
+	c.GC.Disk.TargetFree = ""
+	c.GC.Disk.MinFreeInodes = 0
+	c.GC.Disk.TargetFreeInodes = 0
+	c.GC.Layers.CheckSHA = false
+	c.GC.Layers.MaxAge = 0
+	c.GC.Layers.MaxUnused = 0
+	c.GC.Manifests.MaxAge = 0
+	c.GC.Manifests.MaxUnused = 0
+	c.GC.Partials.MaxUnused = 0
+	c.Tags.TTL = 0
+	c.Auth.CacheTTL = 0
+	c.Auth.NegativeCacheTTL = 0
+	return c
+}
+
+// --debug and --trace take precedence over the log level of the config
+func setLogLevel(level string) {
+	switch {
+	case trace:
+		logrus.SetLevel(logrus.TraceLevel)
+	case debug:
+		logrus.SetLevel(logrus.DebugLevel)
+	case level != "":
+		lvl, _ := logrus.ParseLevel(level)
+		logrus.SetLevel(lvl)
+	default:
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+}
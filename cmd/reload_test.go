@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/gc"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/ish-xyz/registry-cache/pkg/token"
+	"github.com/ish-xyz/registry-cache/pkg/worker"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Reloader of the config file with a gc, a worker caching the tags and a proxy
+func newTestReloader(t *testing.T, file string) (*Reloader, cache.Cache, cache.Index, *cache.TagCache) {
+	cfg, err := LoadAndValidateConfig(file)
+	assert.Nil(t, err)
+	urules, err := getUpstreamRules(cfg.Server.UpstreamRules)
+	assert.Nil(t, err)
+
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+	settings, err := getGCSettings(cfg)
+	assert.Nil(t, err)
+	g := gc.NewGarbageCollector(c, idx, settings, gc.Options{})
+	tags := cache.NewTagCache(cfg.Tags.TTL)
+	w := worker.NewWorker(c, idx, http.DefaultClient, worker.Options{GC: g, Tags: tags})
+	p := proxy.NewProxy(w, "", c.GetDataPath(), cfg.Server.DefaultBackend.Host, cfg.Server.DefaultBackend.Scheme, "", "", urules, proxy.Options{})
+
+	return NewReloader(file, cfg, p, g, w, urules, ReloaderOptions{}), c, idx, tags
+}
+
+// Layer file stored, then changed on disk so that it doesn't match its digest anymore
+func createCorruptLayer(t *testing.T, c cache.Cache, idx cache.Index) cache.DataFile {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("helloworld")))
+	df, _ := cache.ComputeLayerFile(c.GetDataPath(), digest)
+	cr := &cache.CacheRequest{
+		CacheEnabled:     true,
+		CacheKey:         cache.CacheKey(digest),
+		DataFile:         df,
+		ResponseFilePath: cache.ComputeResponseFilePath(string(df)),
+	}
+	idx.Put(cr.CacheKey, cr.DataFile)
+	err := c.Create(cr, cache.NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+	assert.Nil(t, err)
+	idx.SetStatus(cr.CacheKey, cache.STATUS_AVAILABLE)
+	os.WriteFile(string(df), []byte("corrupted!"), 0666)
+	return df
+}
+
+func TestReload(t *testing.T) {
+	file := writeConfig(t, testConfig+"tags:\n  ttl: 1h\n", nil)
+	rl, c, idx, tags := newTestReloader(t, file)
+	df := createCorruptLayer(t, c, idx)
+	entry := cache.TagEntry{Validated: time.Now().Add(-time.Minute)}
+
+	// the layers are checked from the next run of the gc
+	rl.gc.Try()
+	assert.FileExists(t, string(df))
+	assert.True(t, tags.Fresh(entry))
+
+	// gc, worker and proxy settings
+	content := strings.Replace(testConfig, "  layers:\n", "  layers:\n    checkSHA: true\n", 1)
+	content = strings.Replace(content, "    regex: docker.io\n", "    regex: docker.io\n  - host: quay.io\n    scheme: https\n    regex: quay\n", 1)
+	os.WriteFile(file, []byte(content+"tags:\n  ttl: 30s\n"), 0600)
+	assert.True(t, rl.changed())
+
+	err := rl.Reload()
+	assert.Nil(t, err)
+	assert.True(t, rl.current.GC.Layers.CheckSHA)
+	assert.Len(t, rl.rules, 2)
+	assert.False(t, tags.Fresh(entry))
+	rl.gc.Try()
+	assert.NoFileExists(t, string(df))
+}
+
+func TestReloadInvalid(t *testing.T) {
+	file := writeConfig(t, testConfig+"tags:\n  ttl: 1h\n", nil)
+	rl, _, _, tags := newTestReloader(t, file)
+	previous := rl.current
+
+	// nothing is applied
+	content := strings.Replace(testConfig, "workers: 2", "workers: 0", 1)
+	os.WriteFile(file, []byte(content+"tags:\n  ttl: 30s\n"), 0600)
+	err := rl.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, previous, rl.current)
+	assert.True(t, tags.Fresh(cache.TagEntry{Validated: time.Now().Add(-time.Minute)}))
+
+	// the token cache isn't created without upstreams using it at startup
+	content = strings.Replace(testConfig, "    regex: docker.io\n", "    regex: docker.io\n    rewriteRealm: \"true\"\n", 1)
+	os.WriteFile(file, []byte(content), 0600)
+	err = rl.Reload()
+	assert.ErrorContains(t, err, "require a restart")
+	assert.Equal(t, previous, rl.current)
+
+	content = strings.Replace(testConfig, "    regex: docker.io\n", "    regex: docker.io\n    username: robot\n    password: secret\n", 1)
+	os.WriteFile(file, []byte(content), 0600)
+	err = rl.Reload()
+	assert.ErrorContains(t, err, "require a restart")
+	assert.Equal(t, previous, rl.current)
+}
+
+func TestReloadRestartOnly(t *testing.T) {
+	file := writeConfig(t, testConfig, nil)
+	rl, _, _, _ := newTestReloader(t, file)
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	// applied to the other settings, the address stays the same until a restart
+	content := strings.Replace(testConfig, "address: 127.0.0.1:7000", "address: 127.0.0.1:7001", 1)
+	content = strings.Replace(content, "interval: 60s", "interval: 120s", 1)
+	os.WriteFile(file, []byte(content), 0600)
+	err := rl.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, 120*time.Second, rl.current.GC.Interval)
+
+	warnings := []string{}
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	assert.Equal(t, []string{"the config has changes that are applied only after a restart"}, warnings)
+
+	// no warning without restart-only changes
+	hook.Reset()
+	os.WriteFile(file, []byte(strings.Replace(content, "interval: 120s", "interval: 180s", 1)), 0600)
+	assert.Nil(t, rl.Reload())
+	for _, e := range hook.AllEntries() {
+		assert.NotEqual(t, logrus.WarnLevel, e.Level, e.Message)
+	}
+}
+
+func TestReloadFiles(t *testing.T) {
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.yaml")
+	os.WriteFile(policyFile, []byte("default: allow\n"), 0600)
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("first"), 0600)
+
+	engine, err := policy.NewEngine(policyFile)
+	assert.Nil(t, err)
+	credentials := token.NewFileCredentials(tokenFile, "")
+	u, err := proxy.NewUpstreamRule("myregistry.com", "https", "myregistry", false, credentials)
+	assert.Nil(t, err)
+	rl := &Reloader{policy: engine, rules: []*proxy.UpstreamRule{u}, log: logrus.WithField("name", "reloader")}
+
+	req := &policy.Request{ClientIP: net.ParseIP("10.0.0.1"), Method: "GET"}
+	authorization, _ := credentials.Authorization("myregistry.com")
+	assert.Equal(t, "Bearer first", authorization)
+
+	// the requests use the files loaded by the last reload
+	os.WriteFile(policyFile, []byte("default: deny\nrules: []\n"), 0600)
+	os.WriteFile(tokenFile, []byte("second"), 0600)
+	assert.Equal(t, policy.ACTION_ALLOW, engine.Evaluate(req).Action)
+
+	rl.ReloadFiles()
+	assert.Equal(t, policy.ACTION_DENY, engine.Evaluate(req).Action)
+	authorization, _ = credentials.Authorization("myregistry.com")
+	assert.Equal(t, "Bearer second", authorization)
+}
@@ -5,24 +5,33 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"syscall"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
 	"github.com/ish-xyz/registry-cache/pkg/gc"
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
 	"github.com/ish-xyz/registry-cache/pkg/proxy"
+	"github.com/ish-xyz/registry-cache/pkg/quota"
+	"github.com/ish-xyz/registry-cache/pkg/token"
 
 	"github.com/ish-xyz/registry-cache/pkg/worker"
 	"github.com/inhies/go-bytesize"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -67,6 +76,97 @@ func getHttpClientWithCA(capath string) (*http.Client, error) {
 	return client, nil
 }
 
+func getIndex(cfg *Config) (cache.Index, error) {
+
+	if cfg.Index.Type == INDEX_BOLT {
+		path := cfg.Index.Bolt.Path
+		if path == "" {
+			path = filepath.Join(cfg.DataPath, cache.INDEX_DB_FILE)
+		}
+		return cache.NewBoltIndex(path)
+	}
+
+	if cfg.Index.Type != INDEX_REDIS {
+		return cache.NewMemoryIndex(), nil
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      cfg.Index.Redis.Addresses,
+		MasterName: cfg.Index.Redis.MasterName,
+		Username:   cfg.Index.Redis.Username,
+		Password:   cfg.Index.Redis.Password,
+		DB:         cfg.Index.Redis.DB,
+	})
+	err := client.Ping(context.TODO()).Err()
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to redis: %v", err)
+	}
+
+	prefix := cfg.Index.Redis.Prefix
+	if prefix == "" {
+		prefix = DEFAULT_REDIS_PREFIX
+	}
+	return cache.NewRedisIndex(client, prefix), nil
+}
+
+func getCache(cfg *Config, idx cache.Index, policy eviction.Policy, pins *eviction.Pinned) (cache.Cache, error) {
+
+	if cfg.Storage.Type != STORAGE_S3 {
+		return cache.NewCache(idx, cfg.DataPath, policy), nil
+	}
+
+	// without static keys, use the environment or the instance role
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	if cfg.Storage.S3.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.Storage.S3.AccessKeyID, cfg.Storage.S3.SecretAccessKey, "")
+	}
+
+	region := cfg.Storage.S3.Region
+	if region == "" {
+		region = DEFAULT_S3_REGION
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.Storage.S3.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(cfg.Storage.S3.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !cfg.Storage.S3.Insecure,
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't create s3 client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cache.DEFAULT_S3_TIMEOUT)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Storage.S3.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to s3: %v", err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s not found", cfg.Storage.S3.Bucket)
+	}
+
+	return cache.NewS3Cache(
+		idx,
+		client,
+		cfg.Storage.S3.Bucket,
+		cfg.Storage.S3.Prefix,
+		cfg.DataPath,
+		cfg.Storage.S3.PresignExpiry,
+		pins,
+	), nil
+}
+
 func start(c *cobra.Command, args []string) {
 
 	logrus.SetFormatter(&logrus.TextFormatter{
@@ -87,10 +187,11 @@ func start(c *cobra.Command, args []string) {
 	if err != nil {
 		logrus.Fatal("failed to load/validate config: \n", err)
 	}
+	setLogLevel(cfg.LogLevel)
 
 	logrus.Infoln("configuration:")
 	fmt.Println("GOMAXPROCS =", runtime.GOMAXPROCS(0))
-	yamlData, err := yaml.Marshal(cfg)
+	yamlData, err := RedactedConfig(cfg)
 	if err == nil {
 		fmt.Println(string(yamlData))
 	} else {
@@ -98,31 +199,116 @@ func start(c *cobra.Command, args []string) {
 	}
 
 	logrus.Infoln("initializing cache...")
-	indexObj := cache.NewMemoryIndex()
 	err = os.MkdirAll(cfg.DataPath, 0777)
 	if err != nil {
 		logrus.Fatalln("failed to create folder for data", err)
 	}
 
-	cacheObj := cache.NewCache(indexObj, cfg.DataPath)
-	err = cacheObj.Restore()
+	indexObj, err := getIndex(cfg)
+	if err != nil {
+		logrus.Fatalln("failed to initialize index:", err)
+	}
+
+	evictionPolicy, err := eviction.New(cfg.GC.Disk.Policy)
+	if err != nil {
+		logrus.Fatalln("failed to initialize eviction policy:", err)
+	}
+
+	// the files of the owners above their quota are evicted first
+	var tracker *quota.Tracker
+	quotas, err := getQuotas(cfg)
 	if err != nil {
-		logrus.Warningln("failed to restore index:", err)
+		logrus.Fatalln("invalid quotas:", err)
+	}
+	if len(quotas) > 0 {
+		if cfg.Storage.Type == STORAGE_S3 {
+			logrus.Fatalln("quotas can't be used with the s3 storage")
+		}
+		tracker, err = quota.NewTracker(evictionPolicy, indexObj, cfg.GC.Disk.Policy, quotas)
+		if err != nil {
+			logrus.Fatalln("failed to initialize quotas:", err)
+		}
+		metrics.RegisterQuotas(tracker)
+		evictionPolicy = tracker
 	}
 
+	// pinned files are kept out of the eviction policy
+	pinnedPolicy := eviction.NewPinned(evictionPolicy)
+
+	cacheObj, err := getCache(cfg, indexObj, pinnedPolicy, pinnedPolicy)
+	if err != nil {
+		logrus.Fatalln("failed to initialize cache:", err)
+	}
+
+	// caches created by older versions store the files flat in the data path
+	migrated := 0
+	localCache, isLocal := cacheObj.(*cache.LocalCache)
+	if isLocal {
+		migrated, err = localCache.Migrate()
+		if err != nil {
+			logrus.Fatalln("failed to migrate data path to the sharded layout:", err)
+		}
+	}
+
+	// in-memory tier for small files, disabled if maxSize isn't set
+	if cfg.Storage.Memory.MaxSize != "" {
+		maxSize, _ := bytesize.Parse(cfg.Storage.Memory.MaxSize)
+		maxObjectSize, _ := bytesize.Parse(DEFAULT_MEMORY_MAX_OBJECT_SIZE)
+		if cfg.Storage.Memory.MaxObjectSize != "" {
+			maxObjectSize, _ = bytesize.Parse(cfg.Storage.Memory.MaxObjectSize)
+		}
+		memoryCache := cache.NewMemoryCache(cacheObj, indexObj, int64(maxSize), int64(maxObjectSize))
+		metrics.RegisterMemoryCache(memoryCache)
+		cacheObj = memoryCache
+	}
+
+	// lower tier shared by the replicas, disabled if path isn't set
+	if cfg.Storage.L2.Path != "" {
+		if cfg.Storage.Type == STORAGE_S3 {
+			logrus.Fatalln("the l2 tier can't be used with the s3 storage")
+		}
+		err = os.MkdirAll(cfg.Storage.L2.Path, 0777)
+		if err != nil {
+			logrus.Fatalln("failed to create folder for the l2 tier", err)
+		}
+		// no size limit if maxSize isn't set
+		var maxSize bytesize.ByteSize
+		if cfg.Storage.L2.MaxSize != "" {
+			maxSize, _ = bytesize.Parse(cfg.Storage.L2.MaxSize)
+		}
+		cacheObj = cache.NewTieredCache(cacheObj, cfg.Storage.L2.Path, int64(maxSize), cfg.Storage.L2.MaxUnused)
+	}
+
+	// the persistent index survives restarts, walk the data directory only the first time
+	if cfg.Index.Type != INDEX_BOLT || indexObj.Len() == 0 || migrated > 0 {
+		err = cacheObj.Restore()
+		if err != nil {
+			logrus.Warningln("failed to restore index:", err)
+		}
+	}
+
+	// the eviction policy and the disk usage are kept in memory, rebuild them from the index
+	if isLocal {
+		localCache.Rebuild()
+	}
+
+	logrus.Infoln("initializing pins...")
+	pinner, err := pin.NewPinner(cacheObj, indexObj, pinnedPolicy, pin.ComputePinsFile(cfg.DataPath), cfg.GC.Pins)
+	if err != nil {
+		logrus.Fatalln("invalid pins:", err)
+	}
+	err = pinner.Load()
+	if err != nil {
+		logrus.Warningln("failed to load pins:", err)
+	}
+	metrics.RegisterPinner(pinner)
+
 	logrus.Infoln("initializing garbageCollector...")
-	maxSize, _ := bytesize.Parse(cfg.GC.Disk.MaxSize)
-	gcObj := gc.NewGarbageCollector(
-		cacheObj,
-		indexObj,
-		maxSize,
-		cfg.GC.Layers.CheckSHA,
-		cfg.GC.Interval,
-		cfg.GC.Manifests.MaxAge,
-		cfg.GC.Manifests.MaxUnused,
-		cfg.GC.Layers.MaxAge,
-		cfg.GC.Layers.MaxUnused,
-	)
+	gcSettings, err := getGCSettings(cfg)
+	if err != nil {
+		logrus.Fatalln("invalid gc disk watermarks:", err)
+	}
+	gcObj := gc.NewGarbageCollector(cacheObj, indexObj, gcSettings, gc.Options{Pins: pinner, Quotas: tracker})
 
 	logrus.Infoln("initializing  workers...")
 	httpClient, err := getHttpClientWithCA(cfg.Server.TLS.CAPath)
@@ -130,24 +316,86 @@ func start(c *cobra.Command, args []string) {
 		logrus.Fatalln("error loading CA:", err)
 	}
 
-	workerObj := worker.NewWorker(cacheObj, indexObj, httpClient, gcObj)
-
-	logrus.Infoln("initializing  proxy...")
+	prefetch, err := getPrefetch(cfg)
+	if err != nil {
+		logrus.Fatalln("invalid prefetch config:", err)
+	}
+	var tags *cache.TagCache
+	if cfg.Tags.TTL > 0 {
+		tags = cache.NewTagCache(cfg.Tags.TTL)
+	}
+	var auth *cache.AuthCache
+	if cfg.Auth.CacheTTL > 0 || cfg.Auth.NegativeCacheTTL > 0 {
+		auth = cache.NewAuthCache(cfg.Auth.CacheTTL, cfg.Auth.NegativeCacheTTL)
+		metrics.RegisterAuthCache(auth)
+	}
 	urules, err := getUpstreamRules(cfg.Server.UpstreamRules)
 	if err != nil {
 		logrus.Fatalln(err)
 	}
+	// tokens are issued through the proxy when it rewrites the realm of an upstream or owns its credentials
+	var tokens *token.Cache
+	for _, u := range urules {
+		if u.RewriteRealm() || u.Credentials() != nil {
+			tokens = token.NewCache(httpClient)
+			break
+		}
+	}
+	workerObj := worker.NewWorker(cacheObj, indexObj, httpClient, worker.Options{
+		GC:       gcObj,
+		Pins:     pinner,
+		Prefetch: prefetch,
+		Tags:     tags,
+		Auth:     auth,
+		Tokens:   tokens,
+	})
+
+	logrus.Infoln("initializing  proxy...")
+	clientAuth, err := getClientAuth(cfg)
+	if err != nil {
+		logrus.Fatalln("invalid client authentication:", err)
+	}
+	adminServer, err := getAdmin(cfg, clientAuth)
+	if err != nil {
+		logrus.Fatalln("invalid admin config:", err)
+	}
+	adminServer.Handle("/pins", pinner)
+	var policyEngine *policy.Engine
+	if cfg.Policy.Path != "" {
+		policyEngine, err = policy.NewEngine(cfg.Policy.Path)
+		if err != nil {
+			logrus.Fatalln("invalid policy:", err)
+		}
+	}
+	var webhook *policy.Webhook
+	if cfg.Policy.Webhook.URL != "" {
+		timeout := cfg.Policy.Webhook.Timeout
+		if timeout <= 0 {
+			timeout = policy.DEFAULT_WEBHOOK_TIMEOUT
+		}
+		webhookClient := &http.Client{Transport: httpClient.Transport, Timeout: timeout}
+		webhook = policy.NewWebhook(cfg.Policy.Webhook.URL, webhookClient, cfg.Policy.Webhook.CacheTTL, cfg.Policy.Webhook.FailOpen)
+	}
 	proxyObj := proxy.NewProxy(
 		workerObj,
 		cfg.Server.Address,
-		cfg.DataPath,
+		cacheObj.GetDataPath(),
 		cfg.Server.DefaultBackend.Host,
 		cfg.Server.DefaultBackend.Scheme,
 		cfg.Server.TLS.CertPath,
 		cfg.Server.TLS.KeyPath,
 		urules,
+		proxy.Options{
+			Tokens:     tokens,
+			ClientAuth: clientAuth,
+			Policy:     policyEngine,
+			Webhook:    webhook,
+		},
 	)
+	adminServer.Handle("/prefetch", proxy.NewPrefetcher(proxyObj))
+
 	go metrics.Run(cfg.Metrics.Address, indexObj)
+	go adminServer.Run()
 	go gcObj.Start()
 
 	proxyDone := &sync.WaitGroup{}
@@ -155,6 +403,16 @@ func start(c *cobra.Command, args []string) {
 
 	srv := proxyObj.Start(cfg.Server.Workers, debug, proxyDone)
 
+	// upstream rules, gc settings, ttls and log level are reloaded on SIGHUP and when the file changes,
+	// the policy, htpasswd, jwks and token files when they change
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go NewReloader(configFile, cfg, proxyObj, gcObj, workerObj, urules, ReloaderOptions{
+		ClientAuth: clientAuth,
+		Policy:     policyEngine,
+		Tokens:     tokens != nil,
+	}).Watch(hup)
+
 	// set up signal capturing
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
@@ -171,5 +429,9 @@ func start(c *cobra.Command, args []string) {
 
 	proxyDone.Wait()
 
+	if closer, ok := indexObj.(io.Closer); ok {
+		closer.Close()
+	}
+
 	logrus.Infoln("shutting down proxy: done")
 }
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Clients are authenticated by clientAuth, if it isn't nil, and only the users listed are allowed.
+// The server uses the certificate of the proxy
+func NewServer(address, certPath, keyPath string, clientAuth *auth.Authenticator, users []string) *Server {
+	s := &Server{
+		address:    address,
+		certPath:   certPath,
+		keyPath:    keyPath,
+		mux:        http.NewServeMux(),
+		clientAuth: clientAuth,
+		users:      make(map[string]bool),
+		log:        logrus.WithField("name", "admin"),
+	}
+	for _, u := range users {
+		s.users[u] = true
+	}
+	return s
+}
+
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Admin entrypoint, the identity of the client is set in the context of the request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if s.clientAuth != nil {
+		identity, err := s.clientAuth.Authenticate(r)
+		if err != nil {
+			metrics.ClientAuthFailures.Inc()
+			s.log.Warningf("client %s not authenticated for %s: %v", r.RemoteAddr, r.URL.Path, err)
+			if challenge := s.clientAuth.Challenge(); challenge != "" {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if identity.Method == auth.METHOD_ANONYMOUS || !s.users[identity.Name] {
+			s.log.Warningf("%s (%s) isn't allowed to use %s %s", identity.Name, r.RemoteAddr, r.Method, r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) Run() {
+
+	srv := http.Server{
+		Addr:              s.address,
+		Handler:           s,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if s.clientAuth != nil {
+		srv.TLSConfig = s.clientAuth.TLSConfig()
+	}
+
+	s.log.Infoln("starting admin server on", s.address)
+	err := srv.ListenAndServeTLS(s.certPath, s.keyPath)
+	if err != nil {
+		s.log.Fatalln(err)
+	}
+}
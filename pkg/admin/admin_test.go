@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := ""
+	for _, user := range []string{"admin", "developer"} {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		content += fmt.Sprintf("%s:%s\n", user, hash)
+	}
+	os.WriteFile(path, []byte(content), 0600)
+	htpasswd, err := auth.NewHtpasswd(path)
+	assert.Nil(t, err)
+
+	s := NewServer("", "", "", auth.NewAuthenticator(htpasswd, nil, nil, true), []string{"admin"})
+	s.Handle("/pins", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, auth.GetIdentity(r).Name)
+	}))
+
+	serve := func(username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/pins?pattern=*", nil)
+		if username != "" {
+			r.SetBasicAuth(username, "password")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("admin")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "admin", w.Body.String())
+
+	// authenticated clients that aren't admins and anonymous ones are rejected
+	assert.Equal(t, http.StatusForbidden, serve("developer").Code)
+	assert.Equal(t, http.StatusForbidden, serve("").Code)
+}
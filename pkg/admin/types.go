@@ -0,0 +1,26 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_ADDRESS = "127.0.0.1:3001"
+)
+
+// Server serves the admin APIs (e.g.: pins, prefetch) on their own listener,
+// apart from the metrics and the debug handlers
+type Server struct {
+	address  string
+	certPath string
+	keyPath  string
+	mux      *http.ServeMux
+	// authentication of the clients, the admin API is open if nil
+	clientAuth *auth.Authenticator
+	// identities allowed to use the admin API
+	users map[string]bool
+	log   *logrus.Entry
+}
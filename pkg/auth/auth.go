@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Methods are disabled if htpasswd, jwks and clientCAs are nil,
+// clients without credentials are rejected unless allowAnonymous is true
+func NewAuthenticator(htpasswd *Htpasswd, jwks *JWKS, clientCAs *x509.CertPool, allowAnonymous bool) *Authenticator {
+	return &Authenticator{
+		htpasswd:       htpasswd,
+		jwks:           jwks,
+		clientCAs:      clientCAs,
+		allowAnonymous: allowAnonymous,
+		log:            logrus.WithField("name", "auth"),
+	}
+}
+
+// Client certificates are verified if given, clients without them can use the other methods
+func (a *Authenticator) TLSConfig() *tls.Config {
+	if a.clientCAs == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientCAs:  a.clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+}
+
+// Identity of the client of a request. The Authorization header is removed when it's used,
+// so that the credentials of the proxy aren't sent to the upstream
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+
+	authorization := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.htpasswd != nil:
+		username, password, _ := r.BasicAuth()
+		err := a.htpasswd.Verify(username, password)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Del("Authorization")
+		return &Identity{Name: username, Method: METHOD_HTPASSWD}, nil
+
+	case strings.EqualFold(scheme, "Bearer") && a.jwks != nil:
+		id, err := a.jwks.Verify(credentials)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Del("Authorization")
+		return id, nil
+	}
+
+	// verified by the TLS handshake
+	if a.clientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		return &Identity{
+			Name:   cert.Subject.CommonName,
+			Method: METHOD_MTLS,
+			Groups: cert.Subject.OrganizationalUnit,
+		}, nil
+	}
+
+	if a.allowAnonymous {
+		return &Identity{Name: ANONYMOUS, Method: METHOD_ANONYMOUS}, nil
+	}
+	return nil, fmt.Errorf("no valid credentials")
+}
+
+// Load the htpasswd and JWKS files again if they changed
+func (a *Authenticator) Reload() {
+	if a.htpasswd != nil {
+		a.htpasswd.Reload()
+	}
+	if a.jwks != nil {
+		a.jwks.Reload()
+	}
+}
+
+// Challenge returned to the clients that aren't authenticated
+func (a *Authenticator) Challenge() string {
+	if a.htpasswd != nil {
+		return fmt.Sprintf("Basic realm=%q", DEFAULT_REALM)
+	}
+	if a.jwks != nil {
+		return fmt.Sprintf("Bearer realm=%q", DEFAULT_REALM)
+	}
+	return ""
+}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey("identity"), id)
+}
+
+// Identity of the client of a request, nil if client authentication is disabled
+func GetIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(contextKey("identity")).(*Identity)
+	return id
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, users map[string]string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := ""
+	for user, password := range users {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		content += fmt.Sprintf("%s:%s\n", user, hash)
+	}
+	os.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := encode(map[string]string{"alg": "ES256", "kid": "test"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	assert.Nil(t, err)
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, key *ecdsa.PrivateKey) string {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.FillBytes(make([]byte, 32)))
+	}
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "test", "crv": "P-256", "x": "%s", "y": "%s"}]}`, encode(key.X), encode(key.Y))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, []byte(jwks), 0600)
+	return path
+}
+
+func TestHtpasswd(t *testing.T) {
+	htpasswd, err := NewHtpasswd(writeHtpasswd(t, map[string]string{"alice": "secret"}))
+	assert.Nil(t, err)
+	a := NewAuthenticator(htpasswd, nil, nil, false)
+
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.SetBasicAuth("alice", "secret")
+	id, err := a.Authenticate(r)
+	assert.Nil(t, err)
+	assert.Equal(t, &Identity{Name: "alice", Method: METHOD_HTPASSWD}, id)
+	// not sent to the upstream
+	assert.Empty(t, r.Header.Get("Authorization"))
+
+	r.SetBasicAuth("alice", "wrong")
+	_, err = a.Authenticate(r)
+	assert.NotNil(t, err)
+
+	_, err = a.Authenticate(httptest.NewRequest("GET", "/v2/", nil))
+	assert.NotNil(t, err)
+	assert.Equal(t, `Basic realm="registry-cache"`, a.Challenge())
+
+	// the changes of the file are applied on reload
+	os.Rename(writeHtpasswd(t, map[string]string{"bob": "password"}), htpasswd.path)
+	r.SetBasicAuth("alice", "secret")
+	_, err = a.Authenticate(r)
+	assert.Nil(t, err)
+	a.Reload()
+	r.SetBasicAuth("alice", "secret")
+	_, err = a.Authenticate(r)
+	assert.NotNil(t, err)
+	r.SetBasicAuth("bob", "password")
+	_, err = a.Authenticate(r)
+	assert.Nil(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, err := NewJWKS(writeJWKS(t, key), "issuer", "registry-cache")
+	assert.Nil(t, err)
+	a := NewAuthenticator(nil, jwks, nil, true)
+
+	authenticate := func(claims map[string]interface{}) (*Identity, error) {
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.Header.Set("Authorization", "Bearer "+signJWT(t, key, claims))
+		return a.Authenticate(r)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	id, err := authenticate(map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": []string{"registry-cache"}, "exp": exp, "groups": []string{"builders"}})
+	assert.Nil(t, err)
+	assert.Equal(t, &Identity{Name: "ci", Method: METHOD_JWT, Groups: []string{"builders"}}, id)
+
+	_, err = authenticate(map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": "other", "exp": exp})
+	assert.NotNil(t, err)
+	_, err = authenticate(map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": "registry-cache", "exp": time.Now().Add(-time.Hour).Unix()})
+	assert.NotNil(t, err)
+
+	// signed by another key
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.Header.Set("Authorization", "Bearer "+signJWT(t, other, map[string]interface{}{"sub": "ci", "iss": "issuer", "aud": "registry-cache", "exp": exp}))
+	_, err = a.Authenticate(r)
+	assert.NotNil(t, err)
+
+	// anonymous clients are allowed
+	id, err = a.Authenticate(httptest.NewRequest("GET", "/v2/", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, ANONYMOUS, id.Name)
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, log: logrus.WithField("name", "htpasswd")}
+	return h, h.Reload()
+}
+
+// Verify the password of a user
+func (h *Htpasswd) Verify(username, password string) error {
+
+	h.lock.RLock()
+	hash, ok := h.users[username]
+	key := sha256.Sum256([]byte(username + ":" + password))
+	verified := h.verified[key] == username
+	h.lock.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown user '%s'", username)
+	}
+	if verified {
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		return fmt.Errorf("invalid password for user '%s'", username)
+	}
+
+	h.lock.Lock()
+	// the users may have been reloaded during the comparison
+	if bytes.Equal(h.users[username], hash) {
+		h.verified[key] = username
+	}
+	h.lock.Unlock()
+	return nil
+}
+
+// Load the file again if it changed, called periodically by the config reloader.
+// The users loaded before are kept if the new file is invalid
+func (h *Htpasswd) Reload() error {
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		if h.users != nil {
+			return nil
+		}
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+
+	users, err := parseHtpasswd(h.path)
+	if err != nil && h.users == nil {
+		return err
+	}
+
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	if err != nil {
+		h.log.Errorf("failed to reload %s, keeping the previous users: %v", h.path, err)
+		return nil
+	}
+
+	h.lock.Lock()
+	h.users = users
+	h.verified = make(map[[32]byte]string)
+	h.lock.Unlock()
+	h.log.Infof("loaded %d users from %s", len(users), h.path)
+	return nil
+}
+
+func parseHtpasswd(path string) (map[string][]byte, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("invalid htpasswd line %d, only bcrypt is supported", n)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, nil
+}
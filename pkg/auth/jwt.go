@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The iss and aud claims are checked if issuer and audience aren't empty
+func NewJWKS(path, issuer, audience string) (*JWKS, error) {
+	j := &JWKS{
+		path:     path,
+		issuer:   issuer,
+		audience: audience,
+		log:      logrus.WithField("name", "jwks"),
+	}
+	return j, j.Reload()
+}
+
+// Verify the signature and the claims of a JWT, the identity is its subject
+func (j *JWKS) Verify(token string) (*Identity, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	header := &jwtHeader{}
+	err := decodeSegment(parts[0], header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+
+	key, err := j.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &jwtClaims{}
+	err = decodeSegment(parts[1], claims)
+	if err != nil {
+		return nil, err
+	}
+	err = j.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{Name: claims.Subject, Method: METHOD_JWT, Groups: claims.Groups}, nil
+}
+
+func (j *JWKS) key(kid string) (crypto.PublicKey, error) {
+
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	// tokens without kid are accepted when there's only one key
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key '%s'", kid)
+	}
+	return key, nil
+}
+
+func (j *JWKS) checkClaims(claims *jwtClaims) error {
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(JWT_LEEWAY)) {
+		return fmt.Errorf("jwt expired")
+	}
+	if claims.NotBefore != 0 && now.Add(JWT_LEEWAY).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("jwt not valid yet")
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("jwt without subject")
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return fmt.Errorf("unexpected jwt issuer '%s'", claims.Issuer)
+	}
+	if j.audience != "" && !hasAudience(claims.Audience, j.audience) {
+		return fmt.Errorf("jwt not issued for audience '%s'", j.audience)
+	}
+	return nil
+}
+
+// The aud claim is a string or a list of strings
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, input string, signature []byte) error {
+
+	hashes := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, []byte(input), signature) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+
+	hash, ok := hashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported jwt algorithm '%s'", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid jwt signature")
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("malformed jwt: %v", err)
+	}
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		return fmt.Errorf("malformed jwt: %v", err)
+	}
+	return nil
+}
+
+// Load the file again if it changed, called periodically by the config reloader.
+// The keys loaded before are kept if the new file is invalid
+func (j *JWKS) Reload() error {
+
+	info, err := os.Stat(j.path)
+	if err != nil {
+		if j.keys != nil {
+			return nil
+		}
+		return err
+	}
+	if j.keys != nil && info.ModTime().Equal(j.modTime) && info.Size() == j.size {
+		return nil
+	}
+
+	keys, err := parseJWKS(j.path)
+	if err != nil && j.keys == nil {
+		return err
+	}
+
+	j.modTime = info.ModTime()
+	j.size = info.Size()
+	if err != nil {
+		j.log.Errorf("failed to reload %s, keeping the previous keys: %v", j.path, err)
+		return nil
+	}
+
+	j.lock.Lock()
+	j.keys = keys
+	j.lock.Unlock()
+	j.log.Infof("loaded %d keys from %s", len(keys), j.path)
+	return nil
+}
+
+func parseJWKS(path string) (map[string]crypto.PublicKey, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err = json.Unmarshal(content, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s': %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
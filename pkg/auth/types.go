@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	METHOD_HTPASSWD  = "htpasswd"
+	METHOD_MTLS      = "mtls"
+	METHOD_JWT       = "jwt"
+	METHOD_ANONYMOUS = "anonymous"
+
+	ANONYMOUS = "anonymous"
+
+	DEFAULT_REALM = "registry-cache"
+
+	// clock skew tolerated on the exp and nbf claims of the JWTs
+	JWT_LEEWAY = time.Minute
+)
+
+type contextKey string
+
+// Identity of a client, available to logging, metrics and policies
+type Identity struct {
+	Name   string
+	Method string
+	// e.g.: groups claim of the JWTs, organizational units of the client certificates
+	Groups []string
+}
+
+// Authenticator verifies the clients of the proxy with htpasswd basic auth, client certificates or JWTs
+type Authenticator struct {
+	htpasswd       *Htpasswd
+	jwks           *JWKS
+	clientCAs      *x509.CertPool
+	allowAnonymous bool
+	log            *logrus.Entry
+}
+
+// Users of an htpasswd file (bcrypt only), reloaded by Reload when the file changes
+type Htpasswd struct {
+	path  string
+	users map[string][]byte
+	// modTime and size are used only by Reload
+	modTime time.Time
+	size    int64
+	// passwords already verified, bcrypt is slow on purpose
+	verified map[[32]byte]string
+	lock     sync.RWMutex
+	log      *logrus.Entry
+}
+
+// Keys of a local JWKS file, reloaded by Reload when the file changes
+type JWKS struct {
+	path     string
+	issuer   string
+	audience string
+	keys     map[string]crypto.PublicKey
+	// modTime and size are used only by Reload
+	modTime time.Time
+	size    int64
+	lock    sync.RWMutex
+	log     *logrus.Entry
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Groups    []string    `json:"groups"`
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// Results aren't cached if their ttl is 0
+func NewAuthCache(ttl, negativeTTL time.Duration) *AuthCache {
+	return &AuthCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[AuthCacheKey]authDecision),
+	}
+}
+
+// Cached result of a permission check, ok is false if it isn't cached or it's expired
+func (a *AuthCache) Get(key AuthCacheKey) (allowed bool, ok bool) {
+	if a == nil {
+		return false, false
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	decision, ok := a.entries[key]
+	if !ok || time.Now().After(decision.expires) {
+		return false, false
+	}
+	return decision.allowed, true
+}
+
+// Cache the status of a permission check, only successes and authentication or authorization failures are cached
+func (a *AuthCache) Set(key AuthCacheKey, status int) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	decision := authDecision{allowed: status == http.StatusOK}
+	switch {
+	case status == http.StatusOK && a.ttl > 0:
+		decision.expires = time.Now().Add(a.ttl)
+	case (status == http.StatusUnauthorized || status == http.StatusForbidden) && a.negativeTTL > 0:
+		decision.expires = time.Now().Add(a.negativeTTL)
+	default:
+		return
+	}
+
+	if len(a.entries) >= AUTH_CACHE_MAX_ENTRIES {
+		a.purge()
+	}
+	if len(a.entries) >= AUTH_CACHE_MAX_ENTRIES {
+		return
+	}
+	a.entries[key] = decision
+}
+
+// The results already cached keep their expiration
+func (a *AuthCache) SetTTL(ttl, negativeTTL time.Duration) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.ttl = ttl
+	a.negativeTTL = negativeTTL
+}
+
+func (a *AuthCache) purge() {
+	now := time.Now()
+	for key, decision := range a.entries {
+		if now.After(decision.expires) {
+			delete(a.entries, key)
+		}
+	}
+}
+
+func (a *AuthCache) Len() int {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return len(a.entries)
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthCache(t *testing.T) {
+	a := NewAuthCache(time.Hour, 50*time.Millisecond)
+
+	authKey := ComputeAuthKey("Bearer secret-token")
+	assert.False(t, strings.Contains(string(authKey), "secret-token"))
+
+	allowed := AuthCacheKey{AuthKey: authKey, Host: "quay.io", Repository: "org/app"}
+	denied := AuthCacheKey{AuthKey: authKey, Host: "quay.io", Repository: "org/private"}
+	failed := AuthCacheKey{AuthKey: authKey, Host: "quay.io", Repository: "org/other"}
+
+	a.Set(allowed, http.StatusOK)
+	a.Set(denied, http.StatusForbidden)
+	a.Set(failed, http.StatusServiceUnavailable)
+
+	result, ok := a.Get(allowed)
+	assert.True(t, ok)
+	assert.True(t, result)
+
+	result, ok = a.Get(denied)
+	assert.True(t, ok)
+	assert.False(t, result)
+
+	_, ok = a.Get(failed)
+	assert.False(t, ok)
+
+	// negative results expire first
+	time.Sleep(100 * time.Millisecond)
+	_, ok = a.Get(denied)
+	assert.False(t, ok)
+	_, ok = a.Get(allowed)
+	assert.True(t, ok)
+}
@@ -0,0 +1,310 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	BUCKET_META    = []byte("meta")
+	BUCKET_DATAREF = []byte("dataref")
+)
+
+// Index persisted on disk in a bolt database,
+// it survives restarts without walking the data directory
+func NewBoltIndex(path string) (*BoltIndex, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt index %s: %v", path, err)
+	}
+
+	i := &BoltIndex{
+		db:  db,
+		log: logrus.WithField("name", "bolt-index"),
+	}
+
+	err = i.reset()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// Create buckets and reset the state of downloads interrupted by the previous run
+func (i *BoltIndex) reset() error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(BUCKET_DATAREF)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(BUCKET_META)
+		if err != nil {
+			return err
+		}
+
+		return meta.ForEach(func(k, v []byte) error {
+			rec := &indexRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if rec.Status != STATUS_IN_PROGRESS && rec.WorkerID == NO_WORKER {
+				return nil
+			}
+			if rec.Status == STATUS_IN_PROGRESS {
+				rec.Status = STATUS_NOT_FOUND
+			}
+			rec.WorkerID = NO_WORKER
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			return meta.Put(k, data)
+		})
+	})
+}
+
+func (i *BoltIndex) Close() error {
+	return i.db.Close()
+}
+
+func (i *BoltIndex) get(ckey CacheKey) (*indexRecord, error) {
+
+	rec := &indexRecord{}
+	err := i.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BUCKET_META).Get([]byte(ckey))
+		if data == nil {
+			return fmt.Errorf("cache key not found")
+		}
+		return json.Unmarshal(data, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Update record of existing cache key
+func (i *BoltIndex) update(ckey CacheKey, fn func(rec *indexRecord)) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return i.updateTx(tx, ckey, fn)
+	})
+}
+
+func (i *BoltIndex) updateTx(tx *bolt.Tx, ckey CacheKey, fn func(rec *indexRecord)) error {
+
+	bucket := tx.Bucket(BUCKET_META)
+	data := bucket.Get([]byte(ckey))
+	if data == nil {
+		return fmt.Errorf("cache key not found")
+	}
+
+	rec := &indexRecord{}
+	err := json.Unmarshal(data, rec)
+	if err != nil {
+		return err
+	}
+
+	fn(rec)
+
+	data, err = json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(ckey), data)
+}
+
+// ###############
+// *** GETTERS ***
+// ###############
+
+func (i *BoltIndex) GetResponseFile(ckey CacheKey) (*ResponseFile, error) {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return &ResponseFile{}, err
+	}
+	return rec.ResponseFile, nil
+}
+
+func (i *BoltIndex) GetWorker(ckey CacheKey) int {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return NO_WORKER
+	}
+	return rec.WorkerID
+}
+
+func (i *BoltIndex) GetStatus(ckey CacheKey) int {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return STATUS_NOT_FOUND
+	}
+	return rec.Status
+}
+
+func (i *BoltIndex) GetATime(ckey CacheKey) (int64, error) {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return -1, err
+	}
+	return rec.Atime, nil
+}
+
+func (i *BoltIndex) GetCTime(ckey CacheKey) (int64, error) {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return -1, err
+	}
+	return rec.Ctime, nil
+}
+
+func (i *BoltIndex) GetDataRef(df DataFile) CacheKey {
+
+	var ckey CacheKey
+	i.db.View(func(tx *bolt.Tx) error {
+		ckey = CacheKey(tx.Bucket(BUCKET_DATAREF).Get([]byte(df)))
+		return nil
+	})
+	return ckey
+}
+
+func (i *BoltIndex) GetDatafile(ckey CacheKey) (DataFile, error) {
+	rec, err := i.get(ckey)
+	if err != nil {
+		return "", fmt.Errorf("auth key does not exists")
+	}
+	return rec.DataFile, nil
+}
+
+// ###############
+// *** SETTERS ***
+// ###############
+
+func (i *BoltIndex) SetResponseFile(ckey CacheKey, rf *ResponseFile) error {
+	return i.update(ckey, func(rec *indexRecord) {
+		rec.ResponseFile = rf
+	})
+}
+
+// atime is updated on every cache hit,
+// batch the updates to avoid a disk sync per request
+func (i *BoltIndex) SetATime(ckey CacheKey) error {
+	now := time.Now().Unix()
+	return i.db.Batch(func(tx *bolt.Tx) error {
+		return i.updateTx(tx, ckey, func(rec *indexRecord) {
+			rec.Atime = now
+		})
+	})
+}
+
+func (i *BoltIndex) SetStatus(ckey CacheKey, status int) error {
+	return i.update(ckey, func(rec *indexRecord) {
+		rec.Status = status
+	})
+}
+
+func (i *BoltIndex) SetWorker(ckey CacheKey, id int, force bool) error {
+	return i.update(ckey, func(rec *indexRecord) {
+		if force || rec.WorkerID == NO_WORKER {
+			rec.WorkerID = id
+		}
+	})
+}
+
+// ###############
+// ** Delete/List Methods
+// ###############
+
+func (i *BoltIndex) ListCacheKeys() []CacheKey {
+
+	keys := make([]CacheKey, 0)
+	i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BUCKET_META).ForEach(func(k, _ []byte) error {
+			keys = append(keys, CacheKey(k))
+			return nil
+		})
+	})
+	return keys
+}
+
+// Insert cache entry if doesn't exists
+// This method must be idempotent
+func (i *BoltIndex) Put(ckey CacheKey, df DataFile) error {
+
+	if ckey == "" || df == "" {
+		return fmt.Errorf("invalid value for cache key or datafile")
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(BUCKET_META)
+		if meta.Get([]byte(ckey)) == nil {
+			now := time.Now().Unix()
+			data, err := json.Marshal(&indexRecord{
+				Status:   STATUS_NOT_FOUND,
+				WorkerID: NO_WORKER,
+				Atime:    now,
+				Ctime:    now,
+				DataFile: df,
+			})
+			if err != nil {
+				return err
+			}
+			err = meta.Put([]byte(ckey), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		dataref := tx.Bucket(BUCKET_DATAREF)
+		if dataref.Get([]byte(df)) == nil {
+			return dataref.Put([]byte(df), []byte(ckey))
+		}
+		return nil
+	})
+}
+
+func (i *BoltIndex) Delete(ckey CacheKey) {
+
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(BUCKET_META)
+		data := meta.Get([]byte(ckey))
+		if data == nil {
+			return nil
+		}
+
+		rec := &indexRecord{}
+		if err := json.Unmarshal(data, rec); err == nil {
+			tx.Bucket(BUCKET_DATAREF).Delete([]byte(rec.DataFile))
+		}
+		return meta.Delete([]byte(ckey))
+	})
+	if err != nil {
+		i.log.Errorf("failed to delete cache key %s: %v", ckey, err)
+	}
+}
+
+// ###############
+// ** Others
+// ###############
+
+func (i *BoltIndex) Len() int {
+
+	n := 0
+	i.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(BUCKET_META).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func (i *BoltIndex) Print() {
+	logrus.Debugln("----------------------------------------")
+	logrus.Debugln("bolt index:", i.db.Path(), "keys:", i.Len())
+	logrus.Debugln("----------------------------------------")
+}
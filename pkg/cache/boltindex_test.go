@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBoltIndex(t *testing.T, path string) *BoltIndex {
+	myindex, err := NewBoltIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { myindex.Close() })
+	return myindex
+}
+
+func TestBoltCreateDeleteEntry(t *testing.T) {
+	myindex := newTestBoltIndex(t, filepath.Join(t.TempDir(), INDEX_DB_FILE))
+	err := myindex.Put("key", "")
+	err2 := myindex.Put("key", "datafile")
+	err3 := myindex.Put("key", "datafile")
+
+	df, _ := myindex.GetDatafile("key")
+
+	assert.NotNil(t, err)
+	assert.Nil(t, err2)
+	assert.Nil(t, err3)
+	assert.Equal(t, DataFile("datafile"), df)
+	assert.Equal(t, CacheKey("key"), myindex.GetDataRef("datafile"))
+	assert.Equal(t, 1, myindex.Len())
+	assert.Equal(t, []CacheKey{"key"}, myindex.ListCacheKeys())
+
+	myindex.Delete("key")
+	_, dfErr := myindex.GetDatafile("key")
+
+	assert.NotNil(t, dfErr)
+	assert.Equal(t, CacheKey(""), myindex.GetDataRef("datafile"))
+	assert.Equal(t, 0, myindex.Len())
+}
+
+func TestBoltSetters(t *testing.T) {
+	myindex := newTestBoltIndex(t, filepath.Join(t.TempDir(), INDEX_DB_FILE))
+	respfile := NewResponseFile(1000, 200, nil, "key")
+
+	assert.NotNil(t, myindex.SetStatus("key", STATUS_AVAILABLE))
+	assert.NotNil(t, myindex.SetResponseFile("key", respfile))
+
+	myindex.Put("key", "datafile")
+
+	assert.Nil(t, myindex.SetStatus("key", STATUS_AVAILABLE))
+	assert.Nil(t, myindex.SetResponseFile("key", respfile))
+	assert.Nil(t, myindex.SetATime("key"))
+
+	myindex.SetWorker("key", 10, false)
+	myindex.SetWorker("key", 12, false)
+	worker := myindex.GetWorker("key")
+
+	getMeta, _ := myindex.GetResponseFile("key")
+	assert.Equal(t, respfile, getMeta)
+	assert.Equal(t, STATUS_AVAILABLE, myindex.GetStatus("key"))
+	assert.Equal(t, 10, worker)
+}
+
+func TestBoltSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), INDEX_DB_FILE)
+
+	myindex, _ := NewBoltIndex(path)
+	myindex.Put("available", "datafile1")
+	myindex.SetStatus("available", STATUS_AVAILABLE)
+	myindex.SetResponseFile("available", NewResponseFile(1000, 200, nil, "available"))
+	myindex.Put("downloading", "datafile2")
+	myindex.SetStatus("downloading", STATUS_IN_PROGRESS)
+	myindex.SetWorker("downloading", 3, false)
+	ctime, _ := myindex.GetCTime("available")
+	myindex.Close()
+
+	myindex = newTestBoltIndex(t, path)
+	newCtime, _ := myindex.GetCTime("available")
+	respfile, _ := myindex.GetResponseFile("available")
+
+	assert.Equal(t, 2, myindex.Len())
+	assert.Equal(t, ctime, newCtime)
+	assert.Equal(t, 1000, respfile.ContentLength)
+	assert.Equal(t, STATUS_AVAILABLE, myindex.GetStatus("available"))
+
+	// interrupted downloads are reset
+	assert.Equal(t, STATUS_NOT_FOUND, myindex.GetStatus("downloading"))
+	assert.Equal(t, NO_WORKER, myindex.GetWorker("downloading"))
+}
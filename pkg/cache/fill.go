@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+func NewFill(path string, size int64, written int64) *Fill {
+	f := &Fill{
+		path:    path,
+		size:    size,
+		written: written,
+	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Record n new bytes on disk and wake up the readers
+func (f *Fill) advance(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.written += n
+	f.cond.Broadcast()
+}
+
+// Rename the file being filled,
+// readers opening the file at the same time will use the new path
+func (f *Fill) rename(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.Rename(f.path, path)
+	if err != nil {
+		return err
+	}
+	f.path = path
+	return nil
+}
+
+// Mark the fill as completed (err == nil) or aborted
+func (f *Fill) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.done = true
+	if err != nil {
+		f.err = fmt.Errorf("cache fill aborted: %v", err)
+	}
+	f.cond.Broadcast()
+}
+
+// Wait until there are bytes available after offset
+// returns io.EOF if the fill is completed or the abort error
+func (f *Fill) wait(offset int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		if f.err != nil {
+			return 0, f.err
+		}
+
+		limit := f.written
+		if !f.done && f.size > 0 && limit >= f.size {
+			// hold back the last byte until the content has been verified,
+			// so that clients can't complete the download of a corrupted file
+			limit = f.size - 1
+		}
+		if offset < limit {
+			return limit - offset, nil
+		}
+		if f.done {
+			return 0, io.EOF
+		}
+		f.cond.Wait()
+	}
+}
+
+func (f *Fill) NewReader() (*FillReader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &FillReader{fill: f, file: file}, nil
+}
+
+func (r *FillReader) Read(p []byte) (int, error) {
+
+	avail, err := r.fill.wait(r.offset)
+	if avail == 0 {
+		return 0, err
+	}
+
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read,
+// seeking from the end is possible only when the final size is known
+func (r *FillReader) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		if r.fill.size < 0 {
+			return 0, fmt.Errorf("can't seek from end, file size is unknown")
+		}
+		offset += r.fill.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *FillReader) Close() error {
+	return r.file.Close()
+}
+
+func (w *fillWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	if n > 0 {
+		w.written += int64(n)
+		w.fill.advance(int64(n))
+	}
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
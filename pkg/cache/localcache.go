@@ -1,8 +1,8 @@
 package cache
 
 import (
-	"container/list"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -10,17 +10,21 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
 	"github.com/sirupsen/logrus"
 )
 
-func NewCache(idx Index, dp string) *LocalCache {
+func NewCache(idx Index, dp string, policy eviction.Policy) *LocalCache {
 	return &LocalCache{
-		dataPath:    dp,
-		index:       idx,
-		LRUQueue:    list.New(),
-		LRUElements: make(map[CacheKey]*list.Element),
-		log:         logrus.WithField("name", "cache"),
+		dataPath: dp,
+		index:    idx,
+		policy:   policy,
+		fills:    make(map[CacheKey]*Fill),
+		sizes:    make(map[CacheKey]int64),
+		log:      logrus.WithField("name", "cache"),
 	}
 }
 
@@ -35,6 +39,9 @@ func NewCacheRequest(r *http.Request, dataPath string) *CacheRequest {
 		CacheEnabled: false,
 		Request:      r.Clone(context.TODO()), // TODO: improve context usage
 		Response:     make(chan *CacheResponse, 1),
+		AuthKey:      ComputeAuthKey(r.Header.Get("Authorization")),
+		Host:         r.URL.Host,
+		Repository:   ComputeRepository(r.URL.Path),
 	}
 
 	// create cache request for layers
@@ -46,7 +53,6 @@ func NewCacheRequest(r *http.Request, dataPath string) *CacheRequest {
 		}
 		cr.CacheEnabled = true
 		cr.DataFile = df
-		cr.AuthKey = ComputeAuthKey(r.Header.Get("Authorization"))
 		cr.CacheKey = CacheKey(groups[1])
 		cr.ResponseFilePath = ComputeResponseFilePath(string(df))
 		cr.ItemType = "layer"
@@ -60,12 +66,16 @@ func NewCacheRequest(r *http.Request, dataPath string) *CacheRequest {
 		}
 		cr.CacheEnabled = true
 		cr.DataFile = df
-		cr.AuthKey = ComputeAuthKey(r.Header.Get("Authorization"))
 		cr.CacheKey = CacheKey(groups[1])
 		cr.ResponseFilePath = ComputeResponseFilePath(string(df))
 		cr.ItemType = "manifest"
 	}
 
+	// tags are resolved by the worker to the digest of their manifest
+	if REGEX_TAG.MatchString(r.URL.Path) && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		cr.Tag = REGEX_TAG.FindStringSubmatch(r.URL.Path)[1]
+	}
+
 	return cr
 }
 
@@ -81,8 +91,11 @@ func (c *LocalCache) Restore() error {
 	}
 
 	for _, f := range files {
+		df := f.Path
+		if !strings.HasSuffix(df, SUFFIX_LAYER_FILE) && !strings.HasSuffix(df, SUFFIX_MANIFEST_FILE) {
+			continue
+		}
 		rf := &ResponseFile{}
-		df := filepath.Join(c.dataPath, f.Name())
 		metapath := ComputeResponseFilePath(df)
 		err := rf.Load(metapath)
 		if err != nil {
@@ -102,17 +115,152 @@ func (c *LocalCache) Restore() error {
 	return nil
 }
 
-func (c *LocalCache) List() ([]fs.DirEntry, error) {
+// Populate the eviction policy and the disk usage with the available files of the index,
+// the policy from the least to the most recently accessed
+func (c *LocalCache) Rebuild() {
+
+	type entry struct {
+		ckey  CacheKey
+		atime int64
+		size  int64
+	}
+
+	entries := make([]entry, 0)
+	for _, ckey := range c.index.ListCacheKeys() {
+		if c.index.GetStatus(ckey) != STATUS_AVAILABLE {
+			continue
+		}
+		rf, err := c.index.GetResponseFile(ckey)
+		if err != nil || rf == nil {
+			continue
+		}
+		atime, _ := c.index.GetATime(ckey)
+		entries = append(entries, entry{ckey: ckey, atime: atime, size: int64(rf.ContentLength)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].atime < entries[j].atime })
+	for _, e := range entries {
+		c.policy.Add(string(e.ckey), e.size)
+		c.account(e.ckey, e.size)
+	}
+
+	usage, _ := c.Usage()
+	c.log.Infof("eviction policy rebuilt with %d files, %d bytes", len(entries), usage)
+}
+
+func (c *LocalCache) account(ckey CacheKey, size int64) {
+	c.sizesLock.Lock()
+	defer c.sizesLock.Unlock()
+
+	c.usage += size - c.sizes[ckey]
+	c.sizes[ckey] = size
+}
+
+func (c *LocalCache) unaccount(ckey CacheKey) {
+	c.sizesLock.Lock()
+	defer c.sizesLock.Unlock()
 
-	files, err := os.ReadDir(c.GetDataPath())
+	c.usage -= c.sizes[ckey]
+	delete(c.sizes, ckey)
+}
+
+// Tracked incrementally, without walking the data path
+func (c *LocalCache) Usage() (int64, error) {
+	c.sizesLock.Lock()
+	defer c.sizesLock.Unlock()
+
+	return c.usage, nil
+}
+
+// List all the files in the sharded data directory
+func (c *LocalCache) List() ([]FileInfo, error) {
+
+	files := make([]FileInfo, 0)
+	err := filepath.WalkDir(filepath.Join(c.dataPath, SHARDS_DIR), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			var info fs.FileInfo
+			info, err = d.Info()
+			if err == nil {
+				files = append(files, FileInfo{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+		// files can be removed by workers or GC while walking
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return files, nil
 }
 
+func (c *LocalCache) Stat(df DataFile) (*FileInfo, error) {
+
+	info, err := os.Stat(string(df))
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{Path: string(df), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (c *LocalCache) Open(df DataFile) (io.ReadCloser, error) {
+	return os.Open(string(df))
+}
+
+// Move the files of the flat layout (<datapath>/<digest>.layer) into their shard directory.
+// Index entries of moved files are removed so that Restore adds them with the new path.
+// Returns the number of migrated files
+func (c *LocalCache) Migrate() (int, error) {
+
+	entries, err := os.ReadDir(c.dataPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to migrate: %v", err)
+	}
+
+	migrated := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		digest, _, found := strings.Cut(e.Name(), ".")
+		if !found || !REGEX_DIGEST_HEX.MatchString(digest) {
+			continue
+		}
+
+		shard := ComputeShardDir(c.dataPath, digest)
+		err := os.MkdirAll(shard, 0777)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to create shard directory %s: %v", shard, err)
+		}
+
+		oldpath := filepath.Join(c.dataPath, e.Name())
+		if ckey := c.index.GetDataRef(DataFile(oldpath)); ckey != "" {
+			c.index.Delete(ckey)
+		}
+
+		err = os.Rename(oldpath, filepath.Join(shard, e.Name()))
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate %s: %v", oldpath, err)
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		c.log.Infof("migrated %d files to the sharded layout", migrated)
+	}
+
+	return migrated, nil
+}
+
 // Create files on disk and add response file in index
-func (c *LocalCache) Create(cr *CacheRequest, respfile *ResponseFile, content io.ReadCloser) error {
+// The content is hashed while it's copied and moved in place only if it matches
+// the digest in the cache key and the content length, so that a truncated
+// or corrupted file is never served.
+// If offset > 0 the content is appended to the partial file left by an interrupted download.
+// While the content is copied, concurrent Read calls stream the partial file
+func (c *LocalCache) Create(cr *CacheRequest, respfile *ResponseFile, content io.ReadCloser, offset int64) error {
 
 	err := c.index.SetResponseFile(cr.CacheKey, respfile)
 	if err != nil {
@@ -120,27 +268,131 @@ func (c *LocalCache) Create(cr *CacheRequest, respfile *ResponseFile, content io
 		return err
 	}
 
+	err = os.MkdirAll(filepath.Dir(string(cr.DataFile)), 0777)
+	if err != nil {
+		return &WriteError{
+			Reason: WRITE_ERROR_DISK_WRITE,
+			Err:    fmt.Errorf("failed to create shard directory for '%v' '%v'", cr.DataFile, err),
+		}
+	}
+
 	// using name ending with .partial so that GC ignores the files while are getting downloaded
 	partialdf := fmt.Sprintf("%s%s", string(cr.DataFile), SUFFIX_PARTIAL_FILE)
-	dst, err := os.Create(partialdf)
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+	dst, err := os.OpenFile(partialdf, flags, 0666)
 	if err != nil {
-		return fmt.Errorf("failed to create cache file '%v' '%v'", cr.DataFile, err)
+		return &WriteError{
+			Reason: WRITE_ERROR_DISK_WRITE,
+			Err:    fmt.Errorf("failed to create cache file '%v' '%v'", cr.DataFile, err),
+		}
 	}
 
-	err = os.Rename(partialdf, string(cr.DataFile))
+	fill := c.startFill(cr.CacheKey, partialdf, int64(respfile.ContentLength), offset)
+
+	err = c.writeContent(cr, respfile, dst, fill, content, offset)
 	if err != nil {
-		os.Remove(partialdf) // try to remove. If fails, will be removed by GC
-		return fmt.Errorf("failed to rename partial cache file '%s' to '%v'", partialdf, cr.DataFile)
+		// keep the partial file if the upstream connection dropped, so that the download can be resumed
+		var writeErr *WriteError
+		if !errors.As(err, &writeErr) || writeErr.Reason != WRITE_ERROR_UPSTREAM_READ {
+			os.Remove(partialdf) // try to remove. If fails, will be removed by GC
+		}
+		c.stopFill(cr.CacheKey, err)
+		return err
 	}
 
 	// try to dump ResponseFile on disk for restore
-	_ = respfile.Dump(cr.ResponseFilePath)
-	buf := make([]byte, 4*1024)
-	_, err = io.CopyBuffer(dst, content, buf)
+	err = respfile.Dump(cr.ResponseFilePath)
+	if err != nil {
+		c.log.Warningf("failed to dump response file %s: %v", cr.ResponseFilePath, err)
+	}
+
+	size := int64(respfile.ContentLength)
+	if info, err := os.Stat(string(cr.DataFile)); err == nil {
+		size = info.Size()
+	}
+	c.account(cr.CacheKey, size)
+	c.policy.Add(string(cr.CacheKey), size)
+	c.stopFill(cr.CacheKey, nil)
+
+	return nil
+}
+
+// Copy content into the partial file, verify it and move it in place
+func (c *LocalCache) writeContent(cr *CacheRequest, respfile *ResponseFile, dst *os.File, fill *Fill, content io.Reader, offset int64) error {
 
-	c.LRUElements[cr.CacheKey] = c.LRUQueue.PushFront(cr.CacheKey)
+	defer dst.Close()
+
+	hash := sha256.New()
+
+	// hash the content already on disk and continue from there
+	if offset > 0 {
+		_, err := io.Copy(hash, io.NewSectionReader(dst, 0, offset))
+		if err != nil {
+			return &WriteError{Reason: WRITE_ERROR_DISK_WRITE, Err: fmt.Errorf("failed to read partial file: %v", err)}
+		}
+		err = dst.Truncate(offset)
+		if err == nil {
+			_, err = dst.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			return &WriteError{Reason: WRITE_ERROR_DISK_WRITE, Err: err}
+		}
+	}
+
+	fw := &fillWriter{dst: dst, fill: fill}
+	buf := make([]byte, 32*1024)
+	_, err := io.CopyBuffer(io.MultiWriter(hash, fw), content, buf)
+	if err != nil {
+		if fw.err != nil {
+			return &WriteError{Reason: WRITE_ERROR_DISK_WRITE, Err: err}
+		}
+		return &WriteError{Reason: WRITE_ERROR_UPSTREAM_READ, Err: err}
+	}
+
+	size := offset + fw.written
+	if respfile.ContentLength >= 0 && size != int64(respfile.ContentLength) {
+		return &WriteError{
+			Reason: WRITE_ERROR_SIZE_MISMATCH,
+			Err:    fmt.Errorf("expected %d bytes, received %d", respfile.ContentLength, size),
+		}
+	}
+
+	digest := fmt.Sprintf("%x", hash.Sum(nil))
+	if digest != string(cr.CacheKey) {
+		return &WriteError{
+			Reason: WRITE_ERROR_DIGEST_MISMATCH,
+			Err:    fmt.Errorf("expected sha256 '%s', computed '%s'", cr.CacheKey, digest),
+		}
+	}
+
+	err = dst.Sync()
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_FSYNC, Err: err}
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_DISK_WRITE, Err: err}
+	}
+
+	err = fill.rename(string(cr.DataFile))
+	if err != nil {
+		return &WriteError{
+			Reason: WRITE_ERROR_RENAME,
+			Err:    fmt.Errorf("failed to rename partial cache file to '%v': %v", cr.DataFile, err),
+		}
+	}
 
-	return err
+	// make sure the rename survives a crash
+	err = syncDir(filepath.Dir(string(cr.DataFile)))
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_FSYNC, Err: err}
+	}
+
+	return nil
 }
 
 func (c *LocalCache) Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error) {
@@ -149,22 +401,76 @@ func (c *LocalCache) Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error
 	if err != nil {
 		return nil, nil, err
 	}
+	if meta == nil {
+		// the download hasn't started yet
+		return nil, nil, fmt.Errorf("response file not available for cache key %s", cr.CacheKey)
+	}
 	// update last access time for cache key
 	c.index.SetATime(cr.CacheKey)
-	//TODOX: move up in the LRUqueue
+
+	// the file is still being downloaded, stream it while it grows
+	if fill := c.getFill(cr.CacheKey); fill != nil {
+		reader, err := fill.NewReader()
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, meta, nil
+	}
 
 	file, err := os.Open(string(cr.DataFile))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if el, ok := c.LRUElements[cr.CacheKey]; ok {
-		c.LRUQueue.MoveToFront(el)
-	}
+	c.policy.Touch(string(cr.CacheKey))
 
 	return file, meta, nil
 }
 
+// Size of the partial file left by an interrupted download, 0 if there isn't any
+func (c *LocalCache) PartialSize(cr *CacheRequest) int64 {
+
+	if c.getFill(cr.CacheKey) != nil {
+		return 0
+	}
+
+	info, err := os.Stat(fmt.Sprintf("%s%s", string(cr.DataFile), SUFFIX_PARTIAL_FILE))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (c *LocalCache) startFill(ckey CacheKey, path string, size int64, written int64) *Fill {
+	c.fillsLock.Lock()
+	defer c.fillsLock.Unlock()
+
+	fill := NewFill(path, size, written)
+	c.fills[ckey] = fill
+	return fill
+}
+
+func (c *LocalCache) stopFill(ckey CacheKey, err error) {
+	c.fillsLock.Lock()
+	defer c.fillsLock.Unlock()
+
+	if fill, ok := c.fills[ckey]; ok {
+		fill.finish(err)
+		delete(c.fills, ckey)
+	}
+}
+
+func (c *LocalCache) Filling(ckey CacheKey) bool {
+	return c.getFill(ckey) != nil
+}
+
+func (c *LocalCache) getFill(ckey CacheKey) *Fill {
+	c.fillsLock.RLock()
+	defer c.fillsLock.RUnlock()
+
+	return c.fills[ckey]
+}
+
 // Deletes file from disk and index entries
 // TODO: possible data race condition here as there's no locking
 func (c *LocalCache) Delete(filepath DataFile, ckey CacheKey, atomic bool) error {
@@ -189,10 +495,8 @@ func (c *LocalCache) Delete(filepath DataFile, ckey CacheKey, atomic bool) error
 
 	// remove ckey if it exists
 	if ckey != "" {
-		// TODOX: remove from LRUqueue
-		if le, ok := c.LRUElements[ckey]; ok {
-			c.LRUQueue.Remove(le)
-		}
+		c.policy.Remove(string(ckey))
+		c.unaccount(ckey)
 		c.index.Delete(ckey)
 	}
 
@@ -212,12 +516,17 @@ func (c *LocalCache) Delete(filepath DataFile, ckey CacheKey, atomic bool) error
 }
 
 func (c *LocalCache) GetLeastUsedFile() (DataFile, error) {
-	el := c.LRUQueue.Back()
 
-	ckey, ok := el.Value.(CacheKey)
+	key, ok := c.policy.Victim()
 	if !ok {
-		return "", fmt.Errorf("can't cast LRU element into CacheKey %v", el.Value)
+		return "", fmt.Errorf("no files to evict")
 	}
 
-	return c.index.GetDatafile(ckey)
+	df, err := c.index.GetDatafile(CacheKey(key))
+	if err != nil {
+		// removed from the index by someone else, don't return it again
+		c.policy.Remove(key)
+		return "", err
+	}
+	return df, nil
 }
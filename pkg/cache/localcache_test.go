@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCacheRequest(dataPath string, content string) *CacheRequest {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	df, _ := ComputeLayerFile(dataPath, digest)
+	return &CacheRequest{
+		CacheEnabled:     true,
+		CacheKey:         CacheKey(digest),
+		DataFile:         df,
+		ResponseFilePath: ComputeResponseFilePath(string(df)),
+	}
+}
+
+func TestReadWhileFilling(t *testing.T) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	mycache := NewCache(myindex, dataPath, eviction.NewLRU())
+	cr := newTestCacheRequest(dataPath, "helloworld")
+	myindex.Put(cr.CacheKey, cr.DataFile)
+
+	pr, pw := io.Pipe()
+	created := make(chan error)
+	go func() {
+		created <- mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), pr, 0)
+	}()
+
+	pw.Write([]byte("hello"))
+
+	reader, _, err := mycache.Read(cr)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	buf := make([]byte, 10)
+	n, err := reader.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	go func() {
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+
+	rest, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(rest))
+	assert.Nil(t, <-created)
+
+	_, statErr := os.Stat(string(cr.DataFile))
+	assert.Nil(t, statErr)
+}
+
+func TestReadAbortedFill(t *testing.T) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	mycache := NewCache(myindex, dataPath, eviction.NewLRU())
+	cr := newTestCacheRequest(dataPath, "helloworld")
+	myindex.Put(cr.CacheKey, cr.DataFile)
+
+	pr, pw := io.Pipe()
+	created := make(chan error)
+	go func() {
+		created <- mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), pr, 0)
+	}()
+
+	pw.Write([]byte("hello"))
+
+	reader, _, err := mycache.Read(cr)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	pw.CloseWithError(errors.New("connection reset"))
+
+	_, err = io.ReadAll(reader)
+	assert.NotNil(t, err)
+	assert.NotNil(t, <-created)
+
+	_, _, err = mycache.Read(cr)
+	assert.NotNil(t, err)
+}
+
+func TestCreateVerifiesContent(t *testing.T) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	mycache := NewCache(myindex, dataPath, eviction.NewLRU())
+
+	cr := newTestCacheRequest(dataPath, "helloworld")
+	myindex.Put(cr.CacheKey, cr.DataFile)
+
+	// poisoned content
+	err := mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("hellohello")), 0)
+	var writeErr *WriteError
+	assert.True(t, errors.As(err, &writeErr))
+	assert.Equal(t, WRITE_ERROR_DIGEST_MISMATCH, writeErr.Reason)
+
+	// truncated content
+	err = mycache.Create(cr, NewResponseFile(20, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+	assert.True(t, errors.As(err, &writeErr))
+	assert.Equal(t, WRITE_ERROR_SIZE_MISMATCH, writeErr.Reason)
+
+	_, statErr := os.Stat(string(cr.DataFile))
+	_, partialStatErr := os.Stat(string(cr.DataFile) + SUFFIX_PARTIAL_FILE)
+	assert.True(t, errors.Is(statErr, os.ErrNotExist))
+	assert.True(t, errors.Is(partialStatErr, os.ErrNotExist))
+
+	err = mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+	assert.Nil(t, err)
+
+	_, statErr = os.Stat(string(cr.DataFile))
+	_, metaStatErr := os.Stat(cr.ResponseFilePath)
+	assert.Nil(t, statErr)
+	assert.Nil(t, metaStatErr)
+}
+
+func TestComputeDataFileSharded(t *testing.T) {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("helloworld")))
+	df, err := ComputeLayerFile("/data", digest)
+	_, invalidErr := ComputeLayerFile("/data", "../../etc/passwd")
+
+	assert.Nil(t, err)
+	assert.NotNil(t, invalidErr)
+	assert.Equal(t, DataFile(filepath.Join("/data", "sha256", digest[0:2], digest[2:4], digest+SUFFIX_LAYER_FILE)), df)
+}
+
+func TestMigrateFlatLayout(t *testing.T) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	mycache := NewCache(myindex, dataPath, eviction.NewLRU())
+
+	cr := newTestCacheRequest(dataPath, "helloworld")
+	flatdf := filepath.Join(dataPath, filepath.Base(string(cr.DataFile)))
+	os.WriteFile(flatdf, []byte("helloworld"), 0644)
+	NewResponseFile(10, 200, nil, cr.CacheKey).Dump(ComputeResponseFilePath(flatdf))
+	myindex.Put(cr.CacheKey, DataFile(flatdf))
+
+	migrated, err := mycache.Migrate()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, migrated)
+
+	err = mycache.Restore()
+	assert.Nil(t, err)
+
+	files, _ := mycache.List()
+	paths := []string{}
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	df, _ := myindex.GetDatafile(cr.CacheKey)
+	assert.ElementsMatch(t, []string{string(cr.DataFile), cr.ResponseFilePath}, paths)
+	assert.Equal(t, cr.DataFile, df)
+	assert.Equal(t, STATUS_AVAILABLE, myindex.GetStatus(cr.CacheKey))
+}
+
+func TestRebuild(t *testing.T) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	mycache := NewCache(myindex, dataPath, eviction.NewLRU())
+
+	_, err := mycache.GetLeastUsedFile()
+	assert.NotNil(t, err)
+
+	older := newTestCacheRequest(dataPath, "helloworld")
+	newer := newTestCacheRequest(dataPath, "0123456789")
+	createTestFile(t, mycache, myindex, newer, "0123456789")
+	createTestFile(t, mycache, myindex, older, "helloworld")
+	myindex.meta[older.CacheKey].Atime = 100
+	myindex.meta[newer.CacheKey].Atime = 200
+
+	// e.g.: after a restart with a persistent index
+	restarted := NewCache(myindex, dataPath, eviction.NewLRU())
+	restarted.Rebuild()
+	usage, _ := restarted.Usage()
+	assert.Equal(t, int64(20), usage)
+
+	luf, err := restarted.GetLeastUsedFile()
+	assert.Nil(t, err)
+	assert.Equal(t, older.DataFile, luf)
+
+	restarted.Delete(luf, "", false)
+	usage, _ = restarted.Usage()
+	assert.Equal(t, int64(10), usage)
+	luf, err = restarted.GetLeastUsedFile()
+	assert.Nil(t, err)
+	assert.Equal(t, newer.DataFile, luf)
+}
@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// In-memory tier in front of next, holding up to maxSize bytes
+// of files not larger than maxObjectSize (e.g.: manifests and config blobs)
+func NewMemoryCache(next Cache, idx Index, maxSize, maxObjectSize int64) *MemoryCache {
+	return &MemoryCache{
+		next:          next,
+		index:         idx,
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		entries:       make(map[CacheKey]*list.Element),
+		lru:           list.New(),
+		log:           logrus.WithField("name", "memory-cache"),
+	}
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+// Check if a file of the given size can be stored in memory
+func (c *MemoryCache) admit(size int) bool {
+	if size < 0 {
+		return false
+	}
+	if int64(size) > c.maxObjectSize || int64(size) > c.maxSize {
+		c.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (c *MemoryCache) get(ckey CacheKey) *memoryEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[ckey]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*memoryEntry)
+}
+
+// Add file and evict the least recently used ones above maxSize
+func (c *MemoryCache) add(ckey CacheKey, data []byte, meta *ResponseFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[ckey]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[ckey] = c.lru.PushFront(&memoryEntry{ckey: ckey, data: data, meta: meta})
+	c.size += int64(len(data))
+
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		c.removeElement(el)
+		c.evictions.Add(1)
+		c.log.Debugln("evicted from memory:", el.Value.(*memoryEntry).ckey)
+	}
+}
+
+func (c *MemoryCache) remove(ckey CacheKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[ckey]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *MemoryCache) removeElement(el *list.Element) {
+	entry := el.Value.(*memoryEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.ckey)
+	c.size -= int64(len(entry.data))
+}
+
+func (c *MemoryCache) Stats() MemoryCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return MemoryCacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Rejected:  c.rejected.Load(),
+		Size:      c.size,
+		Entries:   int64(len(c.entries)),
+	}
+}
+
+// Create the file in the next tier, keeping a copy in memory once it's verified
+func (c *MemoryCache) Create(cr *CacheRequest, meta *ResponseFile, content io.ReadCloser, offset int64) error {
+
+	if offset > 0 || !c.admit(meta.ContentLength) {
+		return c.next.Create(cr, meta, content, offset)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, meta.ContentLength))
+	tee := struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(content, buf), content}
+
+	err := c.next.Create(cr, meta, tee, offset)
+	if err != nil {
+		return err
+	}
+
+	c.add(cr.CacheKey, buf.Bytes(), meta)
+	return nil
+}
+
+// Serve the file from memory, or load it from the next tier if it's small enough
+func (c *MemoryCache) Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error) {
+
+	if entry := c.get(cr.CacheKey); entry != nil {
+		c.hits.Add(1)
+		c.index.SetATime(cr.CacheKey)
+		return &memoryReader{bytes.NewReader(entry.data)}, entry.meta, nil
+	}
+	c.misses.Add(1)
+
+	reader, meta, err := c.next.Read(cr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// files being downloaded are streamed while they grow
+	if c.index.GetStatus(cr.CacheKey) != STATUS_AVAILABLE || !c.admit(meta.ContentLength) {
+		return reader, meta, nil
+	}
+
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, int64(meta.ContentLength)+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) != meta.ContentLength {
+		return nil, nil, fmt.Errorf("expected %d bytes for cache key %s, read %d", meta.ContentLength, cr.CacheKey, len(data))
+	}
+
+	c.add(cr.CacheKey, data, meta)
+	return &memoryReader{bytes.NewReader(data)}, meta, nil
+}
+
+// Files in memory are always streamed, the rest is redirected if the next tier supports it
+func (c *MemoryCache) RedirectURL(cr *CacheRequest) (string, error) {
+
+	r, ok := c.next.(Redirector)
+	if !ok || c.get(cr.CacheKey) != nil {
+		return "", nil
+	}
+	return r.RedirectURL(cr)
+}
+
+func (c *MemoryCache) Delete(df DataFile, ckey CacheKey, atomic bool) error {
+
+	key := ckey
+	if key == "" && df != "" {
+		key = c.index.GetDataRef(df)
+	}
+	c.remove(key)
+
+	return c.next.Delete(df, ckey, atomic)
+}
+
+func (c *MemoryCache) PartialSize(cr *CacheRequest) int64 {
+	return c.next.PartialSize(cr)
+}
+
+func (c *MemoryCache) Filling(ckey CacheKey) bool {
+	return c.next.Filling(ckey)
+}
+
+func (c *MemoryCache) Restore() error {
+	return c.next.Restore()
+}
+
+func (c *MemoryCache) GetDataPath() string {
+	return c.next.GetDataPath()
+}
+
+func (c *MemoryCache) GetLeastUsedFile() (DataFile, error) {
+	return c.next.GetLeastUsedFile()
+}
+
+func (c *MemoryCache) List() ([]FileInfo, error) {
+	return c.next.List()
+}
+
+func (c *MemoryCache) Stat(df DataFile) (*FileInfo, error) {
+	return c.next.Stat(df)
+}
+
+func (c *MemoryCache) Open(df DataFile) (io.ReadCloser, error) {
+	return c.next.Open(df)
+}
+
+func (c *MemoryCache) Usage() (int64, error) {
+	return c.next.Usage()
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryCache(t *testing.T, maxSize, maxObjectSize int64) (*MemoryCache, Index, string) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	return NewMemoryCache(NewCache(myindex, dataPath, eviction.NewLRU()), myindex, maxSize, maxObjectSize), myindex, dataPath
+}
+
+func createTestFile(t *testing.T, c Cache, idx Index, cr *CacheRequest, content string) {
+	idx.Put(cr.CacheKey, cr.DataFile)
+	err := c.Create(cr, NewResponseFile(len(content), 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader(content)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SetStatus(cr.CacheKey, STATUS_AVAILABLE)
+}
+
+func TestMemoryCachePopulatedOnWrite(t *testing.T) {
+	mycache, myindex, dataPath := newTestMemoryCache(t, 100, 50)
+	cr := newTestCacheRequest(dataPath, "helloworld")
+	createTestFile(t, mycache, myindex, cr, "helloworld")
+
+	// served without touching the disk
+	os.Remove(string(cr.DataFile))
+	reader, meta, err := mycache.Read(cr)
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	assert.Equal(t, "helloworld", string(content))
+	assert.Equal(t, 10, meta.ContentLength)
+	assert.Equal(t, MemoryCacheStats{Hits: 1, Size: 10, Entries: 1}, mycache.Stats())
+
+	mycache.Delete("", cr.CacheKey, false)
+	assert.Equal(t, int64(0), mycache.Stats().Entries)
+}
+
+func TestMemoryCachePopulatedOnRead(t *testing.T) {
+	mycache, myindex, dataPath := newTestMemoryCache(t, 100, 50)
+	cr := newTestCacheRequest(dataPath, "helloworld")
+
+	// written by another tier, e.g.: before a restart
+	createTestFile(t, mycache.next, myindex, cr, "helloworld")
+
+	reader, _, err := mycache.Read(cr)
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	assert.Equal(t, "helloworld", string(content))
+
+	mycache.Read(cr)
+	stats := mycache.Stats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Entries)
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	mycache, myindex, dataPath := newTestMemoryCache(t, 25, 15)
+
+	first := newTestCacheRequest(dataPath, "helloworld")
+	second := newTestCacheRequest(dataPath, "0123456789")
+	third := newTestCacheRequest(dataPath, "abcdefghij")
+	large := newTestCacheRequest(dataPath, "this is larger than 15 bytes")
+	createTestFile(t, mycache, myindex, first, "helloworld")
+	createTestFile(t, mycache, myindex, second, "0123456789")
+
+	// the first file becomes the most recently used
+	mycache.Read(first)
+	createTestFile(t, mycache, myindex, third, "abcdefghij")
+	createTestFile(t, mycache, myindex, large, "this is larger than 15 bytes")
+
+	stats := mycache.Stats()
+	assert.NotNil(t, mycache.get(first.CacheKey))
+	assert.Nil(t, mycache.get(second.CacheKey))
+	assert.NotNil(t, mycache.get(third.CacheKey))
+	assert.Nil(t, mycache.get(large.CacheKey))
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(1), stats.Rejected)
+	assert.Equal(t, int64(20), stats.Size)
+}
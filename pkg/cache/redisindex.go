@@ -0,0 +1,573 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+)
+
+var (
+	// set field only if the cache key exists
+	scriptSetField = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+	// compare-and-set of the worker allocated to a cache key,
+	// the claim of a worker is taken over when its lease has expired (e.g.: the replica died)
+	scriptSetWorker = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local current = redis.call('HGET', KEYS[1], 'worker')
+local lease = tonumber(redis.call('HGET', KEYS[1], 'lease') or '0')
+if ARGV[2] == '1' or current == false or current == ARGV[3] or lease < tonumber(ARGV[4]) then
+	if ARGV[1] == ARGV[3] then
+		redis.call('HSET', KEYS[1], 'worker', ARGV[1])
+		redis.call('HDEL', KEYS[1], 'lease')
+	else
+		redis.call('HSET', KEYS[1], 'worker', ARGV[1], 'lease', ARGV[5])
+	end
+	return 1
+end
+return 0
+`)
+
+	// the sorted set of the access times is updated with the field
+	scriptSetATime = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'atime', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+	// extend the lease of a worker, only if it's still allocated to the cache key
+	scriptRenewLease = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'worker') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'lease', ARGV[2])
+return 1
+`)
+
+	// downloads whose worker lease has expired are reset, so that another worker can claim them
+	scriptGetStatus = redis.NewScript(`
+local values = redis.call('HMGET', KEYS[1], 'status', 'lease')
+if values[1] == false then
+	return false
+end
+if values[1] == ARGV[2] and tonumber(values[2] or '0') < tonumber(ARGV[1]) then
+	redis.call('HSET', KEYS[1], 'status', ARGV[3], 'worker', ARGV[4])
+	redis.call('HDEL', KEYS[1], 'lease')
+	return ARGV[3]
+end
+return values[1]
+`)
+
+	scriptPut = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('HSET', KEYS[1],
+		'datafile', ARGV[2], 'atime', ARGV[3], 'ctime', ARGV[3],
+		'status', ARGV[4], 'worker', ARGV[5])
+	redis.call('ZADD', KEYS[4], ARGV[3], ARGV[1])
+end
+redis.call('SETNX', KEYS[2], ARGV[1])
+redis.call('SADD', KEYS[3], ARGV[1])
+return 1
+`)
+
+	// the dataref key of the datafile read before is declared too, it's deleted only if the datafile didn't change
+	scriptDelete = redis.NewScript(`
+local df = redis.call('HGET', KEYS[1], 'datafile')
+if df and df == ARGV[2] then
+	redis.call('DEL', KEYS[3])
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+return 1
+`)
+)
+
+// Index shared by multiple replicas, stored in Redis.
+// All the keys use the same hash tag and are declared so that the scripts work on Redis Cluster
+func NewRedisIndex(client redis.UniversalClient, prefix string) *RedisIndex {
+	return newRedisIndex(client, prefix, DEFAULT_REDIS_WORKER_LEASE)
+}
+
+// The leases are renewed every third of their duration, until Close
+func newRedisIndex(client redis.UniversalClient, prefix string, lease time.Duration) *RedisIndex {
+
+	hostname, _ := os.Hostname()
+	i := &RedisIndex{
+		client:  client,
+		prefix:  fmt.Sprintf("{%s}", prefix),
+		replica: fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		timeout: DEFAULT_REDIS_TIMEOUT,
+		lease:   lease,
+		leases:  make(map[CacheKey]string),
+		stop:    make(chan struct{}),
+		log:     logrus.WithField("name", "redis-index"),
+	}
+	go i.renewLeases()
+	return i
+}
+
+func (i *RedisIndex) metaKey(ckey CacheKey) string {
+	return fmt.Sprintf("%s:meta:%s", i.prefix, ckey)
+}
+
+func (i *RedisIndex) datarefPrefix() string {
+	return fmt.Sprintf("%s:dataref:", i.prefix)
+}
+
+func (i *RedisIndex) keysKey() string {
+	return fmt.Sprintf("%s:keys", i.prefix)
+}
+
+// Cache keys sorted by access time
+func (i *RedisIndex) atimesKey() string {
+	return fmt.Sprintf("%s:atimes", i.prefix)
+}
+
+func (i *RedisIndex) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), i.timeout)
+}
+
+// Get field of cache key, returns redis.Nil if the cache key doesn't exist
+func (i *RedisIndex) getField(ckey CacheKey, field string) (string, error) {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	return i.client.HGet(ctx, i.metaKey(ckey), field).Result()
+}
+
+func (i *RedisIndex) setField(ckey CacheKey, field string, value interface{}) error {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	updated, err := scriptSetField.Run(ctx, i.client, []string{i.metaKey(ckey)}, field, value).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("cache key not found")
+	}
+	return nil
+}
+
+// ###############
+// *** GETTERS ***
+// ###############
+
+func (i *RedisIndex) GetResponseFile(ckey CacheKey) (*ResponseFile, error) {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	values, err := i.client.HMGet(ctx, i.metaKey(ckey), "ctime", "responseFile").Result()
+	if err != nil {
+		return &ResponseFile{}, err
+	}
+	if values[0] == nil {
+		return &ResponseFile{}, fmt.Errorf("cache key not found")
+	}
+
+	// response file not set yet
+	data, ok := values[1].(string)
+	if !ok {
+		return nil, nil
+	}
+
+	rf := &ResponseFile{}
+	err = json.Unmarshal([]byte(data), rf)
+	if err != nil {
+		return &ResponseFile{}, err
+	}
+	return rf, nil
+}
+
+func (i *RedisIndex) GetWorker(ckey CacheKey) int {
+
+	value, err := i.getField(ckey, "worker")
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			i.log.Errorln("failed to get worker:", err)
+		}
+		return NO_WORKER
+	}
+
+	replica, id, found := strings.Cut(value, "/")
+	if !found {
+		return NO_WORKER
+	}
+
+	// workers of other replicas don't share the ids of the local ones
+	if replica != i.replica {
+		return REMOTE_WORKER
+	}
+
+	workerID, err := strconv.Atoi(id)
+	if err != nil {
+		return NO_WORKER
+	}
+	return workerID
+}
+
+func (i *RedisIndex) GetStatus(ckey CacheKey) int {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	value, err := scriptGetStatus.Run(
+		ctx,
+		i.client,
+		[]string{i.metaKey(ckey)},
+		time.Now().UnixMilli(),
+		strconv.Itoa(STATUS_IN_PROGRESS),
+		strconv.Itoa(STATUS_NOT_FOUND),
+		strconv.Itoa(NO_WORKER),
+	).Text()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			i.log.Errorln("failed to get status:", err)
+		}
+		return STATUS_NOT_FOUND
+	}
+
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return STATUS_NOT_FOUND
+	}
+	return status
+}
+
+func (i *RedisIndex) GetATime(ckey CacheKey) (int64, error) {
+
+	value, err := i.getField(ckey, "atime")
+	if err != nil {
+		return -1, fmt.Errorf("cache key not found: %v", err)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (i *RedisIndex) GetCTime(ckey CacheKey) (int64, error) {
+
+	value, err := i.getField(ckey, "ctime")
+	if err != nil {
+		return -1, fmt.Errorf("cache key not found: %v", err)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (i *RedisIndex) GetDataRef(df DataFile) CacheKey {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	value, err := i.client.Get(ctx, i.datarefPrefix()+string(df)).Result()
+	if err != nil {
+		return ""
+	}
+	return CacheKey(value)
+}
+
+func (i *RedisIndex) GetDatafile(ckey CacheKey) (DataFile, error) {
+
+	value, err := i.getField(ckey, "datafile")
+	if err != nil {
+		return "", fmt.Errorf("auth key does not exists")
+	}
+	return DataFile(value), nil
+}
+
+// ###############
+// *** SETTERS ***
+// ###############
+
+func (i *RedisIndex) SetResponseFile(ckey CacheKey, rf *ResponseFile) error {
+
+	data, err := json.Marshal(rf)
+	if err != nil {
+		return err
+	}
+	return i.setField(ckey, "responseFile", data)
+}
+
+func (i *RedisIndex) SetATime(ckey CacheKey) error {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	updated, err := scriptSetATime.Run(
+		ctx,
+		i.client,
+		[]string{i.metaKey(ckey), i.atimesKey()},
+		string(ckey),
+		time.Now().Unix(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("cache key not found")
+	}
+	return nil
+}
+
+func (i *RedisIndex) SetStatus(ckey CacheKey, status int) error {
+	return i.setField(ckey, "status", status)
+}
+
+// Allocate worker to cache key, unless force is true
+// the worker is set only if no other worker (of any replica) is allocated or its lease has expired.
+// The lease is renewed in background until the worker is released
+func (i *RedisIndex) SetWorker(ckey CacheKey, id int, force bool) error {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	value := strconv.Itoa(NO_WORKER)
+	if id != NO_WORKER {
+		value = fmt.Sprintf("%s/%d", i.replica, id)
+	}
+
+	now := time.Now()
+	updated, err := scriptSetWorker.Run(
+		ctx,
+		i.client,
+		[]string{i.metaKey(ckey)},
+		value,
+		force,
+		strconv.Itoa(NO_WORKER),
+		now.UnixMilli(),
+		now.Add(i.lease).UnixMilli(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if updated == -1 {
+		return fmt.Errorf("failed to update cache key status, not found")
+	}
+
+	i.leasesLock.Lock()
+	defer i.leasesLock.Unlock()
+
+	if updated == 1 && id != NO_WORKER {
+		i.leases[ckey] = value
+	} else if updated == 1 {
+		delete(i.leases, ckey)
+	}
+	return nil
+}
+
+// Renew the leases of the workers of this replica, the ones taken over by other replicas are dropped
+func (i *RedisIndex) renewLeases() {
+
+	ticker := time.NewTicker(i.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+		}
+
+		i.leasesLock.Lock()
+		leases := maps.Clone(i.leases)
+		i.leasesLock.Unlock()
+
+		for ckey, value := range leases {
+			ctx, cancel := i.context()
+			renewed, err := scriptRenewLease.Run(
+				ctx,
+				i.client,
+				[]string{i.metaKey(ckey)},
+				value,
+				time.Now().Add(i.lease).UnixMilli(),
+			).Int()
+			cancel()
+			if err != nil {
+				i.log.Errorf("failed to renew worker lease of %s: %v", ckey, err)
+				continue
+			}
+			if renewed == 0 {
+				i.leasesLock.Lock()
+				if i.leases[ckey] == value {
+					delete(i.leases, ckey)
+				}
+				i.leasesLock.Unlock()
+			}
+		}
+	}
+}
+
+// ###############
+// ** Delete/List Methods
+// ###############
+
+func (i *RedisIndex) ListCacheKeys() []CacheKey {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	members, err := i.client.SMembers(ctx, i.keysKey()).Result()
+	if err != nil {
+		i.log.Errorln("failed to list cache keys:", err)
+		return []CacheKey{}
+	}
+
+	keys := make([]CacheKey, 0, len(members))
+	for _, m := range members {
+		keys = append(keys, CacheKey(m))
+	}
+	return keys
+}
+
+// Insert cache entry if doesn't exists
+// This method must be idempotent
+func (i *RedisIndex) Put(ckey CacheKey, df DataFile) error {
+
+	if ckey == "" || df == "" {
+		return fmt.Errorf("invalid value for cache key or datafile")
+	}
+
+	ctx, cancel := i.context()
+	defer cancel()
+
+	return scriptPut.Run(
+		ctx,
+		i.client,
+		[]string{i.metaKey(ckey), i.datarefPrefix() + string(df), i.keysKey(), i.atimesKey()},
+		string(ckey),
+		string(df),
+		time.Now().Unix(),
+		STATUS_NOT_FOUND,
+		NO_WORKER,
+	).Err()
+}
+
+func (i *RedisIndex) Delete(ckey CacheKey) {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	df, err := i.client.HGet(ctx, i.metaKey(ckey), "datafile").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		i.log.Errorf("failed to delete cache key %s: %v", ckey, err)
+		return
+	}
+
+	err = scriptDelete.Run(
+		ctx,
+		i.client,
+		[]string{i.metaKey(ckey), i.keysKey(), i.datarefPrefix() + df, i.atimesKey()},
+		string(ckey),
+		df,
+	).Err()
+	if err != nil {
+		i.log.Errorf("failed to delete cache key %s: %v", ckey, err)
+	}
+}
+
+// Cache keys from the sorted set of the access times.
+// The keys stored before it existed are added from their atime field when they're missing
+func (i *RedisIndex) ListLeastUsed(offset, count int) ([]CacheKey, error) {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	if offset == 0 {
+		err := i.addMissingATimes(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	members, err := i.client.ZRange(ctx, i.atimesKey(), int64(offset), int64(offset+count-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]CacheKey, 0, len(members))
+	for _, m := range members {
+		keys = append(keys, CacheKey(m))
+	}
+	return keys, nil
+}
+
+func (i *RedisIndex) addMissingATimes(ctx context.Context) error {
+
+	indexed, err := i.client.SCard(ctx, i.keysKey()).Result()
+	if err != nil {
+		return err
+	}
+	sorted, err := i.client.ZCard(ctx, i.atimesKey()).Result()
+	if err != nil || sorted >= indexed {
+		return err
+	}
+
+	members, err := i.client.SMembers(ctx, i.keysKey()).Result()
+	if err != nil {
+		return err
+	}
+	pipe := i.client.Pipeline()
+	atimes := make([]*redis.StringCmd, 0, len(members))
+	for _, m := range members {
+		atimes = append(atimes, pipe.HGet(ctx, i.metaKey(CacheKey(m)), "atime"))
+	}
+	pipe.Exec(ctx)
+
+	missing := make([]redis.Z, 0, len(members))
+	for n, cmd := range atimes {
+		atime, err := cmd.Int64()
+		if err == nil {
+			missing = append(missing, redis.Z{Score: float64(atime), Member: members[n]})
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// the keys already sorted keep their access time
+	err = i.client.ZAddNX(ctx, i.atimesKey(), missing...).Err()
+	if err != nil {
+		return err
+	}
+	i.log.Infof("%d cache keys added to the access times", indexed-sorted)
+	return nil
+}
+
+// ###############
+// ** Others
+// ###############
+
+func (i *RedisIndex) Len() int {
+	ctx, cancel := i.context()
+	defer cancel()
+
+	n, err := i.client.SCard(ctx, i.keysKey()).Result()
+	if err != nil {
+		i.log.Errorln("failed to count cache keys:", err)
+		return 0
+	}
+	return int(n)
+}
+
+// Stop renewing the worker leases, the downloads in progress are taken over by other replicas when they expire
+func (i *RedisIndex) Close() error {
+	close(i.stop)
+	return nil
+}
+
+func (i *RedisIndex) Print() {
+	logrus.Debugln("----------------------------------------")
+	logrus.Debugln("redis index:", i.prefix, "keys:", i.Len())
+	logrus.Debugln("----------------------------------------")
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisIndex(t *testing.T) (*RedisIndex, *miniredis.Miniredis) {
+	srv := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{srv.Addr()}})
+	return NewRedisIndex(client, "registry-cache"), srv
+}
+
+func TestRedisCreateEntry(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	err := myindex.Put("key", "")
+	err2 := myindex.Put("key", "datafile")
+	err3 := myindex.Put("key", "datafile")
+
+	df, dfErr := myindex.GetDatafile("key")
+
+	assert.NotNil(t, err)
+	assert.Nil(t, err2)
+	assert.Nil(t, err3)
+	assert.Nil(t, dfErr)
+	assert.Equal(t, DataFile("datafile"), df)
+	assert.Equal(t, CacheKey("key"), myindex.GetDataRef("datafile"))
+	assert.Equal(t, STATUS_NOT_FOUND, myindex.GetStatus("key"))
+	assert.Equal(t, 1, myindex.Len())
+}
+
+func TestRedisDeleteEntry(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	myindex.Put("key", "datafile")
+	myindex.Delete("key")
+
+	_, dfErr := myindex.GetDatafile("key")
+
+	assert.NotNil(t, dfErr)
+	assert.Equal(t, CacheKey(""), myindex.GetDataRef("datafile"))
+	assert.Equal(t, 0, len(myindex.ListCacheKeys()))
+}
+
+func TestRedisSetGetResponseFile(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	respfile := NewResponseFile(1000, 200, map[string][]string{"Content-Type": {"application/json"}}, "key")
+
+	err := myindex.SetResponseFile("key", respfile)
+	assert.NotNil(t, err)
+
+	myindex.Put("key", "datafile")
+	err = myindex.SetResponseFile("key", respfile)
+	getMeta, getErr := myindex.GetResponseFile("key")
+
+	assert.Nil(t, err)
+	assert.Nil(t, getErr)
+	assert.Equal(t, respfile, getMeta)
+}
+
+func TestRedisSetGetStatus(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	err := myindex.SetStatus("key", STATUS_AVAILABLE)
+	assert.NotNil(t, err)
+
+	myindex.Put("key", "datafile")
+	err2 := myindex.SetStatus("key", STATUS_AVAILABLE)
+
+	assert.Nil(t, err2)
+	assert.Equal(t, STATUS_AVAILABLE, myindex.GetStatus("key"))
+}
+
+func TestRedisSetWorker(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	myindex.Put("key", "datafile")
+
+	assert.Equal(t, NO_WORKER, myindex.GetWorker("key"))
+
+	myindex.SetWorker("key", 10, false)
+	first := myindex.GetWorker("key")
+
+	myindex.SetWorker("key", 11, true)
+	second := myindex.GetWorker("key")
+
+	myindex.SetWorker("key", 12, false)
+	third := myindex.GetWorker("key")
+
+	myindex.SetWorker("key", NO_WORKER, true)
+	fourth := myindex.GetWorker("key")
+
+	assert.Equal(t, 10, first)
+	assert.Equal(t, 11, second)
+	assert.Equal(t, 11, third)
+	assert.Equal(t, NO_WORKER, fourth)
+}
+
+func TestRedisSetWorkerAcrossReplicas(t *testing.T) {
+	replica1, srv := newTestRedisIndex(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{srv.Addr()}})
+	replica2 := NewRedisIndex(client, "registry-cache")
+
+	replica1.Put("key", "datafile")
+	replica2.Put("key", "datafile")
+
+	// both replicas try to allocate their worker 0
+	replica1.SetWorker("key", 0, false)
+	replica2.SetWorker("key", 0, false)
+
+	assert.Equal(t, 0, replica1.GetWorker("key"))
+	assert.Equal(t, REMOTE_WORKER, replica2.GetWorker("key"))
+}
+
+func TestRedisSetGetAtime(t *testing.T) {
+	myindex, _ := newTestRedisIndex(t)
+	myindex.Put("key", "datafile")
+
+	timePreUpdate, _ := myindex.GetATime("key")
+	time.Sleep(1 * time.Second)
+	err := myindex.SetATime("key")
+	timePostUpdate, _ := myindex.GetATime("key")
+	ctime, _ := myindex.GetCTime("key")
+
+	assert.Nil(t, err)
+	assert.NotEqual(t, timePreUpdate, timePostUpdate)
+	assert.Equal(t, timePreUpdate, ctime)
+}
+
+func TestRedisExpiredWorkerLease(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{srv.Addr()}})
+	replica1 := newRedisIndex(client, "registry-cache", 50*time.Millisecond)
+	replica2 := NewRedisIndex(client, "registry-cache")
+
+	// replica1 dies while downloading, its lease isn't renewed
+	replica1.Close()
+	replica1.Put("key", "datafile")
+	replica1.SetWorker("key", 0, false)
+	replica1.SetStatus("key", STATUS_IN_PROGRESS)
+
+	replica2.SetWorker("key", 0, false)
+	assert.Equal(t, REMOTE_WORKER, replica2.GetWorker("key"))
+	assert.Equal(t, STATUS_IN_PROGRESS, replica2.GetStatus("key"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the download is reset and can be claimed by another replica
+	assert.Equal(t, STATUS_NOT_FOUND, replica2.GetStatus("key"))
+	replica2.SetWorker("key", 0, false)
+	assert.Equal(t, 0, replica2.GetWorker("key"))
+}
+
+func TestRedisWorkerLeaseRenewed(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{srv.Addr()}})
+	replica1 := newRedisIndex(client, "registry-cache", 60*time.Millisecond)
+	defer replica1.Close()
+	replica2 := NewRedisIndex(client, "registry-cache")
+
+	replica1.Put("key", "datafile")
+	replica1.SetWorker("key", 0, false)
+	replica1.SetStatus("key", STATUS_IN_PROGRESS)
+
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, STATUS_IN_PROGRESS, replica2.GetStatus("key"))
+	replica2.SetWorker("key", 0, false)
+	assert.Equal(t, REMOTE_WORKER, replica2.GetWorker("key"))
+
+	// released workers aren't renewed anymore
+	replica1.SetWorker("key", NO_WORKER, true)
+	replica1.leasesLock.Lock()
+	assert.Empty(t, replica1.leases)
+	replica1.leasesLock.Unlock()
+}
+
+func TestRedisListLeastUsed(t *testing.T) {
+	myindex, srv := newTestRedisIndex(t)
+	for _, k := range []CacheKey{"a", "b", "c"} {
+		myindex.Put(k, DataFile("datafile-"+k))
+	}
+	srv.ZAdd(myindex.atimesKey(), 3, "a")
+	srv.ZAdd(myindex.atimesKey(), 1, "b")
+	srv.ZAdd(myindex.atimesKey(), 2, "c")
+
+	keys, err := myindex.ListLeastUsed(0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []CacheKey{"b", "c"}, keys)
+	keys, _ = myindex.ListLeastUsed(2, 2)
+	assert.Equal(t, []CacheKey{"a"}, keys)
+
+	myindex.Delete("b")
+	assert.Nil(t, myindex.SetATime("c"))
+	keys, _ = myindex.ListLeastUsed(0, 10)
+	assert.Equal(t, []CacheKey{"a", "c"}, keys)
+
+	// keys indexed before the access times were sorted
+	srv.Del(myindex.atimesKey())
+	srv.HSet(myindex.metaKey("a"), "atime", "10")
+	srv.HSet(myindex.metaKey("c"), "atime", "5")
+	keys, _ = myindex.ListLeastUsed(0, 10)
+	assert.Equal(t, []CacheKey{"c", "a"}, keys)
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 )
@@ -19,21 +20,34 @@ func NewResponseFile(cLen int, status int, headers http.Header, ck CacheKey) *Re
 	}
 }
 
+// Dump response file on disk,
+// the content is written into a partial file first so that a crash never leaves a truncated file
 func (m *ResponseFile) Dump(path string) error {
 
 	jsonBytes, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(path)
+
+	partialPath := fmt.Sprintf("%s%s", path, SUFFIX_PARTIAL_FILE)
+	f, err := os.Create(partialPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	_, err = f.Write(jsonBytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
 
-	return err
+	return os.Rename(partialPath, path)
 }
 
 func (m *ResponseFile) Load(path string) error {
@@ -0,0 +1,376 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/minio/minio-go/v7"
+	"github.com/sirupsen/logrus"
+)
+
+// Cache storing files in a S3-compatible bucket.
+// spoolPath is a local directory used to verify and stream downloads before they're uploaded,
+// if presignExpiry > 0 clients are redirected to presigned URLs of the cached layers
+// The pinned files are never chosen for eviction, pins can be nil
+func NewS3Cache(idx Index, client *minio.Client, bucket, prefix, spoolPath string, presignExpiry time.Duration, pins *eviction.Pinned) *S3Cache {
+	return &S3Cache{
+		client:        client,
+		bucket:        bucket,
+		prefix:        strings.Trim(prefix, "/"),
+		presignExpiry: presignExpiry,
+		timeout:       DEFAULT_S3_TIMEOUT,
+		spool:         NewCache(idx, spoolPath, eviction.NewLRU()),
+		index:         idx,
+		pins:          pins,
+		log:           logrus.WithField("name", "s3-cache"),
+	}
+}
+
+func (c *S3Cache) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// Same cache request, with the files in the local spool directory
+func (c *S3Cache) spoolRequest(cr *CacheRequest) *CacheRequest {
+	scr := *cr
+	scr.DataFile = DataFile(filepath.Join(c.spool.GetDataPath(), string(cr.DataFile)))
+	scr.ResponseFilePath = ComputeResponseFilePath(string(scr.DataFile))
+	return &scr
+}
+
+// Remove the spool files of an uploaded cache request
+func (c *S3Cache) removeSpool(scr *CacheRequest) {
+	c.spool.policy.Remove(string(scr.CacheKey))
+	c.spool.unaccount(scr.CacheKey)
+	os.Remove(string(scr.DataFile))
+	os.Remove(scr.ResponseFilePath)
+}
+
+// Get object, making sure it exists as GetObject is lazy
+func (c *S3Cache) getObject(key string) (*minio.Object, error) {
+
+	obj, err := c.client.GetObject(context.Background(), c.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, toFsError(err)
+	}
+	return obj, nil
+}
+
+// Download and verify the content in the spool directory, then upload it with its response file
+func (c *S3Cache) Create(cr *CacheRequest, respfile *ResponseFile, content io.ReadCloser, offset int64) error {
+
+	scr := c.spoolRequest(cr)
+	err := c.spool.Create(scr, respfile, content, offset)
+	if err != nil {
+		return err
+	}
+	defer c.removeSpool(scr)
+
+	_, err = c.client.FPutObject(
+		context.Background(),
+		c.bucket,
+		string(cr.DataFile),
+		string(scr.DataFile),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+	)
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_UPLOAD, Err: fmt.Errorf("failed to upload '%v': %v", cr.DataFile, err)}
+	}
+
+	jsonBytes, err := json.Marshal(respfile)
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_UPLOAD, Err: err}
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	_, err = c.client.PutObject(
+		ctx,
+		c.bucket,
+		cr.ResponseFilePath,
+		bytes.NewReader(jsonBytes),
+		int64(len(jsonBytes)),
+		minio.PutObjectOptions{ContentType: "application/json"},
+	)
+	if err != nil {
+		return &WriteError{Reason: WRITE_ERROR_UPLOAD, Err: fmt.Errorf("failed to upload '%v': %v", cr.ResponseFilePath, err)}
+	}
+
+	return nil
+}
+
+func (c *S3Cache) PartialSize(cr *CacheRequest) int64 {
+	return c.spool.PartialSize(c.spoolRequest(cr))
+}
+
+// Downloads are written to the spool before being uploaded
+func (c *S3Cache) Filling(ckey CacheKey) bool {
+	return c.spool.Filling(ckey)
+}
+
+// Load the index from the response files stored in the bucket
+func (c *S3Cache) Restore() error {
+
+	files, err := c.List()
+	if err != nil {
+		return fmt.Errorf("failed to restore: %v", err)
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Path, SUFFIX_LAYER_FILE) && !strings.HasSuffix(f.Path, SUFFIX_MANIFEST_FILE) {
+			continue
+		}
+
+		rf, err := c.loadResponseFile(ComputeResponseFilePath(f.Path))
+		if err != nil {
+			c.log.Warningf("failed to load response file of %s: %v", f.Path, err)
+			continue
+		}
+
+		c.index.Put(rf.CacheKey, DataFile(f.Path))
+		c.index.SetResponseFile(rf.CacheKey, rf)
+
+		// avoid the cache key to stay in progress
+		err = c.index.SetStatus(rf.CacheKey, STATUS_AVAILABLE)
+		if err != nil {
+			c.index.Delete(rf.CacheKey)
+		}
+	}
+
+	return nil
+}
+
+func (c *S3Cache) loadResponseFile(key string) (*ResponseFile, error) {
+
+	obj, err := c.getObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	rf := &ResponseFile{}
+	err = json.NewDecoder(obj).Decode(rf)
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Stream the content from the spool while it's downloaded or uploaded, from the bucket otherwise
+func (c *S3Cache) Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error) {
+
+	reader, meta, err := c.spool.Read(c.spoolRequest(cr))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return reader, meta, err
+	}
+
+	meta, err = c.index.GetResponseFile(cr.CacheKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := c.getObject(string(cr.DataFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	return obj, meta, nil
+}
+
+// Presigned URL of a cached layer,
+// manifests and files not uploaded yet are streamed by the proxy
+func (c *S3Cache) RedirectURL(cr *CacheRequest) (string, error) {
+
+	if c.presignExpiry <= 0 || cr.ItemType != "layer" {
+		return "", nil
+	}
+
+	if c.spool.getFill(cr.CacheKey) != nil {
+		return "", nil
+	}
+	if _, err := os.Stat(string(c.spoolRequest(cr).DataFile)); err == nil {
+		return "", nil
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	u, err := c.client.PresignedGetObject(ctx, c.bucket, string(cr.DataFile), c.presignExpiry, nil)
+	if err != nil {
+		return "", err
+	}
+
+	c.index.SetATime(cr.CacheKey)
+	return u.String(), nil
+}
+
+// Deletes objects from the bucket and index entries
+func (c *S3Cache) Delete(df DataFile, ckey CacheKey, atomic bool) error {
+
+	if df == "" && ckey == "" {
+		return fmt.Errorf("empty cache key and empty datafile")
+	}
+
+	if df == "" {
+		df, _ = c.index.GetDatafile(ckey)
+	}
+
+	if ckey == "" {
+		ckey = c.index.GetDataRef(df)
+	}
+
+	if ckey != "" {
+		c.index.Delete(ckey)
+	}
+
+	if df == "" {
+		return nil
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	// removing a missing object isn't an error for S3
+	for _, key := range []string{string(df), ComputeResponseFilePath(string(df))} {
+		err := c.client.RemoveObject(ctx, c.bucket, key, minio.RemoveObjectOptions{})
+		if err != nil && atomic {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Object key prefix, used in place of the data path to compute the data files
+func (c *S3Cache) GetDataPath() string {
+	return c.prefix
+}
+
+// The bucket is shared by replicas, use the access time of the index. Pinned files are skipped
+func (c *S3Cache) GetLeastUsedFile() (DataFile, error) {
+
+	ai, ok := c.index.(ATimeIndex)
+	if !ok {
+		return c.scanLeastUsedFile()
+	}
+
+	for offset := 0; ; offset += LEAST_USED_BATCH {
+		keys, err := ai.ListLeastUsed(offset, LEAST_USED_BATCH)
+		if err != nil {
+			return "", err
+		}
+		for _, k := range keys {
+			if c.evictable(k) {
+				return c.index.GetDatafile(k)
+			}
+		}
+		if len(keys) < LEAST_USED_BATCH {
+			return "", fmt.Errorf("no cached files")
+		}
+	}
+}
+
+// Indexes without sorted access times are read entirely
+func (c *S3Cache) scanLeastUsedFile() (DataFile, error) {
+
+	var lu CacheKey
+	var luAtime int64 = math.MaxInt64
+	for _, k := range c.index.ListCacheKeys() {
+		if !c.evictable(k) {
+			continue
+		}
+		atime, err := c.index.GetATime(k)
+		if err == nil && atime < luAtime {
+			lu = k
+			luAtime = atime
+		}
+	}
+
+	if lu == "" {
+		return "", fmt.Errorf("no cached files")
+	}
+	return c.index.GetDatafile(lu)
+}
+
+func (c *S3Cache) evictable(k CacheKey) bool {
+	if c.pins != nil && c.pins.IsPinned(string(k)) {
+		return false
+	}
+	return c.index.GetStatus(k) == STATUS_AVAILABLE
+}
+
+func (c *S3Cache) List() ([]FileInfo, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	files := make([]FileInfo, 0)
+	opts := minio.ListObjectsOptions{
+		Prefix:    path.Join(c.prefix, SHARDS_DIR) + "/",
+		Recursive: true,
+	}
+	for obj := range c.client.ListObjects(ctx, c.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		files = append(files, FileInfo{Path: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return files, nil
+}
+
+// The bucket can be shared by other replicas, the usage is computed listing it
+func (c *S3Cache) Usage() (int64, error) {
+
+	files, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	return size, nil
+}
+
+func (c *S3Cache) Stat(df DataFile) (*FileInfo, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	info, err := c.client.StatObject(ctx, c.bucket, string(df), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, toFsError(err)
+	}
+	return &FileInfo{Path: info.Key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (c *S3Cache) Open(df DataFile) (io.ReadCloser, error) {
+	return c.getObject(string(df))
+}
+
+// Map missing objects to fs.ErrNotExist, so that callers handle both backends alike
+func toFsError(err error) error {
+	code := minio.ToErrorResponse(err).Code
+	if code == "NoSuchKey" || code == "NotFound" {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBucket = "registry-cache"
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Minimal S3 server: put, get, head, delete and list objects of a single bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// client trusting the server certificate
+	client *http.Client
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	Size         int64
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3Contents
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		result := &fakeS3ListResult{Name: bucket, Prefix: prefix}
+		for k, obj := range s.objects {
+			if strings.HasPrefix(k, prefix) {
+				result.Contents = append(result.Contents, fakeS3Contents{
+					Key:          k,
+					LastModified: obj.modTime.UTC().Format(time.RFC3339),
+					Size:         int64(len(obj.data)),
+				})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = &fakeObject{data: data, modTime: time.Now()}
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		obj, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, "", obj.modTime, bytes.NewReader(obj.data))
+	}
+}
+
+func newTestS3Cache(t *testing.T, idx Index, presignExpiry time.Duration) (*S3Cache, *fakeS3) {
+	fake := &fakeS3{objects: map[string]*fakeObject{}}
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+	fake.client = srv.Client()
+
+	u, _ := url.Parse(srv.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Secure:       true,
+		Transport:    srv.Client().Transport,
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewS3Cache(idx, client, testBucket, "cache/", t.TempDir(), presignExpiry, nil), fake
+}
+
+func TestS3CreateRead(t *testing.T) {
+	myindex := NewMemoryIndex()
+	mycache, fake := newTestS3Cache(t, myindex, 0)
+
+	cr := newTestCacheRequest(mycache.GetDataPath(), "helloworld")
+	myindex.Put(cr.CacheKey, cr.DataFile)
+
+	err := mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "helloworld", string(fake.objects[string(cr.DataFile)].data))
+	assert.Contains(t, fake.objects, cr.ResponseFilePath)
+	assert.True(t, strings.HasPrefix(string(cr.DataFile), "cache/sha256/"))
+
+	// spool files are removed once uploaded
+	_, spoolErr := mycache.spool.Stat(mycache.spoolRequest(cr).DataFile)
+	assert.True(t, errors.Is(spoolErr, fs.ErrNotExist))
+
+	reader, meta, err := mycache.Read(cr)
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "helloworld", string(content))
+	assert.Equal(t, 10, meta.ContentLength)
+
+	// ranges are served by seeking into the object
+	reader, _, _ = mycache.Read(cr)
+	reader.(io.Seeker).Seek(5, io.SeekStart)
+	content, _ = io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "world", string(content))
+
+	files, err := mycache.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	err = mycache.Delete("", cr.CacheKey, true)
+	_, statErr := mycache.Stat(cr.DataFile)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(statErr, fs.ErrNotExist))
+	assert.Equal(t, 0, len(fake.objects))
+}
+
+func TestS3CreateVerifiesContent(t *testing.T) {
+	myindex := NewMemoryIndex()
+	mycache, fake := newTestS3Cache(t, myindex, 0)
+
+	cr := newTestCacheRequest(mycache.GetDataPath(), "helloworld")
+	myindex.Put(cr.CacheKey, cr.DataFile)
+
+	err := mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("hellohello")), 0)
+	var writeErr *WriteError
+	assert.True(t, errors.As(err, &writeErr))
+	assert.Equal(t, WRITE_ERROR_DIGEST_MISMATCH, writeErr.Reason)
+	assert.Equal(t, 0, len(fake.objects))
+}
+
+func TestS3Restore(t *testing.T) {
+	mycache, _ := newTestS3Cache(t, NewMemoryIndex(), 0)
+
+	cr := newTestCacheRequest(mycache.GetDataPath(), "helloworld")
+	mycache.index.Put(cr.CacheKey, cr.DataFile)
+	mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+
+	// another replica sharing the bucket
+	myindex := NewMemoryIndex()
+	mycache.index = myindex
+	err := mycache.Restore()
+
+	df, _ := myindex.GetDatafile(cr.CacheKey)
+	assert.Nil(t, err)
+	assert.Equal(t, cr.DataFile, df)
+	assert.Equal(t, STATUS_AVAILABLE, myindex.GetStatus(cr.CacheKey))
+}
+
+func TestS3RedirectURL(t *testing.T) {
+	myindex := NewMemoryIndex()
+	mycache, fake := newTestS3Cache(t, myindex, 10*time.Minute)
+
+	cr := newTestCacheRequest(mycache.GetDataPath(), "helloworld")
+	cr.ItemType = "layer"
+	myindex.Put(cr.CacheKey, cr.DataFile)
+	mycache.Create(cr, NewResponseFile(10, 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader("helloworld")), 0)
+
+	location, err := mycache.RedirectURL(cr)
+	assert.Nil(t, err)
+	assert.Contains(t, location, "/"+testBucket+"/"+string(cr.DataFile))
+
+	resp, err := fake.client.Get(location)
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "helloworld", string(content))
+
+	// manifests are always streamed
+	cr.ItemType = "manifest"
+	location, _ = mycache.RedirectURL(cr)
+	assert.Empty(t, location)
+}
+
+func TestS3LeastUsedFileSkipsPinned(t *testing.T) {
+	myindex := NewMemoryIndex()
+	mycache, _ := newTestS3Cache(t, myindex, 0)
+	mycache.pins = eviction.NewPinned(eviction.NewLRU())
+
+	crs := make([]*CacheRequest, 0)
+	for i, content := range []string{"helloworld", "0123456789"} {
+		cr := newTestCacheRequest(mycache.GetDataPath(), content)
+		myindex.Put(cr.CacheKey, cr.DataFile)
+		mycache.Create(cr, NewResponseFile(len(content), 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader(content)), 0)
+		myindex.SetStatus(cr.CacheKey, STATUS_AVAILABLE)
+		myindex.meta[cr.CacheKey].Atime = int64(i)
+		crs = append(crs, cr)
+	}
+
+	// the least used file is pinned, the next one is chosen
+	mycache.pins.Pin(string(crs[0].CacheKey))
+	luf, err := mycache.GetLeastUsedFile()
+	assert.Nil(t, err)
+	assert.Equal(t, crs[1].DataFile, luf)
+
+	mycache.pins.Pin(string(crs[1].CacheKey))
+	_, err = mycache.GetLeastUsedFile()
+	assert.NotNil(t, err)
+}
+
+func TestS3LeastUsedFileSortedATimes(t *testing.T) {
+	myindex, srv := newTestRedisIndex(t)
+	mycache, _ := newTestS3Cache(t, myindex, 0)
+	mycache.pins = eviction.NewPinned(eviction.NewLRU())
+
+	crs := make([]*CacheRequest, 0)
+	for i := 0; i < LEAST_USED_BATCH+2; i++ {
+		content := fmt.Sprintf("content %d", i)
+		cr := newTestCacheRequest(mycache.GetDataPath(), content)
+		myindex.Put(cr.CacheKey, cr.DataFile)
+		myindex.SetStatus(cr.CacheKey, STATUS_AVAILABLE)
+		srv.ZAdd(myindex.atimesKey(), float64(i), string(cr.CacheKey))
+		crs = append(crs, cr)
+	}
+
+	// the files of the first batch are pinned or being downloaded
+	for _, cr := range crs[:LEAST_USED_BATCH] {
+		mycache.pins.Pin(string(cr.CacheKey))
+	}
+	myindex.SetStatus(crs[LEAST_USED_BATCH].CacheKey, STATUS_IN_PROGRESS)
+
+	luf, err := mycache.GetLeastUsedFile()
+	assert.Nil(t, err)
+	assert.Equal(t, crs[LEAST_USED_BATCH+1].DataFile, luf)
+
+	mycache.pins.Pin(string(crs[LEAST_USED_BATCH+1].CacheKey))
+	_, err = mycache.GetLeastUsedFile()
+	assert.NotNil(t, err)
+}
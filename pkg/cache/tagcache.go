@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"time"
+)
+
+func NewTagCache(ttl time.Duration) *TagCache {
+	return &TagCache{
+		ttl:     ttl,
+		entries: make(map[TagKey]TagEntry),
+	}
+}
+
+func (t *TagCache) Get(key TagKey) (TagEntry, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	entry, ok := t.entries[key]
+	return entry, ok
+}
+
+// Fresh entries are served without revalidation
+func (t *TagCache) Fresh(entry TagEntry) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return time.Since(entry.Validated) < t.ttl
+}
+
+// The new ttl applies to the entries already cached
+func (t *TagCache) SetTTL(ttl time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.ttl = ttl
+}
+
+func (t *TagCache) Set(key TagKey, digest, etag string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.entries[key]; !ok && len(t.entries) >= TAG_CACHE_MAX_ENTRIES {
+		t.purge()
+		if len(t.entries) >= TAG_CACHE_MAX_ENTRIES {
+			return
+		}
+	}
+	t.entries[key] = TagEntry{Digest: digest, ETag: etag, Validated: time.Now()}
+}
+
+// Drop the entries that would be revalidated
+func (t *TagCache) purge() {
+	for key, entry := range t.entries {
+		if time.Since(entry.Validated) >= t.ttl {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// The upstream confirmed that the tag hasn't moved
+func (t *TagCache) Validate(key TagKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if entry, ok := t.entries[key]; ok {
+		entry.Validated = time.Now()
+		t.entries[key] = entry
+	}
+}
+
+func (t *TagCache) Delete(key TagKey) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.entries, key)
+}
+
+func (t *TagCache) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.entries)
+}
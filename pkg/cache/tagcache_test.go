@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeAcceptKey(t *testing.T) {
+	header := http.Header{}
+	header.Add("Accept", MEDIA_TYPE_OCI_INDEX+"; q=0.9, "+MEDIA_TYPE_DOCKER_MANIFEST)
+	header.Add("Accept", "application/x-random-"+fmt.Sprint(time.Now().UnixNano())+", */*, "+MEDIA_TYPE_DOCKER_MANIFEST)
+
+	// unknown media types and parameters don't create new keys
+	assert.Equal(t, MEDIA_TYPE_DOCKER_MANIFEST+","+MEDIA_TYPE_OCI_INDEX, ComputeAcceptKey(header))
+	assert.Equal(t, "", ComputeAcceptKey(http.Header{"Accept": {"text/html"}}))
+}
+
+func TestTagCacheMaxEntries(t *testing.T) {
+	tags := NewTagCache(time.Minute)
+	for i := 0; i < TAG_CACHE_MAX_ENTRIES+10; i++ {
+		tags.Set(TagKey{Repository: "app", Tag: fmt.Sprint(i)}, "sha256:digest", "")
+	}
+	assert.Equal(t, TAG_CACHE_MAX_ENTRIES, tags.Len())
+
+	// the entries to revalidate are dropped to make room
+	tags.SetTTL(0)
+	tags.Set(TagKey{Repository: "app", Tag: "new"}, "sha256:digest", "")
+	assert.Equal(t, 1, tags.Len())
+}
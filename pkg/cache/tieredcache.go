@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Lower tier stored in lowerPath with the same layout of the data path (e.g.: a NFS mount).
+// Files are removed from it when unused for longer than maxUnused
+// or when it's larger than maxSize, zero values disable the limits
+func NewTieredCache(next Cache, lowerPath string, maxSize int64, maxUnused time.Duration) *TieredCache {
+	return &TieredCache{
+		next:      next,
+		lowerPath: lowerPath,
+		maxSize:   maxSize,
+		maxUnused: maxUnused,
+		log:       logrus.WithField("name", "tiered-cache"),
+	}
+}
+
+// Path of a data file of the upper tier in the lower tier
+func (c *TieredCache) lowerFile(df DataFile) (string, error) {
+	rel, err := filepath.Rel(c.next.GetDataPath(), string(df))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not in the data path", df)
+	}
+	return filepath.Join(c.lowerPath, rel), nil
+}
+
+func (c *TieredCache) OpenLower(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error) {
+
+	df, err := c.lowerFile(cr.DataFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the response file is written last, the data file is complete if it exists
+	jsonBytes, err := os.ReadFile(ComputeResponseFilePath(df))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rf := &ResponseFile{}
+	err = json.Unmarshal(jsonBytes, rf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(df)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the modification time tracks the last use of the file in the lower tier
+	now := time.Now()
+	os.Chtimes(df, now, now)
+
+	return f, rf, nil
+}
+
+func (c *TieredCache) Demote(df DataFile) error {
+
+	dst, err := c.lowerFile(df)
+	if err != nil {
+		return err
+	}
+
+	// already demoted by this or another replica
+	if _, err := os.Stat(ComputeResponseFilePath(dst)); err == nil {
+		now := time.Now()
+		return os.Chtimes(dst, now, now)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(string(df), dst)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to the lower tier: %v", df, err)
+	}
+
+	err = copyFile(ComputeResponseFilePath(string(df)), ComputeResponseFilePath(dst))
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy response file of %s to the lower tier: %v", df, err)
+	}
+
+	return nil
+}
+
+func (c *TieredCache) CleanLower() (int64, error) {
+
+	files := make([]FileInfo, 0)
+	err := filepath.WalkDir(filepath.Join(c.lowerPath, SHARDS_DIR), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			var info fs.FileInfo
+			info, err = d.Info()
+			if err == nil {
+				files = append(files, FileInfo{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+		// files can be removed by other replicas while walking
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list lower tier: %v", err)
+	}
+
+	var size int64
+	datafiles := make([]FileInfo, 0)
+	for _, f := range files {
+		unused := c.maxUnused > 0 && time.Since(f.ModTime) > c.maxUnused
+
+		switch {
+		case strings.HasSuffix(f.Path, SUFFIX_PARTIAL_FILE):
+			// copies interrupted by a crash
+			if unused {
+				os.Remove(f.Path)
+			}
+		case strings.HasSuffix(f.Path, SUFFIX_LAYER_FILE), strings.HasSuffix(f.Path, SUFFIX_MANIFEST_FILE):
+			if unused {
+				c.log.Infoln("deleting unused file from lower tier:", f.Path)
+				c.removeLower(f.Path)
+				continue
+			}
+			datafiles = append(datafiles, f)
+			size += f.Size
+		}
+	}
+
+	if c.maxSize <= 0 || size <= c.maxSize {
+		return size, nil
+	}
+
+	// least recently used first
+	sort.Slice(datafiles, func(i, j int) bool { return datafiles[i].ModTime.Before(datafiles[j].ModTime) })
+	for _, f := range datafiles {
+		if size <= c.maxSize {
+			break
+		}
+		c.log.Infoln("deleting least used file from lower tier:", f.Path)
+		c.removeLower(f.Path)
+		size -= f.Size
+	}
+
+	return size, nil
+}
+
+func (c *TieredCache) RemoveLower(df DataFile) error {
+
+	path, err := c.lowerFile(df)
+	if err != nil {
+		return err
+	}
+	c.removeLower(path)
+	return nil
+}
+
+// Remove the response file first, so that the file isn't promoted while it's removed
+func (c *TieredCache) removeLower(path string) {
+	os.Remove(ComputeResponseFilePath(path))
+	os.Remove(path)
+}
+
+func (c *TieredCache) Create(cr *CacheRequest, meta *ResponseFile, content io.ReadCloser, offset int64) error {
+	return c.next.Create(cr, meta, content, offset)
+}
+
+func (c *TieredCache) Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error) {
+	return c.next.Read(cr)
+}
+
+func (c *TieredCache) Delete(df DataFile, ckey CacheKey, atomic bool) error {
+	return c.next.Delete(df, ckey, atomic)
+}
+
+func (c *TieredCache) PartialSize(cr *CacheRequest) int64 {
+	return c.next.PartialSize(cr)
+}
+
+func (c *TieredCache) Filling(ckey CacheKey) bool {
+	return c.next.Filling(ckey)
+}
+
+func (c *TieredCache) Restore() error {
+	return c.next.Restore()
+}
+
+func (c *TieredCache) GetDataPath() string {
+	return c.next.GetDataPath()
+}
+
+func (c *TieredCache) GetLeastUsedFile() (DataFile, error) {
+	return c.next.GetLeastUsedFile()
+}
+
+func (c *TieredCache) List() ([]FileInfo, error) {
+	return c.next.List()
+}
+
+func (c *TieredCache) Stat(df DataFile) (*FileInfo, error) {
+	return c.next.Stat(df)
+}
+
+func (c *TieredCache) Open(df DataFile) (io.ReadCloser, error) {
+	return c.next.Open(df)
+}
+
+func (c *TieredCache) Usage() (int64, error) {
+	return c.next.Usage()
+}
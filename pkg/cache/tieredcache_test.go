@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTieredCache(t *testing.T, lowerPath string, maxSize int64) (*TieredCache, Index, string) {
+	dataPath := t.TempDir()
+	myindex := NewMemoryIndex()
+	return NewTieredCache(NewCache(myindex, dataPath, eviction.NewLRU()), lowerPath, maxSize, time.Hour), myindex, dataPath
+}
+
+func TestTieredDemotePromote(t *testing.T) {
+	lowerPath := t.TempDir()
+	replica1, index1, dataPath1 := newTestTieredCache(t, lowerPath, 0)
+	replica2, _, dataPath2 := newTestTieredCache(t, lowerPath, 0)
+
+	cr1 := newTestCacheRequest(dataPath1, "helloworld")
+	createTestFile(t, replica1, index1, cr1, "helloworld")
+
+	err := replica1.Demote(cr1.DataFile)
+	assert.Nil(t, err)
+
+	// the file is found by other replicas
+	cr2 := newTestCacheRequest(dataPath2, "helloworld")
+	reader, meta, err := replica2.OpenLower(cr2)
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "helloworld", string(content))
+	assert.Equal(t, cr2.CacheKey, meta.CacheKey)
+
+	replica2.RemoveLower(cr2.DataFile)
+	_, _, err = replica1.OpenLower(cr1)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestTieredCleanLower(t *testing.T) {
+	lowerPath := t.TempDir()
+	mycache, myindex, dataPath := newTestTieredCache(t, lowerPath, 15)
+
+	oldest := newTestCacheRequest(dataPath, "helloworld")
+	newest := newTestCacheRequest(dataPath, "0123456789")
+	unused := newTestCacheRequest(dataPath, "abcdefghij")
+	createTestFile(t, mycache, myindex, oldest, "helloworld")
+	createTestFile(t, mycache, myindex, newest, "0123456789")
+	createTestFile(t, mycache, myindex, unused, "abcdefghij")
+
+	mycache.Demote(unused.DataFile)
+	lowerUnused, _ := mycache.lowerFile(unused.DataFile)
+	os.Chtimes(lowerUnused, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	mycache.Demote(oldest.DataFile)
+	lowerOldest, _ := mycache.lowerFile(oldest.DataFile)
+	os.Chtimes(lowerOldest, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+
+	mycache.Demote(newest.DataFile)
+
+	size, err := mycache.CleanLower()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	_, _, unusedErr := mycache.OpenLower(unused)
+	_, _, oldestErr := mycache.OpenLower(oldest)
+	_, _, newestErr := mycache.OpenLower(newest)
+	assert.NotNil(t, unusedErr)
+	assert.NotNil(t, oldestErr)
+	assert.Nil(t, newestErr)
+}
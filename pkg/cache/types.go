@@ -1,19 +1,38 @@
 package cache
 
 import (
+	"bytes"
 	"container/list"
 	"io"
-	"io/fs"
 	"net/http"
+	"os"
 	"regexp"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/minio/minio-go/v7"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	REGEX_LAYER    = regexp.MustCompile("^/.*/blobs/sha256:(.+)$")
 	REGEX_MANIFEST = regexp.MustCompile("^/.*/manifests/sha256:(.+)$")
+	// digests are used as file names
+	REGEX_DIGEST_HEX = regexp.MustCompile("^[a-f0-9]{64}$")
+	REGEX_REPOSITORY = regexp.MustCompile("^/v2/(.+)/(?:blobs|manifests)/[^/]+$")
+	REGEX_TAG        = regexp.MustCompile(`^/v2/.+/manifests/(\w[\w.-]{0,127})$`)
+
+	// media types of the Accept header selecting the representation of a tag
+	manifestMediaTypes = map[string]bool{
+		MEDIA_TYPE_DOCKER_MANIFEST:      true,
+		MEDIA_TYPE_DOCKER_MANIFEST_LIST: true,
+		MEDIA_TYPE_OCI_MANIFEST:         true,
+		MEDIA_TYPE_OCI_INDEX:            true,
+	}
 )
 
 const (
@@ -29,11 +48,47 @@ const (
 	SUFFIX_MANIFEST_FILE = ".manifest"
 	SUFFIX_PARTIAL_FILE  = ".partial"
 
+	DIGEST_PREFIX = "sha256:"
+
+	// authorization results kept in memory, the expired ones are dropped when it's full
+	AUTH_CACHE_MAX_ENTRIES = 100000
+	// tags kept in memory, the ones to revalidate are dropped when it's full
+	TAG_CACHE_MAX_ENTRIES = 100000
+
+	// root of the sharded layout in the data path
+	SHARDS_DIR = "sha256"
+
+	// file of the persistent index, stored in the data path
+	INDEX_DB_FILE = "index.db"
+
 	STATUS_NOT_FOUND   = -1
 	STATUS_AVAILABLE   = 2
 	STATUS_IN_PROGRESS = 1
 
 	NO_WORKER = -1
+	// worker of another replica sharing the index
+	REMOTE_WORKER = -2
+
+	DEFAULT_REDIS_TIMEOUT = 5 * time.Second
+	// claims of the workers on the shared index expire if they're not renewed, e.g.: the replica died
+	DEFAULT_REDIS_WORKER_LEASE = 30 * time.Second
+	// timeout of S3 requests, except uploads and downloads of blobs
+	DEFAULT_S3_TIMEOUT = 30 * time.Second
+	// cache keys read at a time from the least used, when looking for a file to evict
+	LEAST_USED_BATCH = 100
+
+	WRITE_ERROR_UPSTREAM_READ   = "UpstreamReadError"
+	WRITE_ERROR_DISK_WRITE      = "DiskWriteError"
+	WRITE_ERROR_FSYNC           = "FsyncError"
+	WRITE_ERROR_RENAME          = "RenameError"
+	WRITE_ERROR_SIZE_MISMATCH   = "SizeMismatch"
+	WRITE_ERROR_DIGEST_MISMATCH = "DigestMismatch"
+	WRITE_ERROR_UPLOAD          = "UploadError"
+
+	MEDIA_TYPE_DOCKER_MANIFEST      = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIA_TYPE_DOCKER_MANIFEST_LIST = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIA_TYPE_OCI_MANIFEST         = "application/vnd.oci.image.manifest.v1+json"
+	MEDIA_TYPE_OCI_INDEX            = "application/vnd.oci.image.index.v1+json"
 )
 
 // Interfaces
@@ -62,14 +117,46 @@ type Index interface {
 	Print()
 }
 
+// Index keeping the cache keys sorted by access time, the least used are found without reading every entry
+type ATimeIndex interface {
+	// Cache keys from the least used one, count keys after the first offset ones
+	ListLeastUsed(offset, count int) ([]CacheKey, error)
+}
+
 type Cache interface {
-	Create(cr *CacheRequest, meta *ResponseFile, content io.ReadCloser) error
+	Create(cr *CacheRequest, meta *ResponseFile, content io.ReadCloser, offset int64) error
+	PartialSize(cr *CacheRequest) int64
 	Restore() error
 	Read(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error)
 	Delete(filepath DataFile, ckey CacheKey, atomic bool) error
 	GetDataPath() string
 	GetLeastUsedFile() (DataFile, error)
-	List() ([]fs.DirEntry, error)
+	List() ([]FileInfo, error)
+	Stat(df DataFile) (*FileInfo, error)
+	Open(df DataFile) (io.ReadCloser, error)
+	// Bytes of the cached files
+	Usage() (int64, error)
+	// The file of the cache key is being written
+	Filling(ckey CacheKey) bool
+}
+
+// Caches with a lower tier, e.g.: a filesystem shared by all the replicas
+type Tiered interface {
+	// Open a file of the lower tier to promote it, fs.ErrNotExist if it isn't there
+	OpenLower(cr *CacheRequest) (io.ReadCloser, *ResponseFile, error)
+	// Copy a file to the lower tier before it's evicted
+	Demote(df DataFile) error
+	// Remove a file from the lower tier, e.g.: when it's corrupted
+	RemoveLower(df DataFile) error
+	// Remove files of the lower tier unused for longer than maxUnused or above maxSize,
+	// returns the size of the lower tier
+	CleanLower() (int64, error)
+}
+
+// Caches that can send clients directly to the storage backend
+type Redirector interface {
+	// returns an empty URL when the content must be streamed by the proxy
+	RedirectURL(cr *CacheRequest) (string, error)
 }
 
 // Types
@@ -80,12 +167,121 @@ type AuthKey string
 
 type DataFile string
 
+// File stored by a Cache, Path is a DataFile or one of its meta and partial files
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
 type LocalCache struct {
-	dataPath    string
-	index       Index
-	LRUQueue    *list.List
-	LRUElements map[CacheKey]*list.Element
-	log         *logrus.Entry
+	dataPath  string
+	index     Index
+	policy    eviction.Policy
+	fills     map[CacheKey]*Fill
+	fillsLock sync.RWMutex
+	// size of the cached files, updated when they're created and deleted
+	sizes     map[CacheKey]int64
+	usage     int64
+	sizesLock sync.Mutex
+	log       *logrus.Entry
+}
+
+// S3Cache stores the files in a S3-compatible bucket,
+// downloads are verified in a local spool directory before being uploaded
+type S3Cache struct {
+	client        *minio.Client
+	bucket        string
+	prefix        string
+	presignExpiry time.Duration
+	timeout       time.Duration
+	spool         *LocalCache
+	index         Index
+	// pinned files, never evicted
+	pins *eviction.Pinned
+	log  *logrus.Entry
+}
+
+// MemoryCache is the L0 tier, it keeps small files in memory in front of another Cache
+type MemoryCache struct {
+	next          Cache
+	index         Index
+	maxSize       int64
+	maxObjectSize int64
+	size          int64
+	entries       map[CacheKey]*list.Element
+	lru           *list.List
+	lock          sync.Mutex
+	hits          atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	rejected      atomic.Int64
+	log           *logrus.Entry
+}
+
+type memoryEntry struct {
+	ckey CacheKey
+	data []byte
+	meta *ResponseFile
+}
+
+// TieredCache adds a lower tier (L2) to another Cache,
+// files are promoted from it on a miss and demoted to it when they're evicted
+type TieredCache struct {
+	next      Cache
+	lowerPath string
+	maxSize   int64
+	maxUnused time.Duration
+	log       *logrus.Entry
+}
+
+// memoryReader serves a file of the MemoryCache, seekable for range requests
+type memoryReader struct {
+	*bytes.Reader
+}
+
+type MemoryCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Rejected  int64
+	Size      int64
+	Entries   int64
+}
+
+// Fill tracks a cache file while it's being written
+// so that readers can stream it before the download is completed
+type Fill struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	path    string
+	size    int64
+	written int64
+	done    bool
+	err     error
+}
+
+// FillReader reads a file that is still being filled,
+// blocking when it catches up with the writer
+type FillReader struct {
+	fill   *Fill
+	file   *os.File
+	offset int64
+}
+
+// fillWriter writes into the file being filled and notifies the readers
+type fillWriter struct {
+	dst     io.Writer
+	fill    *Fill
+	written int64
+	err     error
+}
+
+// WriteError is returned by Create when the content can't be stored,
+// Reason can be used as metrics label
+type WriteError struct {
+	Reason string
+	Err    error
 }
 
 type MemoryIndex struct {
@@ -97,6 +293,34 @@ type MemoryIndex struct {
 	datarefLock sync.RWMutex
 }
 
+type RedisIndex struct {
+	client  redis.UniversalClient
+	prefix  string
+	replica string
+	timeout time.Duration
+	lease   time.Duration
+	// workers of this replica allocated to cache keys, their leases are renewed until released
+	leases     map[CacheKey]string
+	leasesLock sync.Mutex
+	stop       chan struct{}
+	log        *logrus.Entry
+}
+
+type BoltIndex struct {
+	db  *bolt.DB
+	log *logrus.Entry
+}
+
+// cache key metadata stored in the bolt index
+type indexRecord struct {
+	Status       int           `json:"status"`
+	WorkerID     int           `json:"workerID"`
+	Atime        int64         `json:"atime"`
+	Ctime        int64         `json:"ctime"`
+	DataFile     DataFile      `json:"dataFile"`
+	ResponseFile *ResponseFile `json:"responseFile"`
+}
+
 type CacheKeyMetadata struct {
 	Status   int
 	WorkerID int
@@ -117,6 +341,10 @@ type CacheRequest struct {
 	Request          *http.Request
 	Response         chan *CacheResponse
 	ItemType         string
+	Host             string // upstream host
+	Repository       string
+	Tag              string // manifest requested by tag
+	NoStore          bool   // files missing from the cache aren't stored
 }
 
 type CacheResponse struct {
@@ -132,4 +360,72 @@ type ResponseFile struct {
 	ContentLength int                 `json:"contentLength"`
 	Uncompressed  bool                `json:"uncompressed"`
 	CacheKey      CacheKey            `json:"cacheKey"`
+	Host          string              `json:"host,omitempty"`
+	Repository    string              `json:"repository,omitempty"`
+}
+
+// References of image manifests and image indexes
+type Manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *Descriptor  `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform of the manifests of an image index
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Tags resolved to the digest of their manifest, the manifests are stored in the cache by digest.
+// Entries are revalidated with the upstream after the ttl
+type TagCache struct {
+	ttl     time.Duration
+	entries map[TagKey]TagEntry
+	lock    sync.RWMutex
+}
+
+// Tags are cached per media types accepted by the client,
+// e.g.: docker and OCI clients get different representations
+type TagKey struct {
+	Host       string
+	Repository string
+	Tag        string
+	Accept     string
+}
+
+type TagEntry struct {
+	Digest    string
+	ETag      string
+	Validated time.Time
+}
+
+// Results of the permission checks of the upstream registries,
+// positive and negative results are kept for different ttls
+type AuthCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[AuthCacheKey]authDecision
+	lock        sync.RWMutex
+}
+
+// Permissions are checked per credential and repository
+type AuthCacheKey struct {
+	AuthKey    AuthKey
+	Host       string
+	Repository string
+}
+
+type authDecision struct {
+	allowed bool
+	expires time.Time
 }
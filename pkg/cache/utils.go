@@ -1,28 +1,114 @@
 package cache
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// Hash of the credential of a request, so that it's never kept in memory
 func ComputeAuthKey(authorization string) AuthKey {
 	if authorization == "" {
 		return DEFAULT_AUTH_KEY
 	}
 
-	return AuthKey(fmt.Sprintf("[%s]", authorization))
+	return AuthKey(fmt.Sprintf("%x", sha256.Sum256([]byte(authorization))))
+}
+
+// Repository of a registry API path, e.g.: library/alpine for /v2/library/alpine/blobs/<digest>
+func ComputeRepository(path string) string {
+	groups := REGEX_REPOSITORY.FindStringSubmatch(path)
+	if groups == nil {
+		return ""
+	}
+	return groups[1]
+}
+
+// Item type of a registry API path (layer or manifest, by digest or tag), empty for the other paths
+func ComputeItemType(path string) string {
+	switch {
+	case REGEX_LAYER.MatchString(path):
+		return "layer"
+	case REGEX_MANIFEST.MatchString(path) || REGEX_TAG.MatchString(path):
+		return "manifest"
+	}
+	return ""
+}
+
+// Media types accepted by a client, sorted so that the order doesn't matter
+func ComputeAcceptKey(header http.Header) string {
+	seen := make(map[string]bool)
+	types := make([]string, 0)
+	for _, value := range header.Values("Accept") {
+		for _, t := range strings.Split(value, ",") {
+			// only the manifest media types select a representation, parameters (e.g.: q=0.5) are ignored
+			t, _, _ = strings.Cut(t, ";")
+			t = strings.ToLower(strings.TrimSpace(t))
+			if manifestMediaTypes[t] && !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+// Cache key of a sha256 digest (sha256:<hex>)
+func ComputeDigestKey(digest string) (CacheKey, bool) {
+	hex := strings.TrimPrefix(digest, DIGEST_PREFIX)
+	if hex == digest || !REGEX_DIGEST_HEX.MatchString(hex) {
+		return "", false
+	}
+	return CacheKey(hex), true
+}
+
+// Platform in the os/architecture[/variant] format
+func ParsePlatform(platform string) (*Platform, error) {
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %s, expected os/architecture[/variant]", platform)
+	}
+
+	p := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// Check if a manifest of an image index is built for the platform, the variant is optional
+func (p *Platform) Match(d Descriptor) bool {
+	if d.Platform == nil {
+		return false
+	}
+	return d.Platform.OS == p.OS &&
+		d.Platform.Architecture == p.Architecture &&
+		(p.Variant == "" || d.Platform.Variant == p.Variant)
 }
 
 func ComputeResponseFilePath(filePath string) string {
 	return fmt.Sprintf("%s%s", filePath, SUFFIX_META_FILE)
 }
 
-// Computes the SHA256 of the requestKey and joins that to the configured DataPath
+// Directory of the files of a digest, nested by the first two bytes
+// to keep the number of entries per directory small, e.g.: <datapath>/sha256/ab/cd
+func ComputeShardDir(datapath, name string) string {
+	return filepath.Join(datapath, SHARDS_DIR, name[0:2], name[2:4])
+}
+
+// Joins the digest of the requestKey to its shard directory in the configured DataPath
 func ComputeDataFile(datapath, name string, suffix string) (DataFile, error) {
-	if name == "" {
+	if !REGEX_DIGEST_HEX.MatchString(name) {
 		return "", fmt.Errorf("invalid file name")
 	}
-	return DataFile(filepath.Join(datapath, fmt.Sprintf("%s%s", name, suffix))), nil
+	return DataFile(filepath.Join(ComputeShardDir(datapath, name), fmt.Sprintf("%s%s", name, suffix))), nil
 }
 
 func ComputeLayerFile(datapath, name string) (DataFile, error) {
@@ -32,3 +118,54 @@ func ComputeLayerFile(datapath, name string) (DataFile, error) {
 func ComputeManifestFile(datapath, name string) (DataFile, error) {
 	return ComputeDataFile(datapath, name, SUFFIX_MANIFEST_FILE)
 }
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Flush directory entries (e.g.: after a rename) on disk
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Copy file through a temporary file, so that readers never see a partial copy
+func copyFile(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*"+SUFFIX_PARTIAL_FILE)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
@@ -0,0 +1,128 @@
+package eviction
+
+import "container/list"
+
+// The size of the cache is managed by the garbage collector, so the ARC capacity
+// is the number of tracked entries and the ghost lists are bounded by it
+func NewARC() *ARC {
+	return &ARC{
+		recent:        list.New(),
+		frequent:      list.New(),
+		recentGhost:   list.New(),
+		frequentGhost: list.New(),
+		elements:      make(map[string]*arcElement),
+	}
+}
+
+func (p *ARC) capacity() int {
+	return p.recent.Len() + p.frequent.Len()
+}
+
+// Move an entry to the front of the given list, must be called with the lock held
+func (p *ARC) moveTo(key string, l *list.List) {
+	if e, ok := p.elements[key]; ok {
+		e.list.Remove(e.el)
+	}
+	p.elements[key] = &arcElement{el: l.PushFront(key), list: l}
+}
+
+// Drop the oldest ghosts above the capacity, must be called with the lock held
+func (p *ARC) trimGhosts() {
+	for p.recentGhost.Len()+p.frequentGhost.Len() > p.capacity() {
+		l := p.recentGhost
+		if l.Len() == 0 || (p.frequentGhost.Len() > 0 && p.recent.Len() <= p.target) {
+			l = p.frequentGhost
+		}
+		el := l.Back()
+		l.Remove(el)
+		delete(p.elements, el.Value.(string))
+	}
+}
+
+func (p *ARC) Add(key string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.elements[key]
+	switch {
+	case !ok:
+		p.moveTo(key, p.recent)
+	case e.list == p.recent || e.list == p.frequent:
+		p.moveTo(key, p.frequent)
+	case e.list == p.recentGhost:
+		// evicted too early because it was recent, give more room to recent entries
+		delta := 1
+		if p.recentGhost.Len() < p.frequentGhost.Len() {
+			delta = p.frequentGhost.Len() / p.recentGhost.Len()
+		}
+		p.target += delta
+		if p.target > p.capacity()+1 {
+			p.target = p.capacity() + 1
+		}
+		p.moveTo(key, p.frequent)
+	case e.list == p.frequentGhost:
+		// evicted too early because it was frequent, give more room to frequent entries
+		delta := 1
+		if p.frequentGhost.Len() < p.recentGhost.Len() {
+			delta = p.recentGhost.Len() / p.frequentGhost.Len()
+		}
+		p.target -= delta
+		if p.target < 0 {
+			p.target = 0
+		}
+		p.moveTo(key, p.frequent)
+	}
+	p.trimGhosts()
+}
+
+func (p *ARC) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.elements[key]; ok && (e.list == p.recent || e.list == p.frequent) {
+		p.moveTo(key, p.frequent)
+	}
+}
+
+func (p *ARC) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.elements[key]
+	if !ok {
+		return
+	}
+
+	switch e.list {
+	case p.recent:
+		p.moveTo(key, p.recentGhost)
+	case p.frequent:
+		p.moveTo(key, p.frequentGhost)
+	default:
+		e.list.Remove(e.el)
+		delete(p.elements, key)
+	}
+	p.trimGhosts()
+}
+
+func (p *ARC) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.frequent
+	if p.recent.Len() > 0 && (p.recent.Len() > p.target || p.frequent.Len() == 0) {
+		l = p.recent
+	}
+	el := l.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(string), true
+}
+
+func (p *ARC) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.capacity()
+}
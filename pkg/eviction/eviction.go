@@ -0,0 +1,18 @@
+package eviction
+
+import "fmt"
+
+// Create the policy with the given name, LRU if it's empty
+func New(name string) (Policy, error) {
+	switch name {
+	case "", POLICY_LRU:
+		return NewLRU(), nil
+	case POLICY_LFU:
+		return NewLFU(), nil
+	case POLICY_ARC:
+		return NewARC(), nil
+	case POLICY_GDSF:
+		return NewGDSF(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %s", name)
+}
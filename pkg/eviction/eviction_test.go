@@ -0,0 +1,147 @@
+package eviction
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func victim(t *testing.T, p Policy) string {
+	key, ok := p.Victim()
+	assert.True(t, ok)
+	return key
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"", POLICY_LRU, POLICY_LFU, POLICY_ARC, POLICY_GDSF} {
+		p, err := New(name)
+		assert.Nil(t, err)
+		_, ok := p.Victim()
+		assert.False(t, ok)
+	}
+
+	_, err := New("fifo")
+	assert.NotNil(t, err)
+}
+
+func TestLRU(t *testing.T) {
+	p := NewLRU()
+	p.Add("a", 1)
+	p.Add("b", 1)
+	p.Add("c", 1)
+	assert.Equal(t, "a", victim(t, p))
+
+	p.Touch("a")
+	assert.Equal(t, "b", victim(t, p))
+
+	p.Remove("b")
+	assert.Equal(t, "c", victim(t, p))
+	assert.Equal(t, 2, p.Len())
+}
+
+func TestLFU(t *testing.T) {
+	p := NewLFU()
+	p.Add("a", 1)
+	p.Add("b", 1)
+	p.Add("c", 1)
+	p.Touch("a")
+	p.Touch("a")
+	p.Touch("b")
+
+	// least recently used among the least frequently used
+	assert.Equal(t, "c", victim(t, p))
+	p.Remove("c")
+	assert.Equal(t, "b", victim(t, p))
+
+	p.Touch("b")
+	p.Touch("b")
+	assert.Equal(t, "a", victim(t, p))
+}
+
+func TestARC(t *testing.T) {
+	p := NewARC()
+	p.Add("a", 1)
+	p.Add("b", 1)
+	p.Add("c", 1)
+
+	// entries used more than once are protected from a scan of new entries
+	p.Touch("a")
+	p.Add("d", 1)
+	assert.Equal(t, "b", victim(t, p))
+	p.Remove("b")
+	assert.Equal(t, "c", victim(t, p))
+	p.Remove("c")
+	assert.Equal(t, "d", victim(t, p))
+
+	// an evicted entry added again is frequent and grows the room for recent entries
+	p.Add("b", 1)
+	assert.Equal(t, 1, p.target)
+	assert.Equal(t, 3, p.Len())
+}
+
+func TestGDSF(t *testing.T) {
+	p := NewGDSF()
+	p.Add("small", 10)
+	p.Add("large", 1000)
+	p.Add("medium", 20)
+	p.Touch("small")
+
+	// larger files are evicted first
+	assert.Equal(t, "large", victim(t, p))
+	p.Remove("large")
+	assert.Equal(t, "medium", victim(t, p))
+	p.Remove("medium")
+
+	// new files inherit the priority of the evicted ones, so unused files age
+	p.Add("new", 6)
+	assert.Equal(t, "small", victim(t, p))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	for _, name := range []string{POLICY_LRU, POLICY_LFU, POLICY_ARC, POLICY_GDSF} {
+		p, _ := New(name)
+
+		wg := sync.WaitGroup{}
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := fmt.Sprintf("%d-%d", w, i%20)
+					p.Add(key, int64(i+1))
+					p.Touch(key)
+					if v, ok := p.Victim(); ok && i%3 == 0 {
+						p.Remove(v)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for p.Len() > 0 {
+			p.Remove(victim(t, p))
+		}
+		_, ok := p.Victim()
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	p := NewPinned(NewLRU())
+	p.Pin("b")
+	p.Add("a", 1)
+	p.Add("b", 1)
+	p.Add("c", 1)
+
+	assert.Equal(t, "a", victim(t, p))
+	p.Pin("a")
+	assert.Equal(t, "c", victim(t, p))
+	assert.Equal(t, 3, p.Len())
+
+	// unpinned entries can be evicted again
+	p.Remove("c")
+	p.Unpin("b")
+	assert.Equal(t, "b", victim(t, p))
+}
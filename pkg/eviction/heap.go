@@ -0,0 +1,133 @@
+package eviction
+
+import "container/heap"
+
+// LFU evicts the least frequently used entry, the least recently used one among equals
+func NewLFU() Policy {
+	return &heapPolicy{
+		entries: make(map[string]*heapEntry),
+	}
+}
+
+// GDSF (Greedy-Dual-Size-Frequency) evicts large and rarely used entries first,
+// so that more files fit in the cache. Priorities are inflated on every eviction
+// to age the entries that aren't used anymore
+func NewGDSF() Policy {
+	return &heapPolicy{
+		entries:   make(map[string]*heapEntry),
+		sizeAware: true,
+	}
+}
+
+func (p *heapPolicy) priority(e *heapEntry) float64 {
+	if !p.sizeAware {
+		return float64(e.freq)
+	}
+	size := e.size
+	if size < 1 {
+		size = 1
+	}
+	return p.inflation + float64(e.freq)/float64(size)
+}
+
+// Increase the frequency of an entry and update its position, must be called with the lock held
+func (p *heapPolicy) access(e *heapEntry) {
+	p.clock++
+	e.freq++
+	e.access = p.clock
+	e.priority = p.priority(e)
+}
+
+func (p *heapPolicy) Add(key string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[key]; ok {
+		e.size = size
+		p.access(e)
+		heap.Fix(&p.queue, e.index)
+		return
+	}
+
+	e := &heapEntry{key: key, size: size}
+	p.access(e)
+	p.entries[key] = e
+	heap.Push(&p.queue, e)
+}
+
+func (p *heapPolicy) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[key]; ok {
+		p.access(e)
+		heap.Fix(&p.queue, e.index)
+	}
+}
+
+func (p *heapPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	// the victim is being evicted
+	if p.sizeAware && e.index == 0 {
+		p.inflation = e.priority
+	}
+	heap.Remove(&p.queue, e.index)
+	delete(p.entries, key)
+}
+
+func (p *heapPolicy) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		return "", false
+	}
+	return p.queue[0].key, true
+}
+
+func (p *heapPolicy) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.entries)
+}
+
+// heap.Interface, lowest priority first
+
+func (q entryQueue) Len() int {
+	return len(q)
+}
+
+func (q entryQueue) Less(i, j int) bool {
+	if q[i].priority == q[j].priority {
+		return q[i].access < q[j].access
+	}
+	return q[i].priority < q[j].priority
+}
+
+func (q entryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *entryQueue) Push(x any) {
+	e := x.(*heapEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *entryQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,58 @@
+package eviction
+
+import "container/list"
+
+func NewLRU() *LRU {
+	return &LRU{
+		queue:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (p *LRU) Add(key string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.elements[key]; ok {
+		p.queue.MoveToFront(el)
+		return
+	}
+	p.elements[key] = p.queue.PushFront(key)
+}
+
+func (p *LRU) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.elements[key]; ok {
+		p.queue.MoveToFront(el)
+	}
+}
+
+func (p *LRU) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.elements[key]; ok {
+		p.queue.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+func (p *LRU) Victim() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el := p.queue.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(string), true
+}
+
+func (p *LRU) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.elements)
+}
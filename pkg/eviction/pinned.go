@@ -0,0 +1,84 @@
+package eviction
+
+func NewPinned(next Policy) *Pinned {
+	return &Pinned{
+		next:   next,
+		pinned: make(map[string]bool),
+		sizes:  make(map[string]int64),
+	}
+}
+
+// Stop returning the entry as victim, it can be pinned before it's added
+func (p *Pinned) Pin(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pinned[key] {
+		return
+	}
+	p.pinned[key] = true
+	if _, ok := p.sizes[key]; ok {
+		p.next.Remove(key)
+	}
+}
+
+func (p *Pinned) Unpin(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.pinned[key] {
+		return
+	}
+	delete(p.pinned, key)
+	if size, ok := p.sizes[key]; ok {
+		p.next.Add(key, size)
+	}
+}
+
+// Policies not tracking the entries themselves (e.g.: the s3 storage) skip the pinned ones
+func (p *Pinned) IsPinned(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pinned[key]
+}
+
+func (p *Pinned) Add(key string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sizes[key] = size
+	if !p.pinned[key] {
+		p.next.Add(key, size)
+	}
+}
+
+func (p *Pinned) Touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.pinned[key] {
+		p.next.Touch(key)
+	}
+}
+
+func (p *Pinned) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.sizes, key)
+	if !p.pinned[key] {
+		p.next.Remove(key)
+	}
+}
+
+func (p *Pinned) Victim() (string, bool) {
+	return p.next.Victim()
+}
+
+func (p *Pinned) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.sizes)
+}
@@ -0,0 +1,92 @@
+package eviction
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	POLICY_LRU  = "lru"
+	POLICY_LFU  = "lfu"
+	POLICY_ARC  = "arc"
+	POLICY_GDSF = "gdsf"
+
+	DEFAULT_POLICY = POLICY_LRU
+)
+
+// Interfaces
+
+// Policy chooses the next file to evict, all the implementations are safe for concurrent use
+type Policy interface {
+	// Track a new entry, an existing entry is accessed
+	Add(key string, size int64)
+	// Record an access, unknown keys are ignored
+	Touch(key string)
+	// Stop tracking an entry, e.g.: when it's evicted or deleted
+	Remove(key string)
+	// Entry that should be evicted next, false if there isn't any.
+	// The entry is tracked until it's removed
+	Victim() (string, bool)
+	Len() int
+}
+
+// Types
+
+// LRU evicts the least recently used entry
+type LRU struct {
+	mu       sync.Mutex
+	queue    *list.List
+	elements map[string]*list.Element
+}
+
+// ARC balances recency and frequency, adapting to the workload with the history of evicted entries
+type ARC struct {
+	mu sync.Mutex
+	// target size of the recent list
+	target int
+	// recent and frequent entries, the front is the most recently used
+	recent   *list.List
+	frequent *list.List
+	// ghost lists, keys evicted from recent and frequent
+	recentGhost   *list.List
+	frequentGhost *list.List
+	elements      map[string]*arcElement
+}
+
+type arcElement struct {
+	el   *list.Element
+	list *list.List
+}
+
+// heapPolicy evicts the entry with the lowest priority,
+// used by LFU (frequency) and GDSF (frequency / size, with aging)
+type heapPolicy struct {
+	mu      sync.Mutex
+	entries map[string]*heapEntry
+	queue   entryQueue
+	// incremented on every access, breaks ties with the least recently used
+	clock     uint64
+	sizeAware bool
+	// priority of the last evicted entry, added to new priorities so that old entries age
+	inflation float64
+}
+
+type heapEntry struct {
+	key      string
+	size     int64
+	freq     int64
+	priority float64
+	access   uint64
+	index    int
+}
+
+type entryQueue []*heapEntry
+
+// Pinned wraps a policy, pinned entries are never returned as victims
+type Pinned struct {
+	next   Policy
+	mu     sync.Mutex
+	pinned map[string]bool
+	// all the tracked entries, so that unpinned entries are added back with their size
+	sizes map[string]int64
+}
@@ -1,81 +1,187 @@
 package gc
 
 import (
-	"io/fs"
-	"os"
-	"path/filepath"
 	"time"
 
+	"github.com/ish-xyz/registry-cache/pkg/cache"
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
 )
 
-// should watch disk usage
-// use LRU queue to remove files
+// Free inodes in percentage, 100 if the filesystem doesn't report them (e.g.: btrfs)
+func (st *fsStats) freeInodesPercent() float64 {
+	if st.inodes == 0 {
+		return 100
+	}
+	return float64(st.freeInodes) / float64(st.inodes) * 100
+}
 
-func getFiles(path string) ([]fs.FileInfo, error) {
-	var files []fs.FileInfo
+// Reason to start an eviction batch, empty if no high watermark is exceeded
+func (gc *GarbageCollector) checkHighWatermarks() string {
 
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	disk := gc.current().disk
 
-		if !info.IsDir() {
-			files = append(files, info)
+	usage, err := gc.cache.Usage()
+	if err != nil {
+		gc.log.Errorln("failed to calculate cache size:", err)
+	} else {
+		metrics.CacheSize.Set(float64(usage))
+		if disk.MaxSize > 0 && usage > disk.MaxSize {
+			return EVICTION_REASON_SIZE
 		}
-		return err
-	})
+	}
 
-	return files, err
-}
+	// the owners above their quota are evicted first anyway
+	if over := gc.quotas.OverQuota(); len(over) > 0 {
+		gc.log.Debugln("quotas exceeded:", over)
+		return EVICTION_REASON_QUOTA
+	}
 
-func getDirSize(path string) (int64, error) {
+	if disk.Path == "" {
+		return ""
+	}
 
-	var dirSize int64
+	st, err := statfs(disk.Path)
+	if err != nil {
+		gc.log.Errorln("failed to check free space:", err)
+		return ""
+	}
+	metrics.DiskFreeBytes.Set(float64(st.freeBytes))
+	metrics.DiskFreeInodes.Set(st.freeInodesPercent())
 
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	if disk.MinFree > 0 && st.freeBytes < disk.MinFree {
+		return EVICTION_REASON_FREE_SPACE
+	}
+	if disk.MinFreeInodes > 0 && st.freeInodesPercent() < disk.MinFreeInodes {
+		return EVICTION_REASON_FREE_INODES
+	}
+	return ""
+}
 
-		if !info.IsDir() {
-			dirSize += info.Size()
-		}
-		return err
-	})
+// Check if the low watermark of the reason is reached, freed is what the batch evicted so far
+func (gc *GarbageCollector) lowWatermarkReached(reason string, usage, freed int64) (bool, error) {
+
+	disk := gc.current().disk
 
-	return dirSize, err
+	if reason == EVICTION_REASON_SIZE {
+		return usage-freed <= disk.TargetSize, nil
+	}
+	if reason == EVICTION_REASON_QUOTA {
+		return len(gc.quotas.OverQuota()) == 0, nil
+	}
+
+	st, err := statfs(disk.Path)
+	if err != nil {
+		return false, err
+	}
+	if reason == EVICTION_REASON_FREE_SPACE {
+		return st.freeBytes >= disk.TargetFree, nil
+	}
+	return st.freeInodesPercent() >= disk.TargetFreeInodes, nil
 }
 
-func (gc *GarbageCollector) reduceDiskUsage() {
+// Evict the files chosen by the eviction policy until the low watermark of the reason is reached
+func (gc *GarbageCollector) evict(reason string) *EvictionReport {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	report := &EvictionReport{Reason: reason}
+	start := time.Now()
+
+	// the usage is computed once, it can be expensive (e.g.: listing a bucket)
+	usage, err := gc.cache.Usage()
+	if err != nil {
+		gc.log.Errorln("failed to calculate cache size:", err)
+		return report
+	}
 
-	datapath := gc.cache.GetDataPath()
+	var last cache.DataFile
 	for {
-		size, err := getDirSize(datapath)
+		done, err := gc.lowWatermarkReached(reason, usage, report.Bytes)
 		if err != nil {
-			gc.log.Errorln("failed to calculate dir size:", err)
+			gc.log.Errorln("failed to check low watermark:", err)
+			break
+		}
+		if done {
+			break
 		}
 
-		metrics.CacheSize.Set(float64(size))
+		luf, err := gc.cache.GetLeastUsedFile()
+		if err != nil {
+			gc.log.Errorln("failed to fetch least used file:", err)
+			break
+		}
+		// pinned files are skipped by the policies and the s3 storage, never evict one
+		if gc.pins.IsPinned(gc.index.GetDataRef(luf)) {
+			gc.log.Errorf("least used file %s is pinned, stopping", luf)
+			break
+		}
+		if luf == last {
+			gc.log.Errorf("failed to evict file %s, stopping", luf)
+			break
+		}
+		last = luf
 
-		tolerance := int64(gc.disk.maxSize) / 100 * 15
-		if size < int64(gc.disk.maxSize)-tolerance {
-			gc.log.Debugln("disk space is under the limit")
-		} else {
-			luf, err := gc.cache.GetLeastUsedFile()
-			if err != nil {
-				gc.log.Errorln("failed to fetch least used file from queue")
-				continue
-			}
+		var size int64
+		if info, err := gc.cache.Stat(luf); err == nil {
+			size = info.Size
+		}
 
-			err = gc.cache.Delete(luf, "", false)
+		// keep a copy in the lower tier, if any
+		if tiered, ok := gc.cache.(cache.Tiered); ok {
+			err = tiered.Demote(luf)
 			if err != nil {
-				gc.log.Errorln("error trying to cleanup file ", luf)
+				gc.log.Warningf("failed to demote file %s: %v", luf, err)
 			} else {
-				gc.log.Infof("deleted file %s (least used)", luf)
+				metrics.TieredDemotions.Inc()
+				gc.log.Infof("demoted file %s to lower tier", luf)
 			}
-			continue
 		}
-		time.Sleep(100 * time.Second)
+
+		err = gc.cache.Delete(luf, "", false)
+		if err != nil {
+			gc.log.Errorln("error trying to cleanup file ", luf)
+			break
+		}
+		gc.log.Debugf("evicted file %s (%s)", luf, reason)
+
+		report.Files++
+		report.Bytes += size
+	}
+
+	report.Duration = time.Since(start)
+	metrics.EvictedFiles.WithLabelValues(reason).Add(float64(report.Files))
+	metrics.EvictedBytes.WithLabelValues(reason).Add(float64(report.Bytes))
+	metrics.CacheSize.Set(float64(usage - report.Bytes))
+
+	return report
+}
+
+func (gc *GarbageCollector) reduceDiskUsage() {
+
+	for {
+		if reason := gc.checkHighWatermarks(); reason != "" {
+			report := gc.evict(reason)
+			gc.log.Infof("evicted %d files (%d bytes) in %s, reason: %s",
+				report.Files, report.Bytes, report.Duration, report.Reason)
+		} else {
+			gc.log.Debugln("disk usage is under the watermarks")
+		}
+		time.Sleep(DISK_CHECK_INTERVAL)
+	}
+}
+
+// Apply the limits of the lower tier, if any
+func (gc *GarbageCollector) cleanLowerTier() {
+
+	tiered, ok := gc.cache.(cache.Tiered)
+	if !ok {
+		return
+	}
+
+	size, err := tiered.CleanLower()
+	if err != nil {
+		gc.log.Errorln("failed to clean lower tier:", err)
+		return
 	}
+	metrics.LowerTierSize.Set(float64(size))
 }
@@ -0,0 +1,70 @@
+package gc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestFile(t *testing.T, c cache.Cache, idx cache.Index, content string) *cache.CacheRequest {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	df, _ := cache.ComputeLayerFile(c.GetDataPath(), digest)
+	cr := &cache.CacheRequest{
+		CacheEnabled:     true,
+		CacheKey:         cache.CacheKey(digest),
+		DataFile:         df,
+		ResponseFilePath: cache.ComputeResponseFilePath(string(df)),
+	}
+
+	idx.Put(cr.CacheKey, cr.DataFile)
+	err := c.Create(cr, cache.NewResponseFile(len(content), 200, nil, cr.CacheKey), io.NopCloser(strings.NewReader(content)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SetStatus(cr.CacheKey, cache.STATUS_AVAILABLE)
+	return cr
+}
+
+func TestEvictToLowWatermark(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+	gc := NewGarbageCollector(c, idx, Settings{Interval: time.Minute, Disk: Watermarks{MaxSize: 25, TargetSize: 10}}, Options{})
+
+	first := createTestFile(t, c, idx, "helloworld")
+	second := createTestFile(t, c, idx, "0123456789")
+	assert.Equal(t, "", gc.checkHighWatermarks())
+
+	third := createTestFile(t, c, idx, "abcdefghij")
+	assert.Equal(t, EVICTION_REASON_SIZE, gc.checkHighWatermarks())
+
+	report := gc.evict(EVICTION_REASON_SIZE)
+	assert.Equal(t, 2, report.Files)
+	assert.Equal(t, int64(20), report.Bytes)
+
+	usage, _ := c.Usage()
+	assert.Equal(t, int64(10), usage)
+	assert.Equal(t, cache.STATUS_NOT_FOUND, idx.GetStatus(first.CacheKey))
+	assert.Equal(t, cache.STATUS_NOT_FOUND, idx.GetStatus(second.CacheKey))
+	assert.Equal(t, cache.STATUS_AVAILABLE, idx.GetStatus(third.CacheKey))
+}
+
+func TestEvictStopsWhenEmpty(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+	gc := NewGarbageCollector(c, idx, Settings{Interval: time.Minute, Disk: Watermarks{Path: c.GetDataPath(), MinFree: 1 << 62, TargetFree: 1 << 62}}, Options{})
+
+	createTestFile(t, c, idx, "helloworld")
+	assert.Equal(t, EVICTION_REASON_FREE_SPACE, gc.checkHighWatermarks())
+
+	// the free space can't be reached, evict everything and stop
+	report := gc.evict(EVICTION_REASON_FREE_SPACE)
+	assert.Equal(t, 1, report.Files)
+	assert.Equal(t, 0, idx.Len())
+}
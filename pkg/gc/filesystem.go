@@ -4,7 +4,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -20,25 +20,20 @@ func (gc *GarbageCollector) cleanUndesiredFiles() {
 	}
 
 	for _, f := range files {
-		if strings.HasSuffix(f.Name(), cache.SUFFIX_META_FILE) {
+		if strings.HasSuffix(f.Path, cache.SUFFIX_META_FILE) {
 			continue
 		}
-		if strings.HasSuffix(f.Name(), cache.SUFFIX_LAYER_FILE) {
+		if strings.HasSuffix(f.Path, cache.SUFFIX_LAYER_FILE) {
 			continue
 		}
-		if strings.HasSuffix(f.Name(), cache.SUFFIX_MANIFEST_FILE) {
+		if strings.HasSuffix(f.Path, cache.SUFFIX_MANIFEST_FILE) {
 			continue
 		}
-		if strings.HasSuffix(f.Name(), cache.SUFFIX_PARTIAL_FILE) {
+		if strings.HasSuffix(f.Path, cache.SUFFIX_PARTIAL_FILE) {
 			continue
 		}
-		df, err := cache.ComputeDataFile(gc.cache.GetDataPath(), f.Name(), "")
-		if err != nil {
-			gc.log.Errorln("can't compute filename for", f.Name())
-			continue
-		}
-		gc.log.Infoln("deleting undesired file ", df)
-		os.Remove(string(df))
+		gc.log.Infoln("deleting undesired file ", f.Path)
+		gc.cache.Delete(cache.DataFile(f.Path), "", false)
 	}
 
 }
@@ -54,78 +49,56 @@ func (gc *GarbageCollector) cleanOrphanFiles() {
 
 	for _, f := range files {
 
-		if strings.HasSuffix(f.Name(), cache.SUFFIX_META_FILE) {
-			dataFile := strings.Replace(f.Name(), cache.SUFFIX_META_FILE, "", -1)
+		if strings.HasSuffix(f.Path, cache.SUFFIX_META_FILE) {
+			dataFile := strings.TrimSuffix(f.Path, cache.SUFFIX_META_FILE)
 			if _, ok := orphans[dataFile]; ok {
 				delete(orphans, dataFile)
 				continue
 			}
-			orphans[f.Name()] = struct{}{}
+			orphans[f.Path] = struct{}{}
 
-		} else if strings.HasSuffix(f.Name(), cache.SUFFIX_PARTIAL_FILE) {
+		} else if strings.HasSuffix(f.Path, cache.SUFFIX_PARTIAL_FILE) {
 			continue
 		} else {
-			respFile := cache.ComputeResponseFilePath(f.Name())
+			respFile := cache.ComputeResponseFilePath(f.Path)
 
 			if _, ok := orphans[respFile]; ok {
 				delete(orphans, respFile)
 				continue
 			}
-			orphans[f.Name()] = struct{}{}
+			orphans[f.Path] = struct{}{}
 		}
 
 	}
 
 	for fname := range orphans {
-		f, _ := cache.ComputeDataFile(gc.cache.GetDataPath(), fname, "")
-		gc.log.Infoln("deleting orphan file ", f)
-		gc.cache.Delete(f, "", false)
+		gc.log.Infoln("deleting orphan file ", fname)
+		gc.cache.Delete(cache.DataFile(fname), "", false)
 	}
 }
 
+// Partial files are kept to resume interrupted downloads, they are removed when they haven't been written
+// for longer than partials.maxUnused, unless their download is in progress
 func (gc *GarbageCollector) checkStalePartialFiles() {
 	files, err := gc.cache.List()
 	if err != nil {
 		gc.log.Errorf("failed to list files")
 		return
 	}
-	for _, i := range files {
-		if !strings.HasSuffix(i.Name(), cache.SUFFIX_PARTIAL_FILE) {
-			// skipping checksum on metafiles
+	for _, f := range files {
+		if !strings.HasSuffix(f.Path, cache.SUFFIX_PARTIAL_FILE) {
 			continue
 		}
-		fpath := fmt.Sprintf("%s%s", gc.cache.GetDataPath(), i.Name())
 
-		gc.log.Infof("checking file: '%s'", fpath)
-		toDelete := true
+		gc.log.Infof("checking file: '%s'", f.Path)
 
-		f, err := os.Stat(fpath)
-		if err != nil {
-			gc.log.Warnf("cannot stat() file: '%s'", fpath)
+		ckey := gc.index.GetDataRef(cache.DataFile(strings.TrimSuffix(f.Path, cache.SUFFIX_PARTIAL_FILE)))
+		if ckey != "" && (gc.index.GetStatus(ckey) == cache.STATUS_IN_PROGRESS || gc.cache.Filling(ckey)) {
 			continue
 		}
-
-		prevfsize := f.Size()
-		currfsize := int64(0)
-		for counter := 0; counter < 4; counter++ {
-
-			f, err := os.Stat(fpath)
-			if err != nil {
-				gc.log.Warnf("cannot stat() file: '%s'", fpath)
-				continue
-			}
-
-			currfsize = f.Size()
-			if prevfsize < currfsize {
-				toDelete = false
-				break
-			}
-			time.Sleep(1 * time.Second)
-		}
-
-		if toDelete {
-			gc.log.Infoln("removing stale partial file", fpath)
-			os.Remove(fpath)
+		if time.Since(f.ModTime) > gc.current().partials {
+			gc.log.Infoln("removing stale partial file", f.Path)
+			gc.cache.Delete(cache.DataFile(f.Path), "", false)
 		}
 	}
 }
@@ -138,23 +111,28 @@ func (gc *GarbageCollector) cleanCorruptLayerFiles() {
 	}
 	for _, i := range files {
 
-		if !strings.HasSuffix(i.Name(), cache.SUFFIX_LAYER_FILE) {
+		if !strings.HasSuffix(i.Path, cache.SUFFIX_LAYER_FILE) {
 			// skipping checksum on metafiles
 			continue
 		}
 
-		df, _ := cache.ComputeDataFile(gc.cache.GetDataPath(), i.Name(), "")
-		f, _ := os.Open(string(df))
+		df := cache.DataFile(i.Path)
+		f, err := gc.cache.Open(df)
+		if err != nil {
+			continue
+		}
 		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
 			gc.log.Errorf("%s failed to calculate sha256 %v", df, err)
 			continue
 		}
 
-		expectedSHA256 := strings.ReplaceAll(i.Name(), cache.SUFFIX_LAYER_FILE, "")
+		expectedSHA256 := strings.TrimSuffix(path.Base(i.Path), cache.SUFFIX_LAYER_FILE)
 		actualSHA256 := fmt.Sprintf("%x", h.Sum(nil))
 		if actualSHA256 != expectedSHA256 {
-			gc.log.Infoln("deleting corrupted file:", i.Name())
+			gc.log.Infoln("deleting corrupted file:", df)
 			gc.cache.Delete(df, "", false)
 		}
 	}
@@ -0,0 +1,38 @@
+package gc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStalePartialFilesRemoved(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+
+	stale := createTestFile(t, c, idx, "helloworld")
+	recent := createTestFile(t, c, idx, "0123456789")
+	stalled := createTestFile(t, c, idx, "abcdefghij")
+	stalePartial := string(stale.DataFile) + cache.SUFFIX_PARTIAL_FILE
+	recentPartial := string(recent.DataFile) + cache.SUFFIX_PARTIAL_FILE
+	stalledPartial := string(stalled.DataFile) + cache.SUFFIX_PARTIAL_FILE
+	os.WriteFile(stalePartial, []byte("hello"), 0666)
+	os.WriteFile(recentPartial, []byte("01234"), 0666)
+	os.WriteFile(stalledPartial, []byte("abcde"), 0666)
+
+	gc := NewGarbageCollector(c, idx, Settings{Interval: time.Minute}, Options{})
+	past := time.Now().Add(-DEFAULT_PARTIAL_MAX_UNUSED - time.Minute)
+	os.Chtimes(stalePartial, past, past)
+	// the download is still in progress, e.g.: waiting for the upstream
+	os.Chtimes(stalledPartial, past, past)
+	idx.SetStatus(stalled.CacheKey, cache.STATUS_IN_PROGRESS)
+	gc.checkStalePartialFiles()
+
+	assert.NoFileExists(t, stalePartial)
+	assert.FileExists(t, recentPartial)
+	assert.FileExists(t, stalledPartial)
+}
@@ -6,50 +6,55 @@ import (
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
-	"github.com/inhies/go-bytesize"
 	"github.com/sirupsen/logrus"
 )
 
-func NewGarbageCollector(
-	ch cache.Cache,
-	idx cache.Index,
-	maxSize bytesize.ByteSize,
-	checkSHA bool,
-	interval,
-	mMaxAge,
-	mMaxUnused,
-	lMaxAge,
-	lMaxUnused time.Duration) *GarbageCollector {
-
-	return &GarbageCollector{
-		cache:    ch,
-		index:    idx,
-		checkSHA: checkSHA,
-		interval: interval,
-		disk: struct {
-			maxSize bytesize.ByteSize
-		}{
-			maxSize: maxSize,
-		},
-		manifests: struct {
-			maxUnused time.Duration
-			maxAge    time.Duration
-		}{
-			maxUnused: mMaxUnused,
-			maxAge:    mMaxAge,
-		},
-		layers: struct {
-			maxUnused time.Duration
-			maxAge    time.Duration
-		}{
-			maxUnused: lMaxUnused,
-			maxAge:    lMaxAge,
-		},
-		log: logrus.WithField("name", "gc"),
-		mu:  sync.Mutex{},
+func NewGarbageCollector(ch cache.Cache, idx cache.Index, s Settings, opts Options) *GarbageCollector {
+
+	gc := &GarbageCollector{
+		cache:  ch,
+		index:  idx,
+		pins:   opts.Pins,
+		quotas: opts.Quotas,
+		log:    logrus.WithField("name", "gc"),
+		mu:     sync.Mutex{},
+	}
+	gc.settings = newSettings(s)
+	return gc
+}
+
+// Replace the settings of a reloaded config, they apply from the next run
+func (gc *GarbageCollector) Update(s Settings) {
+
+	gc.settingsLock.Lock()
+	defer gc.settingsLock.Unlock()
+
+	gc.settings = newSettings(s)
+	gc.log.Infoln("settings updated")
+}
+
+func newSettings(s Settings) settings {
+	partials := s.PartialsMaxUnused
+	if partials <= 0 {
+		partials = DEFAULT_PARTIAL_MAX_UNUSED
+	}
+	return settings{
+		interval:  s.Interval,
+		disk:      s.Disk,
+		manifests: ageLimits{maxUnused: s.ManifestsMaxUnused, maxAge: s.ManifestsMaxAge},
+		layers:    ageLimits{maxUnused: s.LayersMaxUnused, maxAge: s.LayersMaxAge},
+		checkSHA:  s.CheckSHA,
+		partials:  partials,
 	}
 }
 
+func (gc *GarbageCollector) current() settings {
+	gc.settingsLock.RLock()
+	defer gc.settingsLock.RUnlock()
+
+	return gc.settings
+}
+
 func (gc *GarbageCollector) Start() {
 
 	// indipendent gc
@@ -66,13 +71,14 @@ func (gc *GarbageCollector) Start() {
 			gc.cleanUndesiredFiles()
 			gc.cleanOrphanFiles()
 			gc.cleanCacheKeys()
-			if gc.checkSHA {
+			if gc.current().checkSHA {
 				gc.cleanCorruptLayerFiles()
 			}
 			gc.checkStalePartialFiles()
+			gc.cleanLowerTier()
 		}()
 
-		time.Sleep(gc.interval)
+		time.Sleep(gc.current().interval)
 
 	}
 }
@@ -85,7 +91,7 @@ func (gc *GarbageCollector) Try() {
 			gc.cleanUndesiredFiles()
 			gc.cleanCacheKeys()
 			gc.cleanOrphanFiles()
-			if gc.checkSHA {
+			if gc.current().checkSHA {
 				gc.cleanCorruptLayerFiles()
 			}
 		}()
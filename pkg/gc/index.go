@@ -2,7 +2,7 @@ package gc
 
 import (
 	"errors"
-	"os"
+	"io/fs"
 	"strings"
 	"time"
 
@@ -15,6 +15,19 @@ const (
 
 func (gc *GarbageCollector) cleanCacheKey(k cache.CacheKey, df cache.DataFile, cfgMaxAge, cfgMaxU time.Duration) {
 
+	//***  checking missing files
+	// key exists but not the underlying file
+	if _, err := gc.cache.Stat(df); errors.Is(err, fs.ErrNotExist) {
+		gc.log.Infoln("cleaning up cache key: ", k)
+		gc.cache.Delete(df, k, false)
+		return
+	}
+
+	// pinned files are kept even if unused or old
+	if gc.pins.IsPinned(k) {
+		return
+	}
+
 	//***  checking max unused
 	atimeInt, err := gc.index.GetATime(k)
 	if err != nil {
@@ -45,25 +58,20 @@ func (gc *GarbageCollector) cleanCacheKey(k cache.CacheKey, df cache.DataFile, c
 		}
 
 	}
-
-	//***  checking missing files
-	// key exists but not the underlying file
-	if _, err := os.Stat(string(df)); errors.Is(err, os.ErrNotExist) {
-		gc.log.Infoln("cleaning up cache key: ", k)
-		gc.cache.Delete(df, k, false)
-	}
 }
 
 func (gc *GarbageCollector) cleanCacheKeys() {
 
+	s := gc.current()
+
 	for _, k := range gc.index.ListCacheKeys() {
 		// check cached file max age
 		df, _ := gc.index.GetDatafile(k)
 		if strings.HasSuffix(string(df), cache.SUFFIX_LAYER_FILE) {
-			gc.cleanCacheKey(k, df, gc.layers.maxAge, gc.layers.maxUnused)
+			gc.cleanCacheKey(k, df, s.layers.maxAge, s.layers.maxUnused)
 			continue
 		} else if strings.HasSuffix(string(df), cache.SUFFIX_MANIFEST_FILE) {
-			gc.cleanCacheKey(k, df, gc.manifests.maxAge, gc.manifests.maxUnused)
+			gc.cleanCacheKey(k, df, s.manifests.maxAge, s.manifests.maxUnused)
 			continue
 		}
 	}
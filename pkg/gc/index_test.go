@@ -0,0 +1,30 @@
+package gc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinnedFilesKept(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+
+	pinned := createTestFile(t, c, idx, "helloworld")
+	unpinned := createTestFile(t, c, idx, "0123456789")
+
+	pins, _ := pin.NewPinner(c, idx, nil, pin.ComputePinsFile(c.GetDataPath()), []string{pin.DIGEST_PREFIX + string(pinned.CacheKey)})
+	pins.Load()
+
+	// every file is unused and too old
+	gc := NewGarbageCollector(c, idx, Settings{Interval: time.Minute}, Options{Pins: pins})
+	time.Sleep(time.Second)
+	gc.cleanCacheKeys()
+
+	assert.Equal(t, cache.STATUS_AVAILABLE, idx.GetStatus(pinned.CacheKey))
+	assert.Equal(t, cache.STATUS_NOT_FOUND, idx.GetStatus(unpinned.CacheKey))
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package gc
+
+import "syscall"
+
+func statfs(path string) (*fsStats, error) {
+
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsStats{
+		freeBytes:  int64(st.Bavail) * int64(st.Bsize),
+		inodes:     st.Files,
+		freeInodes: st.Ffree,
+	}, nil
+}
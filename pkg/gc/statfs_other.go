@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package gc
+
+import "fmt"
+
+func statfs(path string) (*fsStats, error) {
+	return nil, fmt.Errorf("statfs is not supported on this platform")
+}
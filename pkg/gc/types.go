@@ -5,26 +5,98 @@ import (
 	"time"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
-	"github.com/inhies/go-bytesize"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/ish-xyz/registry-cache/pkg/quota"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// how often the watermarks are checked
+	DISK_CHECK_INTERVAL = 10 * time.Second
+
+	// partial files not written for longer are abandoned downloads, long enough to resume them after a restart
+	DEFAULT_PARTIAL_MAX_UNUSED = 24 * time.Hour
+
+	EVICTION_REASON_SIZE        = "size"
+	EVICTION_REASON_FREE_SPACE  = "free-space"
+	EVICTION_REASON_FREE_INODES = "free-inodes"
+	EVICTION_REASON_QUOTA       = "quota"
+)
+
+// Watermarks of the disk usage, eviction starts when a high watermark
+// is exceeded and stops when the low watermark is reached. Zero values disable a check
+type Watermarks struct {
+	// bytes of the cached files
+	MaxSize    int64
+	TargetSize int64
+	// filesystem checked for free space and inodes, e.g.: the data path
+	Path       string
+	MinFree    int64
+	TargetFree int64
+	// percentages of free inodes
+	MinFreeInodes    float64
+	TargetFreeInodes float64
+}
+
+// What was freed by an eviction batch
+type EvictionReport struct {
+	Reason   string
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Free space and inodes of a filesystem
+type fsStats struct {
+	freeBytes  int64
+	inodes     uint64
+	freeInodes uint64
+}
+
+// Settings of the gc, replaced when the config is reloaded. Zero ages disable a check
+type Settings struct {
+	Interval           time.Duration
+	Disk               Watermarks
+	CheckSHA           bool
+	ManifestsMaxAge    time.Duration
+	ManifestsMaxUnused time.Duration
+	LayersMaxAge       time.Duration
+	LayersMaxUnused    time.Duration
+	// DEFAULT_PARTIAL_MAX_UNUSED if zero
+	PartialsMaxUnused time.Duration
+}
+
+// Optional dependencies of the gc, disabled if nil
+type Options struct {
+	// pinned files are never removed
+	Pins *pin.Pinner
+	// the owners above their quota are evicted first
+	Quotas *quota.Tracker
+}
+
 type GarbageCollector struct {
-	interval time.Duration
-	disk     struct {
-		maxSize bytesize.ByteSize
-	}
-	layers struct {
-		maxUnused time.Duration
-		maxAge    time.Duration
-	}
-	manifests struct {
-		maxUnused time.Duration
-		maxAge    time.Duration
-	}
-	checkSHA bool
-	cache    cache.Cache
-	index    cache.Index
-	log      *logrus.Entry
-	mu       sync.Mutex
+	settings settings
+	// guards the settings, they're replaced when the config is reloaded
+	settingsLock sync.RWMutex
+	cache        cache.Cache
+	index        cache.Index
+	pins         *pin.Pinner
+	quotas       *quota.Tracker
+	log          *logrus.Entry
+	mu           sync.Mutex
+}
+
+type settings struct {
+	interval  time.Duration
+	disk      Watermarks
+	layers    ageLimits
+	manifests ageLimits
+	checkSHA  bool
+	// partial files not written for longer aren't being filled or resumed
+	partials time.Duration
+}
+
+type ageLimits struct {
+	maxUnused time.Duration
+	maxAge    time.Duration
 }
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/ish-xyz/registry-cache/pkg/quota"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -39,7 +41,7 @@ var (
 	CacheSize = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "rc_cache_size_bytes",
-			Help: "size of cache folder in bytes",
+			Help: "size of the cached files in bytes",
 		},
 	)
 	FailedRequests = prometheus.NewCounterVec(
@@ -49,6 +51,126 @@ var (
 		},
 		[]string{"reason", "path"},
 	)
+	CacheWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_cache_write_failures",
+			Help: "failed writes of upstream content into the cache",
+		},
+		[]string{"reason", "type"},
+	)
+	TieredPromotions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_l2_promotions",
+			Help: "files copied from the lower tier instead of the upstream registry",
+		},
+		[]string{"type"},
+	)
+	TieredDemotions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rc_l2_demotions",
+			Help: "evicted files copied to the lower tier",
+		},
+	)
+	EvictedFiles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_gc_evicted_files",
+			Help: "files evicted by the gc to respect the disk watermarks",
+		},
+		[]string{"reason"},
+	)
+	EvictedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_gc_evicted_bytes",
+			Help: "bytes evicted by the gc to respect the disk watermarks",
+		},
+		[]string{"reason"},
+	)
+	DiskFreeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rc_disk_free_bytes",
+			Help: "free space of the data path filesystem in bytes",
+		},
+	)
+	DiskFreeInodes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rc_disk_free_inodes_percent",
+			Help: "percentage of free inodes of the data path filesystem",
+		},
+	)
+	BackgroundPrefetches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_background_prefetches",
+			Help: "files referenced by cached manifests fetched in background",
+		},
+		[]string{"type", "status"},
+	)
+	TagRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_tag_requests",
+			Help: "manifests requested by tag, served from the cache (hit, revalidated) or the upstream (miss)",
+		},
+		[]string{"result"},
+	)
+	AuthCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_auth_cache_requests",
+			Help: "permission checks served from the cache (allowed, denied) or sent to the upstream (miss)",
+		},
+		[]string{"result"},
+	)
+	TokenRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_token_requests",
+			Help: "upstream tokens served from the cache (hit), issued by the token services (issued) or failed",
+		},
+		[]string{"result"},
+	)
+	ClientRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_client_requests",
+			Help: "requests of the authenticated clients, per identity and authentication method",
+		},
+		[]string{"identity", "method"},
+	)
+	ClientAuthFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rc_client_auth_failures",
+			Help: "requests rejected because the client isn't authenticated",
+		},
+	)
+	PolicyDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_policy_decisions",
+			Help: "requests evaluated by the access policy, per matching rule and action",
+		},
+		[]string{"rule", "action"},
+	)
+	WebhookRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_webhook_requests",
+			Help: "pulls authorized by the webhook, per verdict (allow, deny, passthrough), cached or failed",
+		},
+		[]string{"result"},
+	)
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rc_config_reloads",
+			Help: "reloads of the config file, per result (applied, failed)",
+		},
+		[]string{"result"},
+	)
+	ConfigLastReload = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rc_config_last_reload_timestamp_seconds",
+			Help: "time of the last config reload applied",
+		},
+	)
+	LowerTierSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rc_l2_size_bytes",
+			Help: "size of the lower tier in bytes",
+		},
+	)
 	TotalCachedRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "rc_total_cached_requests",
@@ -88,6 +210,24 @@ func init() {
 	prometheus.MustRegister(TotalGCRuns)
 	prometheus.MustRegister(CacheSize)
 	prometheus.MustRegister(FailedRequests)
+	prometheus.MustRegister(CacheWriteFailures)
+	prometheus.MustRegister(TieredPromotions)
+	prometheus.MustRegister(TieredDemotions)
+	prometheus.MustRegister(LowerTierSize)
+	prometheus.MustRegister(BackgroundPrefetches)
+	prometheus.MustRegister(TagRequests)
+	prometheus.MustRegister(AuthCacheRequests)
+	prometheus.MustRegister(TokenRequests)
+	prometheus.MustRegister(ClientRequests)
+	prometheus.MustRegister(ClientAuthFailures)
+	prometheus.MustRegister(PolicyDecisions)
+	prometheus.MustRegister(WebhookRequests)
+	prometheus.MustRegister(ConfigReloads)
+	prometheus.MustRegister(ConfigLastReload)
+	prometheus.MustRegister(EvictedFiles)
+	prometheus.MustRegister(EvictedBytes)
+	prometheus.MustRegister(DiskFreeBytes)
+	prometheus.MustRegister(DiskFreeInodes)
 	prometheus.MustRegister(TotalCachedRequests)
 	prometheus.MustRegister(TotalCacheMiss)
 	prometheus.MustRegister(TotalUpstreamActiveConn)
@@ -109,6 +249,81 @@ func Run(metricsAddr string, idx cache.Index) {
 	http.ListenAndServe(metricsAddr, nil)
 }
 
+// Metrics of the in-memory tier, read from its counters on scrape
+func RegisterMemoryCache(mc *cache.MemoryCache) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Name: "rc_memory_cache_hits", Help: "cache hits served from memory"},
+			func() float64 { return float64(mc.Stats().Hits) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Name: "rc_memory_cache_miss", Help: "cache hits not found in memory"},
+			func() float64 { return float64(mc.Stats().Misses) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Name: "rc_memory_cache_evictions", Help: "files evicted from memory"},
+			func() float64 { return float64(mc.Stats().Evictions) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Name: "rc_memory_cache_rejected", Help: "files too large to be stored in memory"},
+			func() float64 { return float64(mc.Stats().Rejected) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "rc_memory_cache_size_bytes", Help: "size of the files stored in memory"},
+			func() float64 { return float64(mc.Stats().Size) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "rc_memory_cache_files", Help: "number of files stored in memory"},
+			func() float64 { return float64(mc.Stats().Entries) },
+		),
+	)
+}
+
+func RegisterPinner(p *pin.Pinner) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "rc_pinned_bytes", Help: "size of the pinned files in the cache"},
+			func() float64 {
+				_, size := p.Stats()
+				return float64(size)
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "rc_pinned_files", Help: "number of pinned files in the cache"},
+			func() float64 {
+				files, _ := p.Stats()
+				return float64(files)
+			},
+		),
+	)
+}
+
+func RegisterQuotas(t *quota.Tracker) {
+	for _, q := range t.Quotas() {
+		name, maxSize := q.Name, q.MaxSize
+		labels := prometheus.Labels{"quota": name}
+		prometheus.MustRegister(
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{Name: "rc_quota_usage_bytes", Help: "size of the files owned by the quota", ConstLabels: labels},
+				func() float64 { return float64(t.Usage(name)) },
+			),
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{Name: "rc_quota_max_bytes", Help: "max size of the files owned by the quota", ConstLabels: labels},
+				func() float64 { return float64(maxSize) },
+			),
+		)
+	}
+}
+
+func RegisterAuthCache(a *cache.AuthCache) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "rc_auth_cache_entries", Help: "permission check results in memory"},
+			func() float64 { return float64(a.Len()) },
+		),
+	)
+}
+
 // Gauge routines
 
 func updateActiveUpstreamConns() {
@@ -0,0 +1,38 @@
+package pin
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Admin API to manage the pins at runtime:
+// GET lists the rules, POST and DELETE add and remove the rule in the pattern parameter
+func (p *Pinner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	var err error
+	pattern := r.URL.Query().Get("pattern")
+
+	switch r.Method {
+	case http.MethodGet:
+		files, size := p.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Status{Rules: p.Rules(), Files: files, Bytes: size})
+		return
+	case http.MethodPost:
+		err = p.AddRule(pattern)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		err = p.RemoveRule(pattern)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,432 @@
+package pin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/sirupsen/logrus"
+)
+
+// Pinner with the rules of the config, the pins added at runtime are stored in path.
+// The policy can be nil if the cache doesn't use one
+func NewPinner(ch cache.Cache, idx cache.Index, policy *eviction.Pinned, path string, patterns []string) (*Pinner, error) {
+
+	p := &Pinner{
+		rules:   make([]*Rule, 0),
+		runtime: make(map[string]bool),
+		keys:    make(map[cache.CacheKey]string),
+		policy:  policy,
+		cache:   ch,
+		index:   idx,
+		path:    path,
+		log:     logrus.WithField("name", "pinner"),
+	}
+
+	for _, pattern := range patterns {
+		rule, err := NewRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+// Load the pins added at runtime and pin the cached files matching the rules
+func (p *Pinner) Load() error {
+
+	state := &pinsState{}
+	data, err := os.ReadFile(p.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read pins: %v", err)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			return fmt.Errorf("failed to parse pins %s: %v", p.path, err)
+		}
+	}
+
+	p.lock.Lock()
+	for _, pattern := range state.Rules {
+		rule, err := NewRule(pattern)
+		if err != nil {
+			p.log.Warningln("ignoring pin:", err)
+			continue
+		}
+		if p.getRule(pattern) == nil {
+			p.rules = append(p.rules, rule)
+		}
+		p.runtime[pattern] = true
+	}
+	p.lock.Unlock()
+
+	// tags resolved before the restart
+	for ckey, pattern := range state.Keys {
+		p.lock.RLock()
+		found := p.getRule(pattern) != nil
+		p.lock.RUnlock()
+		if found {
+			p.pin(ckey, pattern)
+		}
+	}
+
+	p.applyRules()
+	p.log.Infof("%d files pinned by %d rules", len(p.Keys()), len(p.Rules()))
+
+	return p.save()
+}
+
+// Persist the pins added at runtime and the pinned cache keys.
+// Saves are serialized, each one writes a snapshot taken after the previous one through its own temporary file
+func (p *Pinner) save() error {
+
+	p.saveLock.Lock()
+	defer p.saveLock.Unlock()
+
+	p.lock.RLock()
+	state := &pinsState{
+		Rules: make([]string, 0, len(p.runtime)),
+		Keys:  make(map[cache.CacheKey]string, len(p.keys)),
+	}
+	for pattern := range p.runtime {
+		state.Rules = append(state.Rules, pattern)
+	}
+	for ckey, pattern := range p.keys {
+		state.Keys[ckey] = pattern
+	}
+	p.lock.RUnlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*"+cache.SUFFIX_PARTIAL_FILE)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (p *Pinner) getRule(pattern string) *Rule {
+	for _, r := range p.rules {
+		if r.Pattern == pattern {
+			return r
+		}
+	}
+	return nil
+}
+
+// Pattern of the first rule matching a reference (tag or digest) of the repository, empty if none
+func (p *Pinner) Match(repository, reference string) string {
+	if p == nil {
+		return ""
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, r := range p.rules {
+		if r.Match(repository, reference) {
+			return r.Pattern
+		}
+	}
+	return ""
+}
+
+func (p *Pinner) IsPinned(ckey cache.CacheKey) bool {
+	if p == nil {
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.keys[ckey]
+	return ok
+}
+
+func (p *Pinner) Rules() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	patterns := make([]string, 0, len(p.rules))
+	for _, r := range p.rules {
+		patterns = append(patterns, r.Pattern)
+	}
+	return patterns
+}
+
+func (p *Pinner) Keys() []cache.CacheKey {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	keys := make([]cache.CacheKey, 0, len(p.keys))
+	for ckey := range p.keys {
+		keys = append(keys, ckey)
+	}
+	return keys
+}
+
+// Number and size of the pinned files in the cache
+func (p *Pinner) Stats() (int, int64) {
+
+	files := 0
+	var size int64
+	for _, ckey := range p.Keys() {
+		if p.index.GetStatus(ckey) != cache.STATUS_AVAILABLE {
+			continue
+		}
+		rf, err := p.index.GetResponseFile(ckey)
+		if err != nil || rf == nil {
+			continue
+		}
+		files++
+		size += int64(rf.ContentLength)
+	}
+	return files, size
+}
+
+func (p *Pinner) pin(ckey cache.CacheKey, pattern string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.keys[ckey] = pattern
+	if p.policy != nil {
+		p.policy.Pin(string(ckey))
+	}
+}
+
+// Pin the manifest and the blobs it references,
+// returns the manifests referenced by an image index so that they can be resolved too
+func (p *Pinner) PinManifest(ckey cache.CacheKey, pattern string, content []byte) ([]cache.CacheKey, error) {
+
+	children, err := p.pinManifest(ckey, pattern, content)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.save()
+	if err != nil {
+		p.log.Warningln("failed to save pins:", err)
+	}
+	return children, nil
+}
+
+func (p *Pinner) pinManifest(ckey cache.CacheKey, pattern string, content []byte) ([]cache.CacheKey, error) {
+
+	p.pin(ckey, pattern)
+
+	m := &cache.Manifest{}
+	err := json.Unmarshal(content, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", ckey, err)
+	}
+
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, d := range blobs {
+		if key, ok := cache.ComputeDigestKey(d.Digest); ok {
+			p.pin(key, pattern)
+		}
+	}
+
+	children := make([]cache.CacheKey, 0, len(m.Manifests))
+	for _, d := range m.Manifests {
+		if key, ok := cache.ComputeDigestKey(d.Digest); ok {
+			p.pin(key, pattern)
+			children = append(children, key)
+		}
+	}
+
+	return children, nil
+}
+
+// Pin a file stored in the cache if it's matched by a rule or it has been pinned before it was downloaded,
+// manifests are read from the cache to pin what they reference
+func (p *Pinner) Observe(cr *cache.CacheRequest) {
+	if p == nil {
+		return
+	}
+
+	p.lock.RLock()
+	pattern := p.keys[cr.CacheKey]
+	p.lock.RUnlock()
+
+	if pattern == "" {
+		pattern = p.Match(cr.Repository, DIGEST_PREFIX+string(cr.CacheKey))
+	}
+	if pattern == "" {
+		return
+	}
+
+	p.pinFile(cr.CacheKey, pattern)
+
+	err := p.save()
+	if err != nil {
+		p.log.Warningln("failed to save pins:", err)
+	}
+}
+
+// Pin a cached file, resolving the references of cached manifests
+func (p *Pinner) pinFile(ckey cache.CacheKey, pattern string) {
+
+	queue := []cache.CacheKey{ckey}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+
+		p.pin(key, pattern)
+
+		df, err := p.index.GetDatafile(key)
+		if err != nil || !strings.HasSuffix(string(df), cache.SUFFIX_MANIFEST_FILE) {
+			continue
+		}
+
+		content, err := p.readFile(df)
+		if err != nil {
+			p.log.Warningf("failed to read pinned manifest %s: %v", key, err)
+			continue
+		}
+
+		children, err := p.pinManifest(key, pattern, content)
+		if err != nil {
+			p.log.Warningln(err)
+			continue
+		}
+
+		// manifests of an image index that aren't cached yet are resolved when they're stored
+		queue = append(queue, children...)
+	}
+}
+
+func (p *Pinner) readFile(df cache.DataFile) ([]byte, error) {
+
+	f, err := p.cache.Open(df)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, MAX_MANIFEST_SIZE))
+}
+
+// Pin the cached files matching the rules
+func (p *Pinner) applyRules() {
+
+	for _, ckey := range p.index.ListCacheKeys() {
+		if p.index.GetStatus(ckey) != cache.STATUS_AVAILABLE || p.IsPinned(ckey) {
+			continue
+		}
+		rf, err := p.index.GetResponseFile(ckey)
+		if err != nil || rf == nil {
+			continue
+		}
+
+		p.lock.RLock()
+		pattern := ""
+		for _, r := range p.rules {
+			if r.matchFile(ckey, rf.Repository) {
+				pattern = r.Pattern
+				break
+			}
+		}
+		p.lock.RUnlock()
+
+		if pattern != "" {
+			p.pinFile(ckey, pattern)
+		}
+	}
+}
+
+// Add a rule at runtime and pin the cached files matching it
+func (p *Pinner) AddRule(pattern string) error {
+
+	rule, err := NewRule(pattern)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	if p.getRule(pattern) == nil {
+		p.rules = append(p.rules, rule)
+	}
+	p.runtime[pattern] = true
+	p.lock.Unlock()
+
+	p.log.Infoln("added pin", pattern)
+	p.applyRules()
+
+	// the pin is applied even if it can't be persisted
+	err = p.save()
+	if err != nil {
+		p.log.Warningln("failed to save pins:", err)
+	}
+	return nil
+}
+
+// Remove a rule and unpin the files pinned by it, unless another rule matches them
+func (p *Pinner) RemoveRule(pattern string) error {
+
+	p.lock.Lock()
+	found := false
+	for i, r := range p.rules {
+		if r.Pattern == pattern {
+			p.rules = append(p.rules[:i], p.rules[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.lock.Unlock()
+		return fmt.Errorf("pin %s not found", pattern)
+	}
+	delete(p.runtime, pattern)
+
+	for ckey, keyPattern := range p.keys {
+		if keyPattern != pattern {
+			continue
+		}
+		delete(p.keys, ckey)
+		if p.policy != nil {
+			p.policy.Unpin(string(ckey))
+		}
+	}
+	p.lock.Unlock()
+
+	p.log.Infoln("removed pin", pattern)
+	p.applyRules()
+
+	err := p.save()
+	if err != nil {
+		p.log.Warningln("failed to save pins:", err)
+	}
+	return nil
+}
+
+// The pins file is stored next to the cache files
+func ComputePinsFile(dataPath string) string {
+	return filepath.Join(dataPath, PINS_FILE)
+}
@@ -0,0 +1,153 @@
+package pin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func digestOf(content string) cache.CacheKey {
+	return cache.CacheKey(fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+}
+
+func createTestFile(t *testing.T, c cache.Cache, idx cache.Index, repository, content string, manifest bool) cache.CacheKey {
+	ckey := digestOf(content)
+	df, _ := cache.ComputeLayerFile(c.GetDataPath(), string(ckey))
+	if manifest {
+		df, _ = cache.ComputeManifestFile(c.GetDataPath(), string(ckey))
+	}
+	cr := &cache.CacheRequest{
+		CacheEnabled:     true,
+		CacheKey:         ckey,
+		DataFile:         df,
+		ResponseFilePath: cache.ComputeResponseFilePath(string(df)),
+		Repository:       repository,
+	}
+
+	rf := cache.NewResponseFile(len(content), 200, nil, ckey)
+	rf.Repository = repository
+	idx.Put(ckey, df)
+	err := c.Create(cr, rf, io.NopCloser(strings.NewReader(content)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SetStatus(ckey, cache.STATUS_AVAILABLE)
+	return ckey
+}
+
+func TestRuleMatch(t *testing.T) {
+	digest := DIGEST_PREFIX + string(digestOf("helloworld"))
+
+	byDigest, err := NewRule(digest)
+	assert.Nil(t, err)
+	assert.True(t, byDigest.Match("any/repo", digest))
+	assert.False(t, byDigest.Match("any/repo", "latest"))
+
+	byRepo, err := NewRule("nvidia/*")
+	assert.Nil(t, err)
+	assert.True(t, byRepo.Match("nvidia/cuda", "12.2"))
+	assert.True(t, byRepo.Match("nvidia/cuda", digest))
+	assert.False(t, byRepo.Match("library/alpine", "latest"))
+
+	byTag, err := NewRule("localhost:5000/nvidia/cuda:12.*")
+	assert.Nil(t, err)
+	assert.True(t, byTag.Match("localhost:5000/nvidia/cuda", "12.2"))
+	assert.False(t, byTag.Match("localhost:5000/nvidia/cuda", "11.8"))
+	assert.False(t, byTag.Match("localhost:5000/nvidia/cuda", digest))
+
+	_, err = NewRule("sha256:nothex")
+	assert.NotNil(t, err)
+	_, err = NewRule("nvidia/[cuda")
+	assert.NotNil(t, err)
+}
+
+func TestPinManifestByRepository(t *testing.T) {
+	dataPath := t.TempDir()
+	idx := cache.NewMemoryIndex()
+	policy := eviction.NewPinned(eviction.NewLRU())
+	c := cache.NewCache(idx, dataPath, policy)
+
+	layer := createTestFile(t, c, idx, "nvidia/cuda", "layer", false)
+	config := createTestFile(t, c, idx, "nvidia/cuda", "config", false)
+	other := createTestFile(t, c, idx, "library/alpine", "other", false)
+	manifest := createTestFile(t, c, idx, "nvidia/cuda", fmt.Sprintf(
+		`{"config":{"digest":"sha256:%s"},"layers":[{"digest":"sha256:%s"},{"digest":"sha256:%s"}]}`,
+		config, layer, digestOf("not cached yet"),
+	), true)
+
+	pinner, err := NewPinner(c, idx, policy, ComputePinsFile(dataPath), []string{"nvidia/cuda"})
+	assert.Nil(t, err)
+	assert.Nil(t, pinner.Load())
+
+	for _, ckey := range []cache.CacheKey{layer, config, manifest, digestOf("not cached yet")} {
+		assert.True(t, pinner.IsPinned(ckey))
+	}
+	assert.False(t, pinner.IsPinned(other))
+
+	files, _ := pinner.Stats()
+	assert.Equal(t, 3, files)
+
+	// only the unpinned file can be evicted
+	luf, err := c.GetLeastUsedFile()
+	assert.Nil(t, err)
+	assert.Equal(t, other, idx.GetDataRef(luf))
+}
+
+func TestRuntimePinsPersisted(t *testing.T) {
+	dataPath := t.TempDir()
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, dataPath, eviction.NewLRU())
+	layer := createTestFile(t, c, idx, "library/alpine", "layer", false)
+
+	pinner, _ := NewPinner(c, idx, nil, ComputePinsFile(dataPath), nil)
+	assert.Nil(t, pinner.AddRule(DIGEST_PREFIX+string(layer)))
+	assert.True(t, pinner.IsPinned(layer))
+
+	// tag resolved by the worker
+	tagged := digestOf("tagged manifest")
+	_, err := pinner.PinManifest(tagged, DIGEST_PREFIX+string(layer), []byte(`{"layers":[]}`))
+	assert.Nil(t, err)
+
+	restarted, _ := NewPinner(c, idx, nil, ComputePinsFile(dataPath), nil)
+	assert.Nil(t, restarted.Load())
+	assert.Equal(t, []string{DIGEST_PREFIX + string(layer)}, restarted.Rules())
+	assert.True(t, restarted.IsPinned(layer))
+	assert.True(t, restarted.IsPinned(tagged))
+
+	assert.Nil(t, restarted.RemoveRule(DIGEST_PREFIX+string(layer)))
+	assert.False(t, restarted.IsPinned(layer))
+	assert.False(t, restarted.IsPinned(tagged))
+	assert.NotNil(t, restarted.RemoveRule("library/alpine"))
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	dataPath := t.TempDir()
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, dataPath, eviction.NewLRU())
+	pinner, _ := NewPinner(c, idx, nil, ComputePinsFile(dataPath), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, pinner.AddRule(fmt.Sprintf("library/app%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	// the last save has all the rules, no temporary file is left
+	restarted, _ := NewPinner(c, idx, nil, ComputePinsFile(dataPath), nil)
+	assert.Nil(t, restarted.Load())
+	assert.Len(t, restarted.Rules(), 20)
+	partials, _ := filepath.Glob(ComputePinsFile(dataPath) + ".*")
+	assert.Empty(t, partials)
+}
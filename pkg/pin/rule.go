@@ -0,0 +1,68 @@
+package pin
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+)
+
+func NewRule(pattern string) (*Rule, error) {
+
+	if strings.HasPrefix(pattern, DIGEST_PREFIX) {
+		digest := strings.TrimPrefix(pattern, DIGEST_PREFIX)
+		if !cache.REGEX_DIGEST_HEX.MatchString(digest) {
+			return nil, fmt.Errorf("invalid digest in pin %s", pattern)
+		}
+		return &Rule{Pattern: pattern, digest: cache.CacheKey(digest)}, nil
+	}
+
+	// the tag follows the last colon, unless it's part of the registry host (e.g.: host:5000/repo)
+	repository, tag := pattern, ""
+	if i := strings.LastIndex(pattern, ":"); i > strings.LastIndex(pattern, "/") {
+		repository, tag = pattern[:i], pattern[i+1:]
+	}
+
+	if repository == "" {
+		return nil, fmt.Errorf("empty repository in pin %s", pattern)
+	}
+	for _, p := range []string{repository, tag} {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in pin %s: %v", pattern, err)
+		}
+	}
+
+	return &Rule{Pattern: pattern, repository: repository, tag: tag}, nil
+}
+
+// Check if the rule matches a reference (tag or digest) of the repository
+func (r *Rule) Match(repository, reference string) bool {
+
+	isDigest := strings.HasPrefix(reference, DIGEST_PREFIX)
+	if r.digest != "" {
+		return isDigest && cache.CacheKey(strings.TrimPrefix(reference, DIGEST_PREFIX)) == r.digest
+	}
+
+	if ok, _ := path.Match(r.repository, repository); !ok {
+		return false
+	}
+	if r.tag == "" {
+		return true
+	}
+
+	// digests of tagged manifests are pinned when the tag is resolved
+	if isDigest {
+		return false
+	}
+	ok, _ := path.Match(r.tag, reference)
+	return ok
+}
+
+// Tags are resolved when they're pulled, they can't be matched against the cached files
+func (r *Rule) matchFile(ckey cache.CacheKey, repository string) bool {
+	if r.digest != "" {
+		return r.digest == ckey
+	}
+	return r.tag == "" && r.Match(repository, DIGEST_PREFIX+string(ckey))
+}
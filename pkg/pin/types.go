@@ -0,0 +1,60 @@
+package pin
+
+import (
+	"sync"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// file of the pins added at runtime and of the resolved cache keys, stored in the data path
+	PINS_FILE = "pins.json"
+
+	DIGEST_PREFIX = cache.DIGEST_PREFIX
+
+	// manifests larger than this aren't accepted by the registries
+	MAX_MANIFEST_SIZE = 4 * 1024 * 1024
+)
+
+// Pinner keeps the files matching the pin rules in the cache,
+// the pinned files are skipped by the garbage collector and by the eviction policy
+type Pinner struct {
+	rules []*Rule
+	// patterns added at runtime, persisted in the pins file
+	runtime map[string]bool
+	// pinned cache keys and the pattern of the rule pinning them
+	keys   map[cache.CacheKey]string
+	policy *eviction.Pinned
+	cache  cache.Cache
+	index  cache.Index
+	path   string
+	lock   sync.RWMutex
+	// serializes the writes of the pins file
+	saveLock sync.Mutex
+	log      *logrus.Entry
+}
+
+// Rule pins a digest (sha256:<hex>), every file of the matching repositories (<repository>)
+// or the manifests of the matching tags and what they reference (<repository>:<tag>).
+// Repositories and tags are glob patterns
+type Rule struct {
+	Pattern    string
+	digest     cache.CacheKey
+	repository string
+	tag        string
+}
+
+// content of the pins file
+type pinsState struct {
+	Rules []string                  `json:"rules"`
+	Keys  map[cache.CacheKey]string `json:"keys"`
+}
+
+// Status returned by the admin API
+type Status struct {
+	Rules []string `json:"rules"`
+	Files int      `json:"files"`
+	Bytes int64    `json:"bytes"`
+}
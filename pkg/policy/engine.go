@@ -0,0 +1,57 @@
+package policy
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+func NewEngine(file string) (*Engine, error) {
+	e := &Engine{path: file, log: logrus.WithField("name", "policy")}
+	return e, e.Reload()
+}
+
+func (e *Engine) Evaluate(req *Request) Decision {
+
+	e.lock.RLock()
+	p := e.policy
+	e.lock.RUnlock()
+
+	d := p.Evaluate(req)
+	e.log.Debugf("rule '%s' matched %s %s (%s) from %s (%s): %s", d.Rule, req.Method, req.Host, req.Repository, req.ClientIP, req.Identity, d.Action)
+	return d
+}
+
+// Load the file again if it changed, called periodically by the config reloader.
+// The policy loaded before is kept if the new file is invalid
+func (e *Engine) Reload() error {
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		if e.policy != nil {
+			return nil
+		}
+		return err
+	}
+	if e.policy != nil && info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+		return nil
+	}
+
+	p, err := LoadPolicy(e.path)
+	if err != nil && e.policy == nil {
+		return err
+	}
+
+	e.modTime = info.ModTime()
+	e.size = info.Size()
+	if err != nil {
+		e.log.Errorf("failed to reload %s, keeping the previous rules: %v", e.path, err)
+		return nil
+	}
+
+	e.lock.Lock()
+	e.policy = p
+	e.lock.Unlock()
+	e.log.Infof("loaded %d rules from %s", len(p.Rules), e.path)
+	return nil
+}
@@ -0,0 +1,162 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"gopkg.in/yaml.v2"
+)
+
+// Load and validate a policy file
+func LoadPolicy(file string) (*Policy, error) {
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	err = yaml.UnmarshalStrict(content, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, p.validate()
+}
+
+func (p *Policy) validate() error {
+
+	if p.Default == "" {
+		p.Default = ACTION_ALLOW
+	}
+	if !validAction(p.Default) {
+		return fmt.Errorf("invalid default action '%s'", p.Default)
+	}
+
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if !validAction(r.Action) {
+			return fmt.Errorf("invalid action '%s' in rule %s", r.Action, r.Name)
+		}
+
+		r.networks = nil
+		for _, cidr := range r.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid cidr in rule %s: %v", r.Name, err)
+			}
+			r.networks = append(r.networks, network)
+		}
+
+		for _, patterns := range [][]string{r.Identities, r.Groups, r.Hosts, r.Repositories} {
+			for _, pattern := range patterns {
+				if _, err := match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid pattern in rule %s: %v", r.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validAction(action string) bool {
+	switch action {
+	case ACTION_ALLOW, ACTION_DENY, ACTION_PASSTHROUGH, ACTION_NOCACHE:
+		return true
+	}
+	return false
+}
+
+// Action of the first rule matching the request, the default one if none matches
+func (p *Policy) Evaluate(req *Request) Decision {
+	for _, r := range p.Rules {
+		if r.Match(req) {
+			return Decision{Rule: r.Name, Action: r.Action}
+		}
+	}
+	return Decision{Rule: DEFAULT_RULE, Action: p.Default}
+}
+
+func (r *Rule) Match(req *Request) bool {
+
+	if len(r.networks) > 0 {
+		found := false
+		for _, n := range r.networks {
+			if req.ClientIP != nil && n.Contains(req.ClientIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Groups) > 0 {
+		found := false
+		for _, g := range req.Groups {
+			if matchAny(r.Groups, g) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return matchAny(r.Identities, req.Identity) &&
+		matchAny(r.Hosts, req.Host) &&
+		matchAny(r.Repositories, req.Repository) &&
+		matchAny(r.Methods, req.Method) &&
+		matchAny(r.ItemTypes, req.ItemType)
+}
+
+// Empty patterns match any value
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := match(pattern, value); ok || strings.EqualFold(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Glob pattern where * and ? match / too, so that secret/* matches the nested repositories (e.g.: secret/team/app).
+// The slashes are replaced by a character that path.Match doesn't treat as a separator
+func match(pattern, value string) (bool, error) {
+	return path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(value, "/", "\x00"))
+}
+
+// Attributes of a request from a client, before it's rewritten for the upstream
+func NewRequest(r *http.Request) *Request {
+
+	req := &Request{
+		Host:       r.Host,
+		Repository: cache.ComputeRepository(r.URL.Path),
+		Method:     r.Method,
+		ItemType:   cache.ComputeItemType(r.URL.Path),
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	req.ClientIP = net.ParseIP(host)
+
+	if id := auth.GetIdentity(r); id != nil {
+		req.Identity = id.Name
+		req.Groups = id.Groups
+	}
+	return req
+}
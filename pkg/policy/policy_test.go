@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+default: deny
+rules:
+- name: office
+  cidrs: ["10.0.0.0/8"]
+  action: allow
+- name: ci-no-cache
+  identities: ["ci-*"]
+  repositories: ["snapshots/*"]
+  action: nocache
+- name: admins
+  groups: ["admins"]
+  methods: ["GET", "HEAD"]
+  itemTypes: ["manifest"]
+  action: passthrough
+`
+
+// the contents have different sizes, so that the changes are detected within the mtime resolution
+func writePolicy(t *testing.T, file, content string) {
+	os.WriteFile(file, []byte(content), 0600)
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, file, testPolicy)
+	p, err := LoadPolicy(file)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "/v2/snapshots/app/manifests/latest", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	assert.Equal(t, Decision{Rule: "office", Action: ACTION_ALLOW}, p.Evaluate(NewRequest(r)))
+
+	req := &Request{ClientIP: net.ParseIP("192.168.1.1"), Identity: "ci-runner", Repository: "snapshots/app", Method: "GET", ItemType: "layer"}
+	assert.Equal(t, Decision{Rule: "ci-no-cache", Action: ACTION_NOCACHE}, p.Evaluate(req))
+
+	req = &Request{ClientIP: net.ParseIP("192.168.1.1"), Identity: "bob", Groups: []string{"admins"}, Repository: "app", Method: "GET", ItemType: "manifest"}
+	assert.Equal(t, Decision{Rule: "admins", Action: ACTION_PASSTHROUGH}, p.Evaluate(req))
+
+	req.ItemType = "layer"
+	assert.Equal(t, Decision{Rule: DEFAULT_RULE, Action: ACTION_DENY}, p.Evaluate(req))
+
+	// deny rules apply to the nested repositories too
+	writePolicy(t, file, "rules:\n- repositories: [\"secret/*\"]\n  action: deny\n")
+	p, err = LoadPolicy(file)
+	assert.Nil(t, err)
+	req = &Request{Repository: "secret/team/app", Method: "GET"}
+	assert.Equal(t, ACTION_DENY, p.Evaluate(req).Action)
+	req.Repository = "secrets/app"
+	assert.Equal(t, ACTION_ALLOW, p.Evaluate(req).Action)
+
+	writePolicy(t, file, "rules:\n- action: block\n")
+	_, err = LoadPolicy(file)
+	assert.NotNil(t, err)
+}
+
+func TestEngineReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, file, "default: deny\n")
+	e, err := NewEngine(file)
+	assert.Nil(t, err)
+
+	req := &Request{ClientIP: net.ParseIP("10.0.0.1"), Method: "GET"}
+	assert.Equal(t, ACTION_DENY, e.Evaluate(req).Action)
+
+	// applied on the next reload only
+	writePolicy(t, file, "default: allow\nrules: []\n")
+	assert.Equal(t, ACTION_DENY, e.Evaluate(req).Action)
+	assert.Nil(t, e.Reload())
+	assert.Equal(t, ACTION_ALLOW, e.Evaluate(req).Action)
+
+	// invalid files are ignored
+	writePolicy(t, file, "default: maybe\nrules: [] # invalid\n")
+	assert.Nil(t, e.Reload())
+	assert.Equal(t, ACTION_ALLOW, e.Evaluate(req).Action)
+}
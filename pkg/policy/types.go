@@ -0,0 +1,110 @@
+package policy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ACTION_ALLOW = "allow"
+	ACTION_DENY  = "deny"
+	// the request is relayed to the upstream, the cache isn't used
+	ACTION_PASSTHROUGH = "passthrough"
+	// cached files are served, the missing ones aren't stored
+	ACTION_NOCACHE = "nocache"
+
+	// name of the decisions taken without a matching rule
+	DEFAULT_RULE = "default"
+
+	DEFAULT_WEBHOOK_TIMEOUT = 5 * time.Second
+	// verdicts kept in memory, the expired ones are dropped when it's full
+	WEBHOOK_MAX_ENTRIES = 100000
+)
+
+// Rules are evaluated in order, the first matching rule decides the action. Empty fields match any request
+type Policy struct {
+	Default string  `yaml:"default"`
+	Rules   []*Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Name  string   `yaml:"name"`
+	CIDRs []string `yaml:"cidrs"`
+	// glob patterns of the identities of the authenticated clients
+	Identities []string `yaml:"identities"`
+	Groups     []string `yaml:"groups"`
+	// glob patterns of the Host header sent by the clients
+	Hosts        []string `yaml:"hosts"`
+	Repositories []string `yaml:"repositories"`
+	Methods      []string `yaml:"methods"`
+	// layer or manifest
+	ItemTypes []string `yaml:"itemTypes"`
+	Action    string   `yaml:"action"`
+
+	networks []*net.IPNet
+}
+
+// Attributes of a request matched by the rules
+type Request struct {
+	ClientIP   net.IP
+	Identity   string
+	Groups     []string
+	Host       string
+	Repository string
+	Method     string
+	ItemType   string
+}
+
+type Decision struct {
+	Rule   string
+	Action string
+}
+
+// Engine evaluates the policy of a file, reloaded by Reload when the file changes
+type Engine struct {
+	path   string
+	policy *Policy
+	// modTime and size are used only by Reload
+	modTime time.Time
+	size    int64
+	lock    sync.RWMutex
+	log     *logrus.Entry
+}
+
+// Pull described to the authorization webhook
+type Pull struct {
+	Identity   string `json:"identity"`
+	ClientIP   string `json:"clientIP"`
+	Host       string `json:"host"` // upstream host
+	Repository string `json:"repository"`
+	// tag or digest of a manifest
+	Reference string `json:"reference,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// Answer of the authorization webhook, the action is allow, deny or passthrough
+type Verdict struct {
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Webhook asks an external service to authorize the pulls, the verdicts are cached for ttl
+type Webhook struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+	// allow the pulls when the service is unreachable
+	failOpen bool
+	verdicts map[Pull]webhookEntry
+	lock     sync.RWMutex
+	log      *logrus.Entry
+}
+
+type webhookEntry struct {
+	verdict Verdict
+	expires time.Time
+}
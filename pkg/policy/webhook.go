@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Verdicts aren't cached if ttl is 0, the timeout of the requests is the one of the client
+func NewWebhook(url string, client *http.Client, ttl time.Duration, failOpen bool) *Webhook {
+	return &Webhook{
+		url:      url,
+		client:   client,
+		ttl:      ttl,
+		failOpen: failOpen,
+		verdicts: make(map[Pull]webhookEntry),
+		log:      logrus.WithField("name", "webhook"),
+	}
+}
+
+// Pull of a manifest or a blob, the request must be rewritten for the upstream
+func NewPull(r *http.Request) (Pull, bool) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return Pull{}, false
+	}
+
+	p := Pull{
+		Host:       r.URL.Host,
+		Repository: cache.ComputeRepository(r.URL.Path),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		p.ClientIP = host
+	}
+	if id := auth.GetIdentity(r); id != nil {
+		p.Identity = id.Name
+	}
+
+	switch {
+	case cache.REGEX_LAYER.MatchString(r.URL.Path):
+		p.Digest = cache.DIGEST_PREFIX + cache.REGEX_LAYER.FindStringSubmatch(r.URL.Path)[1]
+	case cache.REGEX_MANIFEST.MatchString(r.URL.Path):
+		p.Digest = cache.DIGEST_PREFIX + cache.REGEX_MANIFEST.FindStringSubmatch(r.URL.Path)[1]
+		p.Reference = p.Digest
+	case cache.REGEX_TAG.MatchString(r.URL.Path):
+		p.Reference = cache.REGEX_TAG.FindStringSubmatch(r.URL.Path)[1]
+	default:
+		return Pull{}, false
+	}
+	return p, true
+}
+
+// Verdict of the webhook for a pull, allow or deny according to the fail mode if the service can't answer
+func (w *Webhook) Check(p Pull) Verdict {
+
+	w.lock.RLock()
+	entry, ok := w.verdicts[p]
+	w.lock.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		metrics.WebhookRequests.WithLabelValues("cached").Inc()
+		return entry.verdict
+	}
+
+	v, err := w.request(p)
+	if err != nil {
+		metrics.WebhookRequests.WithLabelValues("failed").Inc()
+		w.log.Errorf("authorization of %s/%s failed: %v", p.Host, p.Repository, err)
+
+		v = Verdict{Action: ACTION_DENY, Reason: "authorization service unavailable"}
+		if w.failOpen {
+			v.Action = ACTION_ALLOW
+		}
+		return v
+	}
+	metrics.WebhookRequests.WithLabelValues(v.Action).Inc()
+
+	w.store(p, v)
+	return v
+}
+
+func (w *Webhook) request(p Pull) (Verdict, error) {
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+
+	v := Verdict{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&v)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("invalid webhook response: %v", err)
+	}
+	switch v.Action {
+	case ACTION_ALLOW, ACTION_DENY, ACTION_PASSTHROUGH:
+		return v, nil
+	}
+	return Verdict{}, fmt.Errorf("invalid webhook action '%s'", v.Action)
+}
+
+func (w *Webhook) store(p Pull, v Verdict) {
+
+	if w.ttl <= 0 {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.verdicts) >= WEBHOOK_MAX_ENTRIES {
+		now := time.Now()
+		for k, e := range w.verdicts {
+			if now.After(e.expires) {
+				delete(w.verdicts, k)
+			}
+		}
+	}
+	if len(w.verdicts) >= WEBHOOK_MAX_ENTRIES {
+		return
+	}
+	w.verdicts[p] = webhookEntry{verdict: v, expires: time.Now().Add(w.ttl)}
+}
@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPull(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	r := httptest.NewRequest("GET", "https://registry.local/v2/library/alpine/blobs/sha256:"+digest, nil)
+	r = r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{Name: "alice"}))
+
+	p, ok := NewPull(r)
+	assert.True(t, ok)
+	assert.Equal(t, Pull{Identity: "alice", ClientIP: "192.0.2.1", Host: "registry.local", Repository: "library/alpine", Digest: "sha256:" + digest}, p)
+
+	p, _ = NewPull(httptest.NewRequest("HEAD", "https://registry.local/v2/library/alpine/manifests/3.18", nil))
+	assert.Equal(t, "3.18", p.Reference)
+
+	_, ok = NewPull(httptest.NewRequest("GET", "https://registry.local/v2/", nil))
+	assert.False(t, ok)
+}
+
+func TestWebhook(t *testing.T) {
+	requests := &atomic.Int32{}
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		p := Pull{}
+		json.NewDecoder(r.Body).Decode(&p)
+		action := ACTION_ALLOW
+		if strings.HasPrefix(p.Repository, "private/") {
+			action = ACTION_DENY
+		}
+		fmt.Fprintf(w, `{"action": "%s", "reason": "repository %s"}`, action, p.Repository)
+	}))
+
+	w := NewWebhook(service.URL, service.Client(), time.Minute, false)
+	assert.Equal(t, ACTION_ALLOW, w.Check(Pull{Repository: "library/alpine"}).Action)
+	assert.Equal(t, Verdict{Action: ACTION_DENY, Reason: "repository private/app"}, w.Check(Pull{Repository: "private/app"}))
+
+	// cached for the ttl
+	w.Check(Pull{Repository: "library/alpine"})
+	assert.Equal(t, int32(2), requests.Load())
+
+	// unreachable
+	service.Close()
+	assert.Equal(t, ACTION_DENY, w.Check(Pull{Repository: "library/busybox"}).Action)
+	w.failOpen = true
+	assert.Equal(t, ACTION_ALLOW, w.Check(Pull{Repository: "library/busybox"}).Action)
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/sirupsen/logrus"
+)
+
+var manifestAccept = strings.Join([]string{
+	cache.MEDIA_TYPE_OCI_INDEX,
+	cache.MEDIA_TYPE_DOCKER_MANIFEST_LIST,
+	cache.MEDIA_TYPE_OCI_MANIFEST,
+	cache.MEDIA_TYPE_DOCKER_MANIFEST,
+}, ", ")
+
+func NewPrefetcher(p *Proxy) *Prefetcher {
+	return &Prefetcher{
+		proxy: p,
+		jobs:  make([]*PrefetchJob, 0),
+		log:   logrus.WithField("name", "prefetcher"),
+	}
+}
+
+// Split an image reference ([host/]repository[:tag|@digest]), the host is empty if the reference doesn't have one
+func ParseImage(image string) (string, string, string, error) {
+
+	name, reference := image, DEFAULT_TAG
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, reference = name[:i], name[i+1:]
+		if _, ok := cache.ComputeDigestKey(reference); !ok {
+			return "", "", "", fmt.Errorf("invalid digest in image %s", image)
+		}
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, reference = name[:i], name[i+1:]
+	}
+
+	// the first component is a host if it looks like one (e.g.: quay.io, localhost:5000)
+	host := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, name = first, name[i+1:]
+		}
+	}
+
+	if name == "" || reference == "" {
+		return "", "", "", fmt.Errorf("invalid image %s", image)
+	}
+	return host, name, reference, nil
+}
+
+// Start a prefetch in background, the requests are authorized like the ones of the client with identity and remoteAddr
+// and the authorization is sent to the upstream. Images indexes are filtered by platform, if not empty
+func (pf *Prefetcher) Start(image, platform, authorization, remoteAddr string, identity *auth.Identity) (PrefetchJob, error) {
+
+	host, repository, reference, err := ParseImage(image)
+	if err != nil {
+		return PrefetchJob{}, err
+	}
+	if platform != "" {
+		if _, err := cache.ParsePlatform(platform); err != nil {
+			return PrefetchJob{}, err
+		}
+	}
+
+	pf.lock.Lock()
+	pf.next++
+	job := &PrefetchJob{
+		ID:            pf.next,
+		Image:         image,
+		Platform:      platform,
+		Status:        PREFETCH_RUNNING,
+		Started:       time.Now(),
+		host:          host,
+		repository:    repository,
+		reference:     reference,
+		authorization: authorization,
+		remoteAddr:    remoteAddr,
+		identity:      identity,
+	}
+	pf.jobs = append(pf.jobs, job)
+	pf.trim()
+	snapshot := *job
+	pf.lock.Unlock()
+
+	pf.log.Infof("prefetching %s (job %d)", image, job.ID)
+	go pf.run(job)
+
+	return snapshot, nil
+}
+
+// Drop the oldest finished jobs
+func (pf *Prefetcher) trim() {
+	for i := 0; i < len(pf.jobs) && len(pf.jobs) > PREFETCH_MAX_JOBS; {
+		if pf.jobs[i].Status == PREFETCH_RUNNING {
+			i++
+			continue
+		}
+		pf.jobs = append(pf.jobs[:i], pf.jobs[i+1:]...)
+	}
+}
+
+func (pf *Prefetcher) Job(id int) (PrefetchJob, bool) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+
+	for _, job := range pf.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return PrefetchJob{}, false
+}
+
+func (pf *Prefetcher) Jobs() []PrefetchJob {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+
+	jobs := make([]PrefetchJob, 0, len(pf.jobs))
+	for _, job := range pf.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (pf *Prefetcher) update(fn func()) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	fn()
+}
+
+func (pf *Prefetcher) run(job *PrefetchJob) {
+
+	blobs, err := pf.resolve(job)
+	if err != nil {
+		pf.finish(job, err)
+		return
+	}
+	pf.update(func() { job.Blobs = len(blobs) })
+
+	sem := make(chan struct{}, PREFETCH_CONCURRENCY)
+	wg := &sync.WaitGroup{}
+	for _, digest := range blobs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(digest string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			size, err := pf.fetchBlob(job, digest)
+			pf.update(func() {
+				if err != nil {
+					job.Failed++
+					job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", digest, err))
+					return
+				}
+				job.Done++
+				job.Bytes += size
+			})
+		}(digest)
+	}
+	wg.Wait()
+
+	pf.finish(job, nil)
+}
+
+func (pf *Prefetcher) finish(job *PrefetchJob, err error) {
+
+	pf.lock.Lock()
+	job.Finished = time.Now()
+	job.Status = PREFETCH_DONE
+	if err != nil {
+		job.Errors = append(job.Errors, err.Error())
+	}
+	if err != nil || job.Failed > 0 {
+		job.Status = PREFETCH_FAILED
+	}
+	// the credentials of the client aren't kept with the finished jobs
+	job.authorization = ""
+	snapshot := *job
+	pf.lock.Unlock()
+
+	pf.log.Infof(
+		"prefetch of %s %s: %d/%d blobs (%d bytes) in %s",
+		snapshot.Image,
+		snapshot.Status,
+		snapshot.Done,
+		snapshot.Blobs,
+		snapshot.Bytes,
+		snapshot.Finished.Sub(snapshot.Started),
+	)
+}
+
+// Fetch the manifest of the image, and the ones of the platforms of an image index,
+// returns the digests of the blobs they reference
+func (pf *Prefetcher) resolve(job *PrefetchJob) ([]string, error) {
+
+	var platform *cache.Platform
+	if job.Platform != "" {
+		platform, _ = cache.ParsePlatform(job.Platform)
+	}
+
+	blobs := make([]string, 0)
+	seen := make(map[string]bool)
+	queue := []string{job.reference}
+	for len(queue) > 0 {
+		reference := queue[0]
+		queue = queue[1:]
+
+		content, digest, err := pf.fetchManifest(job, reference)
+		if err != nil {
+			return nil, err
+		}
+
+		// tags aren't cached, fetch the manifest by digest so that it's stored
+		if _, isDigest := cache.ComputeDigestKey(reference); !isDigest {
+			if _, ok := cache.ComputeDigestKey(digest); ok {
+				queue = append(queue, digest)
+				continue
+			}
+		}
+		pf.update(func() { job.Manifests++ })
+
+		m := &cache.Manifest{}
+		err = json.Unmarshal(content, m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s: %v", reference, err)
+		}
+
+		matched := 0
+		for _, d := range m.Manifests {
+			if platform != nil && !platform.Match(d) {
+				continue
+			}
+			queue = append(queue, d.Digest)
+			matched++
+		}
+		if len(m.Manifests) > 0 && matched == 0 {
+			return nil, fmt.Errorf("no manifest found for platform %s", job.Platform)
+		}
+
+		refs := m.Layers
+		if m.Config != nil {
+			refs = append(refs, *m.Config)
+		}
+		for _, d := range refs {
+			if _, ok := cache.ComputeDigestKey(d.Digest); ok && !seen[d.Digest] {
+				seen[d.Digest] = true
+				blobs = append(blobs, d.Digest)
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
+// Content and digest of a manifest
+func (pf *Prefetcher) fetchManifest(job *PrefetchJob, reference string) ([]byte, string, error) {
+
+	resp, err := pf.get(job, fmt.Sprintf("/v2/%s/manifests/%s", job.repository, reference), manifestAccept)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch manifest %s: %v", reference, err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, pin.MAX_MANIFEST_SIZE))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest %s: %v", reference, err)
+	}
+	return content, resp.Header.Get(HEADER_DOCKER_DIGEST), nil
+}
+
+// Pull a blob so that it's stored in the cache, returns the bytes read
+func (pf *Prefetcher) fetchBlob(job *PrefetchJob, digest string) (int64, error) {
+
+	resp, err := pf.get(job, fmt.Sprintf("/v2/%s/blobs/%s", job.repository, digest), "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(io.Discard, resp.Body)
+}
+
+// Send a request through the access policy, the upstream rules, the webhook and the worker, like the ones of the clients.
+// Redirects to the storage backend are followed
+func (pf *Prefetcher) get(job *PrefetchJob, path, accept string) (*http.Response, error) {
+
+	r, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Host = job.host
+	r.RemoteAddr = job.remoteAddr
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if job.authorization != "" {
+		r.Header.Set("Authorization", job.authorization)
+	}
+	log := pf.log
+	if job.identity != nil {
+		r = r.WithContext(auth.WithIdentity(r.Context(), job.identity))
+		log = log.WithField("identity", job.identity.Name)
+	}
+
+	decision, err := pf.proxy.evaluatePolicy(r, log)
+	if err != nil {
+		return nil, err
+	}
+	cr, _, _, err := pf.proxy.authorize(r, decision, log)
+	if err != nil {
+		return nil, err
+	}
+	pf.proxy.worker.Push(cr)
+	resp := (<-cr.Response).Response
+
+	if resp.StatusCode == http.StatusTemporaryRedirect {
+		resp.Body.Close()
+		resp, err = http.Get(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("non-200 response: %v", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Admin API to prefetch images:
+// POST starts the prefetch of the image parameter (optionally filtered by platform),
+// GET returns the progress of the job in the id parameter or of all the jobs
+func (pf *Prefetcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		var body interface{} = pf.Jobs()
+		if id := query.Get("id"); id != "" {
+			n, _ := strconv.Atoi(id)
+			job, ok := pf.Job(n)
+			if !ok {
+				http.Error(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+				return
+			}
+			body = job
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	case http.MethodPost:
+		// the admin server has authenticated the client, its credentials have been removed
+		job, err := pf.Start(query.Get("image"), query.Get("platform"), r.Header.Get("Authorization"), r.RemoteAddr, auth.GetIdentity(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
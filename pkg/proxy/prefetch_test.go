@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/ish-xyz/registry-cache/pkg/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func digestOf(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+func TestParseImage(t *testing.T) {
+	host, repository, reference, err := ParseImage("quay.io/coreos/etcd:v3.5")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"quay.io", "coreos/etcd", "v3.5"}, []string{host, repository, reference})
+
+	host, repository, reference, _ = ParseImage("localhost:5000/app")
+	assert.Equal(t, []string{"localhost:5000", "app", DEFAULT_TAG}, []string{host, repository, reference})
+
+	digest := digestOf("manifest")
+	host, repository, reference, _ = ParseImage("library/alpine@" + digest)
+	assert.Equal(t, []string{"", "library/alpine", digest}, []string{host, repository, reference})
+
+	_, _, _, err = ParseImage("library/alpine@sha256:abc")
+	assert.NotNil(t, err)
+}
+
+func TestPrefetchImageIndex(t *testing.T) {
+
+	config, layer, armLayer := "config", "layer", "arm layer"
+	manifest := fmt.Sprintf(`{"config": {"digest": "%s"}, "layers": [{"digest": "%s"}]}`, digestOf(config), digestOf(layer))
+	armManifest := fmt.Sprintf(`{"config": {"digest": "%s"}, "layers": [{"digest": "%s"}]}`, digestOf(config), digestOf(armLayer))
+	index := fmt.Sprintf(
+		`{"manifests": [{"digest": "%s", "platform": {"os": "linux", "architecture": "amd64"}}, {"digest": "%s", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		digestOf(manifest), digestOf(armManifest),
+	)
+
+	contents := map[string]string{
+		"/v2/app/manifests/v1": index,
+	}
+	for _, c := range []string{index, manifest, armManifest} {
+		contents["/v2/app/manifests/"+digestOf(c)] = c
+	}
+	for _, c := range []string{config, layer, armLayer} {
+		contents["/v2/app/blobs/"+digestOf(c)] = c
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := contents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(HEADER_DOCKER_DIGEST, digestOf(content))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+	upstreamUrl, _ := url.Parse(upstream.URL)
+
+	dataPath := t.TempDir()
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, dataPath, eviction.NewLRU())
+	wk := worker.NewWorker(c, idx, upstream.Client(), worker.Options{})
+	wk.Start(2)
+
+	p := NewProxy(wk, "", dataPath, upstreamUrl.Host, upstreamUrl.Scheme, "", "", nil, Options{})
+	pf := NewPrefetcher(p)
+
+	job, err := pf.Start("app:v1", "linux/amd64", "", "", nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100 && job.Status == PREFETCH_RUNNING; i++ {
+		time.Sleep(50 * time.Millisecond)
+		job, _ = pf.Job(job.ID)
+	}
+
+	assert.Equal(t, PREFETCH_DONE, job.Status)
+	assert.Equal(t, 2, job.Manifests)
+	assert.Equal(t, 2, job.Done)
+	assert.Equal(t, int64(len(config)+len(layer)), job.Bytes)
+
+	for _, c := range []string{index, manifest, config, layer} {
+		assert.Equal(t, cache.STATUS_AVAILABLE, idx.GetStatus(cache.CacheKey(strings.TrimPrefix(digestOf(c), "sha256:"))))
+	}
+	assert.Equal(t, cache.STATUS_NOT_FOUND, idx.GetStatus(cache.CacheKey(strings.TrimPrefix(digestOf(armLayer), "sha256:"))))
+}
+
+func TestPrefetchDeniedByPolicy(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("denied prefetch reached the upstream: %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+	upstreamUrl, _ := url.Parse(upstream.URL)
+
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(file, []byte("default: allow\nrules:\n- name: secret\n  repositories: [\"secret/*\"]\n  action: deny\n"), 0600)
+	engine, err := policy.NewEngine(file)
+	assert.Nil(t, err)
+
+	dataPath := t.TempDir()
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, dataPath, eviction.NewLRU())
+	wk := worker.NewWorker(c, idx, upstream.Client(), worker.Options{})
+	wk.Start(1)
+
+	p := NewProxy(wk, "", dataPath, upstreamUrl.Host, upstreamUrl.Scheme, "", "", nil, Options{Policy: engine})
+	pf := NewPrefetcher(p)
+
+	job, err := pf.Start("secret/app:v1", "", "Basic YWRtaW46c2VjcmV0", "127.0.0.1:1234", &auth.Identity{Name: "admin"})
+	assert.Nil(t, err)
+
+	for i := 0; i < 100 && job.Status == PREFETCH_RUNNING; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = pf.Job(job.ID)
+	}
+
+	assert.Equal(t, PREFETCH_FAILED, job.Status)
+	assert.Contains(t, job.Errors[0], "denied by rule 'secret'")
+	assert.Empty(t, job.authorization)
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,13 +12,19 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/ish-xyz/registry-cache/pkg/auth"
 	"github.com/ish-xyz/registry-cache/pkg/cache"
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/ish-xyz/registry-cache/pkg/token"
 
 	"github.com/ish-xyz/registry-cache/pkg/worker"
 	"github.com/sirupsen/logrus"
 )
 
+// Token requests of the rules rewriting the realm are served with tokens,
+// clients are authenticated by clientAuth, requests are checked by policyEngine
+// and pulls are authorized by webhook if they aren't nil
 func NewProxy(
 	wk *worker.Worker,
 	addr,
@@ -27,6 +34,7 @@ func NewProxy(
 	cPath,
 	kPath string,
 	urules []*UpstreamRule,
+	opts Options,
 ) *Proxy {
 
 	return &Proxy{
@@ -43,25 +51,56 @@ func NewProxy(
 		upstreamRules: urules,
 		tlsCertPath:   cPath,
 		tlsKeyPath:    kPath,
+		tokens:        opts.Tokens,
+		clientAuth:    opts.ClientAuth,
+		policy:        opts.Policy,
+		webhook:       opts.Webhook,
 		log:           logrus.WithField("name", "proxy"),
 	}
 }
 
-func NewUpstreamRule(host, scheme, regex string) (*UpstreamRule, error) {
+// The proxy authenticates with the upstream itself if credentials isn't nil
+func NewUpstreamRule(host, scheme, regex string, rewriteRealm bool, credentials token.Credentials) (*UpstreamRule, error) {
 	re, err := regexp.Compile(regex)
 	if err != nil {
 		return nil, err
 	}
 
 	return &UpstreamRule{
-		host:   host,
-		scheme: scheme,
-		regex:  re,
+		host:         host,
+		scheme:       scheme,
+		regex:        re,
+		rewriteRealm: rewriteRealm,
+		credentials:  credentials,
 	}, nil
 }
 
-// Rewrite request from client for the upstream registry
-func (p *Proxy) rewriteRequest(r *http.Request) {
+func (u *UpstreamRule) RewriteRealm() bool {
+	return u.rewriteRealm
+}
+
+func (u *UpstreamRule) Credentials() token.Credentials {
+	return u.credentials
+}
+
+// Replace the upstream rules and the default backend, the requests in flight keep the previous ones
+func (p *Proxy) SetUpstreamRules(urules []*UpstreamRule, defaultBackendHost, defaultBackendScheme string) {
+	p.rulesLock.Lock()
+	defer p.rulesLock.Unlock()
+
+	p.upstreamRules = urules
+	p.defaultBackend.Host = defaultBackendHost
+	p.defaultBackend.Schema = defaultBackendScheme
+	p.log.Infof("loaded %d upstream rules", len(urules))
+}
+
+// Rewrite request from client for the upstream registry, returns the matching rule
+func (p *Proxy) rewriteRequest(r *http.Request) *UpstreamRule {
+
+	p.rulesLock.RLock()
+	upstreamRules := p.upstreamRules
+	defaultBackend := p.defaultBackend
+	p.rulesLock.RUnlock()
 
 	// DO NOT REMOVE
 	// http: Request.RequestURI can't be set in client/proxy requests.
@@ -76,7 +115,7 @@ func (p *Proxy) rewriteRequest(r *http.Request) {
 
 	r.Header.Set(HEADER_ORIGINAL_HOST, r.Host)
 
-	for i, cfg := range p.upstreamRules {
+	for i, cfg := range upstreamRules {
 
 		if !cfg.regex.MatchString(r.Host) {
 			p.log.Debugf("requested host '%s' doesn't match regex '%s' in rule '%d', skipping.", r.Host, cfg.regex, i)
@@ -94,14 +133,24 @@ func (p *Proxy) rewriteRequest(r *http.Request) {
 		r.URL.Host = upstreamHost
 		r.Host = upstreamHost
 
+		if cfg.credentials != nil {
+			authorization, err := cfg.credentials.Authorization(upstreamHost)
+			if err != nil {
+				p.log.Warningf("failed to get credentials of '%s', using the ones of the client: %v", upstreamHost, err)
+			} else {
+				r.Header.Set("Authorization", authorization)
+			}
+		}
+
 		p.log.Debugf("new destination set '%s'", upstreamHost)
-		return
+		return cfg
 	}
 
 	// no match, set default backend
-	r.URL.Scheme = p.defaultBackend.Schema
-	r.URL.Host = p.defaultBackend.Host
-	r.Host = p.defaultBackend.Host
+	r.URL.Scheme = defaultBackend.Schema
+	r.URL.Host = defaultBackend.Host
+	r.Host = defaultBackend.Host
+	return nil
 }
 
 // Proxy entrypoint
@@ -114,11 +163,35 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logrus.Tracef("request: %+v", r)
-	p.rewriteRequest(r) // rewrite request for upstream
-	logrus.Tracef("rewritten request: %+v", r)
+	log := p.log
+	if p.clientAuth != nil {
+		identity, err := p.clientAuth.Authenticate(r)
+		if err != nil {
+			p.unauthorized(w, r, err)
+			return
+		}
+		metrics.ClientRequests.WithLabelValues(identity.Name, identity.Method).Inc()
+		r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+		log = log.WithField("identity", identity.Name)
+	}
 
-	cr := cache.NewCacheRequest(r, p.dataPath) //TODO: datapath should be in the cache object only
+	decision, err := p.evaluatePolicy(r, log)
+	if err != nil {
+		writeRegistryError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied", map[string]string{"rule": decision.Rule})
+		return
+	}
+
+	if r.URL.Path == token.TOKEN_PATH {
+		p.serveToken(w, r)
+		return
+	}
+
+	logrus.Tracef("request: %+v", r)
+	cr, rule, verdict, err := p.authorize(r, decision, log)
+	if err != nil {
+		writeRegistryError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied", map[string]string{"reason": verdict.Reason})
+		return
+	}
 	logrus.Tracef("cache request: %+v", cr)
 
 	p.worker.Push(cr)
@@ -132,13 +205,17 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if rule != nil && rule.rewriteRealm {
+		p.rewriteChallenge(cresp.Response, cr.Host, r.Header.Get(HEADER_ORIGINAL_HOST))
+	}
+
 	metrics.ActiveClientsConn.Add(1)
-	err := p.streamResponse(w, cresp.Response, cresp.Origin == cache.ORIGIN_CACHE)
+	err = p.streamResponse(w, cresp.Response, cresp.Origin == cache.ORIGIN_CACHE)
 	metrics.ActiveClientsConn.Add(-1)
 
 	if err != nil {
 		metrics.FailedRequests.WithLabelValues(STREAMING_ERROR, cr.Request.URL.Path).Inc()
-		p.log.Errorf(
+		log.Errorf(
 			"(%s) [%s - %s %s%s, err: %v]",
 			cresp.Origin,
 			cresp.Response.Status,
@@ -147,9 +224,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			cresp.Response.Request.URL.Path,
 			err,
 		)
+
+		// abort the response, so that the client doesn't take
+		// 	a truncated or unverified body as complete
+		if cresp.Origin == cache.ORIGIN_CACHE {
+			panic(http.ErrAbortHandler)
+		}
 	}
 
-	p.log.Infof(
+	log.Infof(
 		"(%s) [%s - %s %s%s]",
 		cresp.Origin,
 		cresp.Response.Status,
@@ -159,6 +242,73 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
+// Decision of the access policy, an error is returned if the request is denied
+func (p *Proxy) evaluatePolicy(r *http.Request, log *logrus.Entry) (policy.Decision, error) {
+
+	decision := policy.Decision{Action: policy.ACTION_ALLOW}
+	if p.policy == nil {
+		return decision, nil
+	}
+
+	decision = p.policy.Evaluate(policy.NewRequest(r))
+	metrics.PolicyDecisions.WithLabelValues(decision.Rule, decision.Action).Inc()
+	if decision.Action == policy.ACTION_DENY {
+		log.Warningf("request %s %s%s from %s denied by rule '%s'", r.Method, r.Host, r.URL.Path, r.RemoteAddr, decision.Rule)
+		return decision, fmt.Errorf("denied by rule '%s'", decision.Rule)
+	}
+	return decision, nil
+}
+
+// Rewrite the request for the upstream and authorize the pulls with the webhook,
+// returns the cache request with the action of the policy decision applied, an error if the webhook denied it
+func (p *Proxy) authorize(r *http.Request, decision policy.Decision, log *logrus.Entry) (*cache.CacheRequest, *UpstreamRule, policy.Verdict, error) {
+
+	rule := p.rewriteRequest(r) // rewrite request for upstream
+	logrus.Tracef("rewritten request: %+v", r)
+
+	verdict := policy.Verdict{Action: policy.ACTION_ALLOW}
+	if pull, ok := policy.NewPull(r); ok && p.webhook != nil {
+		verdict = p.webhook.Check(pull)
+		switch verdict.Action {
+		case policy.ACTION_DENY:
+			log.Warningf("pull %s/%s from %s denied by the webhook: %s", pull.Host, pull.Repository, r.RemoteAddr, verdict.Reason)
+			return nil, rule, verdict, fmt.Errorf("denied by the webhook: %s", verdict.Reason)
+		case policy.ACTION_PASSTHROUGH:
+			decision.Action = policy.ACTION_PASSTHROUGH
+		}
+	}
+
+	cr := cache.NewCacheRequest(r, p.dataPath) //TODO: datapath should be in the cache object only
+	switch decision.Action {
+	case policy.ACTION_PASSTHROUGH:
+		cr.CacheEnabled = false
+		cr.Tag = ""
+	case policy.ACTION_NOCACHE:
+		cr.NoStore = true
+	}
+	return cr, rule, verdict, nil
+}
+
+// Reject a client that isn't authenticated with a registry error
+func (p *Proxy) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+
+	metrics.ClientAuthFailures.Inc()
+	p.log.Warningf("client %s not authenticated for %s: %v", r.RemoteAddr, r.URL.Path, err)
+
+	if challenge := p.clientAuth.Challenge(); challenge != "" {
+		w.Header().Set(token.HEADER_WWW_AUTHENTICATE, challenge)
+	}
+	writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required", nil)
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string, detail interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]registryError{
+		"errors": {{Code: code, Message: message, Detail: detail}},
+	})
+}
+
 // Start proxy
 func (p *Proxy) Start(workers int, debug bool, wg *sync.WaitGroup) *http.Server {
 
@@ -172,6 +322,9 @@ func (p *Proxy) Start(workers int, debug bool, wg *sync.WaitGroup) *http.Server
 		Handler:           p,
 		ReadHeaderTimeout: 5 * time.Second, // prevent slowloris
 	}
+	if p.clientAuth != nil {
+		srv.TLSConfig = p.clientAuth.TLSConfig()
+	}
 
 	go func() {
 		defer wg.Done()
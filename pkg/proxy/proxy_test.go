@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
 	"github.com/ish-xyz/registry-cache/pkg/worker"
 	"github.com/stretchr/testify/assert"
 )
@@ -22,7 +24,7 @@ func getUpstreamRules(rules []map[string]string) ([]*UpstreamRule, error) {
 	var urules = make([]*UpstreamRule, 0)
 	for _, r := range rules {
 
-		u, err := NewUpstreamRule(r["host"], r["scheme"], r["regex"])
+		u, err := NewUpstreamRule(r["host"], r["scheme"], r["regex"], r["rewriteRealm"] == "true", nil)
 		if err != nil {
 			return nil, err
 		}
@@ -57,8 +59,8 @@ func TestIntegrationFullOK(t *testing.T) {
 	}
 
 	indexObj := cache.NewMemoryIndex()
-	cacheObj := cache.NewCache(indexObj, dataPath)
-	workerObj := worker.NewWorker(cacheObj, indexObj, testServer.Client(), nil)
+	cacheObj := cache.NewCache(indexObj, dataPath, eviction.NewLRU())
+	workerObj := worker.NewWorker(cacheObj, indexObj, testServer.Client(), worker.Options{})
 	urules, _ := getUpstreamRules(urulesMap)
 
 	proxyObj := NewProxy(
@@ -70,6 +72,7 @@ func TestIntegrationFullOK(t *testing.T) {
 		fmt.Sprintf("%s/../../config/localhost.crt", baseDir),
 		fmt.Sprintf("%s/../../config/localhost.key", baseDir),
 		urules,
+		Options{},
 	)
 
 	proxyDone := &sync.WaitGroup{}
@@ -82,7 +85,7 @@ func TestIntegrationFullOK(t *testing.T) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}}
 
-	req, err := http.NewRequest("GET", "https://localhost:8000/v2/nvidia/cudagl/blobs/sha256:8bd98d4761dc30931a35b249051f59e5deb9a7a3b3dee384fd3b99ca03e792eb", nil)
+	req, err := http.NewRequest("GET", "https://localhost:8000/v2/nvidia/cudagl/blobs/sha256:565339bc4d33d72817b583024112eb7f5cdf3e5eef0252d6ec1b9c9a94e12bb3", nil)
 	if err != nil {
 		panic(err)
 	}
@@ -90,8 +93,8 @@ func TestIntegrationFullOK(t *testing.T) {
 	resp, respErr := cclient.Do(req)
 	resp2, respErr2 := cclient.Do(req)
 
-	ckey := cache.CacheKey("8bd98d4761dc30931a35b249051f59e5deb9a7a3b3dee384fd3b99ca03e792eb")
-	dataFile := cache.DataFile(fmt.Sprintf("%s/%s", dataPath, "8bd98d4761dc30931a35b249051f59e5deb9a7a3b3dee384fd3b99ca03e792eb.layer"))
+	ckey := cache.CacheKey("565339bc4d33d72817b583024112eb7f5cdf3e5eef0252d6ec1b9c9a94e12bb3")
+	dataFile := cache.DataFile(fmt.Sprintf("%s/sha256/56/53/%s", dataPath, "565339bc4d33d72817b583024112eb7f5cdf3e5eef0252d6ec1b9c9a94e12bb3.layer"))
 	fetchedDF, fetchDFErr := indexObj.GetDatafile(ckey)
 	_, statErr := os.Stat(string(dataFile))
 
@@ -106,3 +109,38 @@ func TestIntegrationFullOK(t *testing.T) {
 	// TODO get prometheus metrics
 	// clean up data
 }
+
+func TestPolicyDenied(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(file, []byte("rules:\n- name: no-private\n  repositories: [\"private/*\"]\n  action: deny\n"), 0600)
+	engine, err := policy.NewEngine(file)
+	assert.Nil(t, err)
+
+	p := NewProxy(nil, "", "", "registry", "https", "", "", nil, Options{Policy: engine})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/v2/private/app/manifests/latest", nil))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"errors": [{"code": "DENIED", "message": "requested access to the resource is denied", "detail": {"rule": "no-private"}}]}`, w.Body.String())
+}
+
+func TestSetUpstreamRules(t *testing.T) {
+	p := NewProxy(nil, "", "", "registry", "https", "", "", nil, Options{})
+
+	r := httptest.NewRequest("GET", "http://docker.local/v2/library/alpine/manifests/latest", nil)
+	assert.Nil(t, p.rewriteRequest(r))
+	assert.Equal(t, "registry", r.URL.Host)
+
+	urules, err := getUpstreamRules([]map[string]string{{"host": "registry-1.docker.io", "scheme": "https", "regex": "docker.local"}})
+	assert.Nil(t, err)
+	p.SetUpstreamRules(urules, "default.local", "http")
+
+	r = httptest.NewRequest("GET", "http://docker.local/v2/library/alpine/manifests/latest", nil)
+	assert.NotNil(t, p.rewriteRequest(r))
+	assert.Equal(t, "registry-1.docker.io", r.URL.Host)
+
+	r = httptest.NewRequest("GET", "http://other.local/v2/library/alpine/manifests/latest", nil)
+	assert.Nil(t, p.rewriteRequest(r))
+	assert.Equal(t, "default.local", r.URL.Host)
+	assert.Equal(t, "http", r.URL.Scheme)
+}
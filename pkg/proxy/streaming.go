@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
 	"github.com/sirupsen/logrus"
@@ -21,6 +23,13 @@ func (p *Proxy) streamResponse(w http.ResponseWriter, resp *http.Response, origi
 		}
 	}
 
+	// serve byte ranges for cached files
+	if originCache && resp.StatusCode == http.StatusOK && resp.ContentLength != -1 {
+		if body, ok := resp.Body.(io.ReadSeeker); ok {
+			return p.serveContent(w, resp, body)
+		}
+	}
+
 	// Add status code
 	if resp.StatusCode >= 100 {
 		w.WriteHeader(resp.StatusCode)
@@ -49,6 +58,46 @@ func (p *Proxy) streamResponse(w http.ResponseWriter, resp *http.Response, origi
 	return nil
 }
 
+// Serve cached content honouring Range, If-Range and conditional headers.
+// Responds with 206 Partial Content for single and multi-range requests
+// and with 416 Range Not Satisfiable for invalid ranges
+func (p *Proxy) serveContent(w http.ResponseWriter, resp *http.Response, body io.ReadSeeker) error {
+
+	// Content-Length is set by http.ServeContent based on the requested ranges
+	w.Header().Del("Content-Length")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// blobs are content addressable, use the digest for If-Range and If-None-Match
+	if w.Header().Get("ETag") == "" {
+		if digest := w.Header().Get(HEADER_DOCKER_DIGEST); digest != "" {
+			w.Header().Set("ETag", fmt.Sprintf("%q", digest))
+		}
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	src := &errReadSeeker{ReadSeeker: body}
+	http.ServeContent(cw, resp.Request, "", time.Time{}, src)
+
+	metrics.TotalBytesServedFromCache.Add(float64(cw.written))
+
+	return src.err
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+// record read errors, http.ServeContent doesn't return them
+func (r *errReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
 func lazyStream(dst io.Writer, src io.Reader, totalBytes int64) (written int64, err error) {
 
 	buf := make([]byte, 32*1024) // 32KB buffer
@@ -75,9 +124,12 @@ func lazyStream(dst io.Writer, src io.Reader, totalBytes int64) (written int64,
 				break
 			}
 		}
-		if er != nil && written == totalBytes {
+		if er != nil {
 			if er != io.EOF {
+				// e.g.: the cache fill has been aborted
 				err = er
+			} else if written != totalBytes {
+				err = io.ErrUnexpectedEOF
 			}
 			break
 		}
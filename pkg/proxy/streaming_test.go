@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testContent = "0123456789abcdefghij"
+
+func newCachedResponse(t *testing.T, headers map[string]string) *http.Response {
+
+	fpath := filepath.Join(t.TempDir(), "data.layer")
+	os.WriteFile(fpath, []byte(testContent), 0644)
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/myimage/blobs/sha256:abc", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Body:          f,
+		ContentLength: int64(len(testContent)),
+		Header: http.Header{
+			"Content-Length":     []string{"20"},
+			"Content-Type":       []string{"application/octet-stream"},
+			HEADER_DOCKER_DIGEST: []string{"sha256:abc"},
+		},
+		Request: req,
+	}
+}
+
+func TestStreamFullContent(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+	rec := httptest.NewRecorder()
+
+	err := p.streamResponse(rec, newCachedResponse(t, nil), true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Equal(t, testContent, rec.Body.String())
+}
+
+func TestStreamSingleRange(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+	rec := httptest.NewRecorder()
+
+	err := p.streamResponse(rec, newCachedResponse(t, map[string]string{"Range": "bytes=5-9"}), true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes 5-9/20", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "5", rec.Header().Get("Content-Length"))
+	assert.Equal(t, "56789", rec.Body.String())
+}
+
+func TestStreamMultiRange(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+	rec := httptest.NewRecorder()
+
+	err := p.streamResponse(rec, newCachedResponse(t, map[string]string{"Range": "bytes=0-1,-2"}), true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges"))
+	assert.Contains(t, rec.Body.String(), "Content-Range: bytes 0-1/20")
+	assert.Contains(t, rec.Body.String(), "Content-Range: bytes 18-19/20")
+}
+
+func TestStreamIfRange(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+
+	rec := httptest.NewRecorder()
+	p.streamResponse(rec, newCachedResponse(t, map[string]string{
+		"Range":    "bytes=5-9",
+		"If-Range": `"sha256:abc"`,
+	}), true)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+
+	// the validator doesn't match, send the full content
+	rec = httptest.NewRecorder()
+	p.streamResponse(rec, newCachedResponse(t, map[string]string{
+		"Range":    "bytes=5-9",
+		"If-Range": `"sha256:def"`,
+	}), true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, testContent, rec.Body.String())
+}
+
+func TestStreamRangeNotSatisfiable(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+	rec := httptest.NewRecorder()
+
+	p.streamResponse(rec, newCachedResponse(t, map[string]string{"Range": "bytes=100-200"}), true)
+
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	assert.Equal(t, "bytes */20", rec.Header().Get("Content-Range"))
+}
+
+func TestStreamReadError(t *testing.T) {
+	p := &Proxy{log: logrus.WithField("name", "proxy")}
+
+	// the cached file can be seeked but not read, e.g.: an I/O error of the disk
+	for code, headers := range map[int]map[string]string{
+		http.StatusOK:             nil,
+		http.StatusPartialContent: {"Range": "bytes=5-9"},
+	} {
+		rec := httptest.NewRecorder()
+		resp := newCachedResponse(t, headers)
+		resp.Body.Close()
+		resp.Body = &failingReadSeeker{Seeker: strings.NewReader(testContent)}
+
+		err := p.streamResponse(rec, resp, true)
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+		assert.Equal(t, code, rec.Code)
+		assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	}
+}
+
+type failingReadSeeker struct {
+	io.Seeker
+}
+
+func (r *failingReadSeeker) Read(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (r *failingReadSeeker) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ish-xyz/registry-cache/pkg/token"
+)
+
+// Token endpoint advertised to the clients in place of the upstream realm.
+// Requests are sent to the token service of the upstream matching the host, the tokens are cached per credential.
+// Only the credentials of the clients are exchanged, the rules owning credentials don't serve tokens
+func (p *Proxy) serveToken(w http.ResponseWriter, r *http.Request) {
+
+	rule := p.rewriteRequest(r)
+	if rule == nil || !rule.rewriteRealm || rule.credentials != nil || p.tokens == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	realm, err := p.tokens.Realm(r.URL.Scheme, r.URL.Host)
+	if err != nil {
+		p.log.Warningf("token realm of %s not found: %v", r.URL.Host, err)
+		http.Error(w, "token service not found", http.StatusBadGateway)
+		return
+	}
+
+	// e.g.: OAuth2 requests with refresh tokens aren't cached
+	if r.Method != http.MethodGet {
+		resp, err := p.tokens.Forward(realm, r)
+		if err != nil {
+			p.log.Warningf("token request to %s failed: %v", realm, err)
+			http.Error(w, "token request failed", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	t, err := p.tokens.Fetch(realm, r.URL.Query(), r.Header.Get("Authorization"))
+	var serr *token.ServiceError
+	if errors.As(err, &serr) {
+		w.Header().Set("Content-Type", serr.Header.Get("Content-Type"))
+		w.WriteHeader(serr.StatusCode)
+		w.Write(serr.Body)
+		return
+	}
+	if err != nil {
+		p.log.Warningf("token request to %s failed: %v", realm, err)
+		http.Error(w, "token request failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(t.Body)
+}
+
+// Point the Bearer challenge of the upstream to the token endpoint of the proxy,
+// the upstream realm is kept for the token requests
+func (p *Proxy) rewriteChallenge(resp *http.Response, upstreamHost, originalHost string) {
+
+	if p.tokens == nil || resp.StatusCode != http.StatusUnauthorized {
+		return
+	}
+
+	header := resp.Header.Get(token.HEADER_WWW_AUTHENTICATE)
+	challenge, ok := token.ParseChallenge(header)
+	if !ok {
+		return
+	}
+	p.tokens.SetRealm(upstreamHost, challenge.Realm)
+
+	realm := fmt.Sprintf("https://%s%s", originalHost, token.TOKEN_PATH)
+	resp.Header = resp.Header.Clone()
+	resp.Header.Set(token.HEADER_WWW_AUTHENTICATE, token.RewriteRealm(header, realm))
+}
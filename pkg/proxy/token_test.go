@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/token"
+	"github.com/ish-xyz/registry-cache/pkg/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+const badCredentials = "Basic YmFkOmJhZA=="
+
+// Token service issuing the Authorization header of the request and the scope as token, returns the number of requests.
+// The POST requests get the grant type as token and the bad credentials are denied
+func newTokenService(t *testing.T) (*httptest.Server, *int32) {
+	requests := int32(0)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") == badCredentials {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"details": "incorrect username or password"}`)
+			return
+		}
+		if r.Method == http.MethodPost {
+			r.ParseForm()
+			fmt.Fprintf(w, `{"access_token": "%s", "expires_in": 300}`, r.PostForm.Get("grant_type"))
+			return
+		}
+		fmt.Fprintf(w, `{"token": "%s %s", "expires_in": 300}`, r.Header.Get("Authorization"), r.URL.Query().Get("scope"))
+	}))
+	t.Cleanup(service.Close)
+	return service, &requests
+}
+
+func serveTokenRequest(p *Proxy, method, query, authorization string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://docker.local/token?"+query, body)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestTokenEndpointCredentials(t *testing.T) {
+	service, _ := newTokenService(t)
+	tokens := token.NewCache(service.Client())
+	tokens.SetRealm("registry.local", service.URL)
+
+	rule, err := NewUpstreamRule("registry.local", "https", "docker.local", true, token.NewBasicCredentials("proxy", "secret"))
+	assert.Nil(t, err)
+	p := NewProxy(nil, "", "", "registry", "https", "", "", []*UpstreamRule{rule}, Options{Tokens: tokens})
+
+	// the credentials of the proxy are never exchanged for the clients
+	w := serveTokenRequest(p, "GET", "scope=repository:app:push", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, 0, tokens.Len())
+
+	rule, err = NewUpstreamRule("registry.local", "https", "docker.local", true, nil)
+	assert.Nil(t, err)
+	p.SetUpstreamRules([]*UpstreamRule{rule}, "registry", "https")
+
+	w = serveTokenRequest(p, "GET", "scope=repository:app:pull", "Basic Y2xpZW50OnBhc3M=", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"token": "Basic Y2xpZW50OnBhc3M= repository:app:pull", "expires_in": 300}`, w.Body.String())
+}
+
+func TestRewriteChallenge(t *testing.T) {
+	service, requests := newTokenService(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(token.HEADER_WWW_AUTHENTICATE, fmt.Sprintf(`Bearer realm="%s/auth",service="registry.local",scope="repository:app:pull"`, service.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+	upstreamUrl, _ := url.Parse(upstream.URL)
+
+	idx := cache.NewMemoryIndex()
+	c := cache.NewCache(idx, t.TempDir(), eviction.NewLRU())
+	wk := worker.NewWorker(c, idx, upstream.Client(), worker.Options{})
+	wk.Start(1)
+
+	tokens := token.NewCache(service.Client())
+	rule, err := NewUpstreamRule(upstreamUrl.Host, upstreamUrl.Scheme, "docker.local", true, nil)
+	assert.Nil(t, err)
+	p := NewProxy(wk, "", c.GetDataPath(), "registry", "https", "", "", []*UpstreamRule{rule}, Options{Tokens: tokens})
+
+	// the clients are sent to the proxy for their tokens, the realm of the upstream is kept
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://docker.local/v2/app/manifests/latest", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="https://docker.local/token",service="registry.local",scope="repository:app:pull"`, w.Header().Get(token.HEADER_WWW_AUTHENTICATE))
+	realm, err := tokens.Realm(upstreamUrl.Scheme, upstreamUrl.Host)
+	assert.Nil(t, err)
+	assert.Equal(t, service.URL+"/auth", realm)
+
+	// cached per credential
+	query := "service=registry.local&scope=repository:app:pull"
+	for _, authorization := range []string{"Basic Y2xpZW50OnBhc3M=", "Basic Y2xpZW50OnBhc3M=", "Basic b3RoZXI6cGFzcw=="} {
+		w = serveTokenRequest(p, "GET", query, authorization, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"token": "%s repository:app:pull", "expires_in": 300}`, authorization), w.Body.String())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+	assert.Equal(t, 2, tokens.Len())
+
+	// the OAuth2 requests are proxied as is, and never cached
+	form := "grant_type=refresh_token&refresh_token=identity&service=registry.local"
+	for i := 0; i < 2; i++ {
+		w = serveTokenRequest(p, "POST", "", "", strings.NewReader(form))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"access_token": "refresh_token", "expires_in": 300}`, w.Body.String())
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(requests))
+	assert.Equal(t, 2, tokens.Len())
+
+	// the errors of the token service are relayed to the clients
+	w = serveTokenRequest(p, "GET", query, badCredentials, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"details": "incorrect username or password"}`, w.Body.String())
+
+	w = serveTokenRequest(p, "POST", "", badCredentials, strings.NewReader(form))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"details": "incorrect username or password"}`, w.Body.String())
+	assert.Equal(t, 2, tokens.Len())
+}
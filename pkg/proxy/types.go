@@ -1,9 +1,15 @@
 package proxy
 
 import (
+	"io"
 	"net/http"
 	"regexp"
+	"sync"
+	"time"
 
+	"github.com/ish-xyz/registry-cache/pkg/auth"
+	"github.com/ish-xyz/registry-cache/pkg/policy"
+	"github.com/ish-xyz/registry-cache/pkg/token"
 	"github.com/ish-xyz/registry-cache/pkg/worker"
 	"github.com/sirupsen/logrus"
 )
@@ -11,9 +17,32 @@ import (
 const (
 	HOST_PLACEHOLDER_PREFIX = "$group"
 	HEADER_ORIGINAL_HOST    = "X-ORIGINAL-HOST"
+	HEADER_DOCKER_DIGEST    = "Docker-Content-Digest"
 	STREAMING_ERROR         = "StreamingError"
+
+	// blobs downloaded in parallel by a prefetch job
+	PREFETCH_CONCURRENCY = 4
+	// finished jobs kept for the admin API
+	PREFETCH_MAX_JOBS = 100
+	DEFAULT_TAG       = "latest"
+
+	PREFETCH_RUNNING = "running"
+	PREFETCH_DONE    = "done"
+	PREFETCH_FAILED  = "failed"
 )
 
+// Optional dependencies of the proxy, disabled if nil
+type Options struct {
+	// tokens of the upstreams whose realm is rewritten
+	Tokens *token.Cache
+	// authentication of the clients
+	ClientAuth *auth.Authenticator
+	// access rules of the requests
+	Policy *policy.Engine
+	// external authorization of the pulls
+	Webhook *policy.Webhook
+}
+
 type Proxy struct {
 	worker      *worker.Worker
 	address     string
@@ -26,15 +55,36 @@ type Proxy struct {
 		Host   string
 		Schema string
 	}
+	// guards the upstream rules and the default backend, they're replaced when the config is reloaded
+	rulesLock      sync.RWMutex
 	streamers      int
 	streamingQueue chan *StreamingMessage
-	log            *logrus.Entry
+	// tokens of the upstreams whose realm is rewritten
+	tokens *token.Cache
+	// authentication of the clients, disabled if nil
+	clientAuth *auth.Authenticator
+	// access rules of the requests, disabled if nil
+	policy *policy.Engine
+	// external authorization of the pulls, disabled if nil
+	webhook *policy.Webhook
+	log     *logrus.Entry
 }
 
 type UpstreamRule struct {
 	regex  *regexp.Regexp
 	host   string
 	scheme string
+	// send the clients to the token endpoint of the proxy instead of the upstream realm
+	rewriteRealm bool
+	// sent in place of the credentials of the clients if set
+	credentials token.Credentials
+}
+
+// Error of the registry API, e.g.: {"errors": [{"code": "DENIED", "message": "..."}]}
+type registryError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail"`
 }
 
 type StreamingMessage struct {
@@ -43,3 +93,48 @@ type StreamingMessage struct {
 	OriginCache   bool
 	Error         chan error
 }
+
+// http.ResponseWriter counting the bytes written
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+type errReadSeeker struct {
+	io.ReadSeeker
+	err error
+}
+
+// Prefetcher pulls images through the proxy, so that their blobs land in the cache
+type Prefetcher struct {
+	proxy *Proxy
+	jobs  []*PrefetchJob
+	next  int
+	// guards the jobs and their progress
+	lock sync.Mutex
+	log  *logrus.Entry
+}
+
+// Progress of a prefetch, returned by the admin API
+type PrefetchJob struct {
+	ID        int       `json:"id"`
+	Image     string    `json:"image"`
+	Platform  string    `json:"platform,omitempty"`
+	Status    string    `json:"status"`
+	Manifests int       `json:"manifests"`
+	Blobs     int       `json:"blobs"`
+	Done      int       `json:"done"`
+	Failed    int       `json:"failed"`
+	Bytes     int64     `json:"bytes"`
+	Errors    []string  `json:"errors,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+
+	host          string
+	repository    string
+	reference     string
+	authorization string
+	// client of the admin API, its requests are authorized like the ones of the proxy
+	remoteAddr string
+	identity   *auth.Identity
+}
@@ -0,0 +1,189 @@
+package quota
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+)
+
+// Tracker in front of the next policy, the owner of the files is read from the index.
+// The files of an owner are sorted with a policy of the given type
+func NewTracker(next eviction.Policy, idx cache.Index, policy string, quotas []*Quota) (*Tracker, error) {
+
+	t := &Tracker{
+		next:     next,
+		quotas:   quotas,
+		policies: make(map[string]eviction.Policy),
+		usage:    make(map[string]int64),
+		draining: make(map[string]bool),
+		owners:   make(map[string]string),
+		sizes:    make(map[string]int64),
+		index:    idx,
+	}
+
+	for _, q := range quotas {
+		if _, ok := t.policies[q.Name]; ok {
+			return nil, fmt.Errorf("duplicated quota %s", q.Name)
+		}
+		for _, pattern := range []string{q.Host, q.Repository} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern in quota %s: %v", q.Name, err)
+			}
+		}
+		p, err := eviction.New(policy)
+		if err != nil {
+			return nil, err
+		}
+		t.policies[q.Name] = p
+	}
+
+	return t, nil
+}
+
+func (q *Quota) Match(host, repository string) bool {
+	if q.Host != "" {
+		if ok, _ := path.Match(q.Host, host); !ok {
+			return false
+		}
+	}
+	if q.Repository != "" {
+		if ok, _ := path.Match(q.Repository, repository); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Name of the first quota matching the file, empty if none
+func (t *Tracker) owner(key string) string {
+
+	rf, err := t.index.GetResponseFile(cache.CacheKey(key))
+	if err != nil || rf == nil {
+		return ""
+	}
+	for _, q := range t.quotas {
+		if q.Match(rf.Host, rf.Repository) {
+			return q.Name
+		}
+	}
+	return ""
+}
+
+func (t *Tracker) getQuota(name string) *Quota {
+	for _, q := range t.quotas {
+		if q.Name == name {
+			return q
+		}
+	}
+	return nil
+}
+
+func (t *Tracker) Add(key string, size int64) {
+
+	owner := t.owner(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.next.Add(key, size)
+
+	// the owner of a file doesn't change
+	if old, ok := t.owners[key]; ok {
+		owner = old
+	}
+	if owner == "" {
+		return
+	}
+
+	t.usage[owner] += size - t.sizes[key]
+	t.owners[key] = owner
+	t.sizes[key] = size
+	t.policies[owner].Add(key, size)
+
+	if t.usage[owner] > t.getQuota(owner).MaxSize {
+		t.draining[owner] = true
+	}
+}
+
+func (t *Tracker) Touch(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.next.Touch(key)
+	if owner, ok := t.owners[key]; ok {
+		t.policies[owner].Touch(key)
+	}
+}
+
+func (t *Tracker) Remove(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.next.Remove(key)
+
+	owner, ok := t.owners[key]
+	if !ok {
+		return
+	}
+
+	t.usage[owner] -= t.sizes[key]
+	delete(t.owners, key)
+	delete(t.sizes, key)
+	t.policies[owner].Remove(key)
+
+	if t.usage[owner] <= t.getQuota(owner).TargetSize {
+		delete(t.draining, owner)
+	}
+}
+
+// Victim of the first owner above its quota, or of the next policy
+func (t *Tracker) Victim() (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, q := range t.quotas {
+		if !t.draining[q.Name] {
+			continue
+		}
+		if key, ok := t.policies[q.Name].Victim(); ok {
+			return key, true
+		}
+	}
+	return t.next.Victim()
+}
+
+func (t *Tracker) Len() int {
+	return t.next.Len()
+}
+
+// Names of the quotas exceeded and not yet evicted down to their target size
+func (t *Tracker) OverQuota() []string {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	names := make([]string, 0)
+	for _, q := range t.quotas {
+		if t.draining[q.Name] {
+			names = append(names, q.Name)
+		}
+	}
+	return names
+}
+
+func (t *Tracker) Quotas() []*Quota {
+	return t.quotas
+}
+
+// Size of the evictable files of the quota owner
+func (t *Tracker) Usage(name string) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.usage[name]
+}
@@ -0,0 +1,73 @@
+package quota
+
+import (
+	"testing"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/stretchr/testify/assert"
+)
+
+func addFile(t *Tracker, idx cache.Index, key, host, repository string, size int64) {
+	rf := cache.NewResponseFile(int(size), 200, nil, cache.CacheKey(key))
+	rf.Host = host
+	rf.Repository = repository
+	idx.Put(cache.CacheKey(key), cache.DataFile(key))
+	idx.SetResponseFile(cache.CacheKey(key), rf)
+	t.Add(key, size)
+}
+
+func TestQuotaMatch(t *testing.T) {
+	q := &Quota{Name: "library", Host: "*.docker.io", Repository: "library/*"}
+
+	assert.True(t, q.Match("registry-1.docker.io", "library/alpine"))
+	assert.False(t, q.Match("quay.io", "library/alpine"))
+	assert.False(t, q.Match("registry-1.docker.io", "bitnami/redis"))
+	assert.True(t, (&Quota{Host: "quay.io"}).Match("quay.io", "any/repo"))
+}
+
+func TestOverQuotaEvictedFirst(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+	tracker, err := NewTracker(eviction.NewLRU(), idx, "lru", []*Quota{
+		{Name: "quay", Host: "quay.io", MaxSize: 25, TargetSize: 10},
+	})
+	assert.Nil(t, err)
+
+	addFile(tracker, idx, "docker-1", "registry-1.docker.io", "library/alpine", 10)
+	addFile(tracker, idx, "quay-1", "quay.io", "coreos/etcd", 10)
+	addFile(tracker, idx, "quay-2", "quay.io", "coreos/etcd", 10)
+	assert.Empty(t, tracker.OverQuota())
+
+	// the least used file isn't owned by the quota
+	key, _ := tracker.Victim()
+	assert.Equal(t, "docker-1", key)
+
+	addFile(tracker, idx, "quay-3", "quay.io", "coreos/etcd", 10)
+	assert.Equal(t, []string{"quay"}, tracker.OverQuota())
+	assert.Equal(t, int64(30), tracker.Usage("quay"))
+
+	key, _ = tracker.Victim()
+	assert.Equal(t, "quay-1", key)
+	tracker.Remove(key)
+	// still above the target size
+	assert.Equal(t, []string{"quay"}, tracker.OverQuota())
+
+	key, _ = tracker.Victim()
+	assert.Equal(t, "quay-2", key)
+	tracker.Remove(key)
+	assert.Empty(t, tracker.OverQuota())
+	assert.Equal(t, int64(10), tracker.Usage("quay"))
+
+	key, _ = tracker.Victim()
+	assert.Equal(t, "docker-1", key)
+}
+
+func TestInvalidQuotas(t *testing.T) {
+	idx := cache.NewMemoryIndex()
+
+	_, err := NewTracker(eviction.NewLRU(), idx, "lru", []*Quota{{Name: "a"}, {Name: "a"}})
+	assert.NotNil(t, err)
+
+	_, err = NewTracker(eviction.NewLRU(), idx, "lru", []*Quota{{Name: "a", Repository: "["}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,37 @@
+package quota
+
+import (
+	"sync"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+)
+
+// Quota limits the size of the files pulled from the matching upstream hosts and repositories,
+// empty patterns match everything
+type Quota struct {
+	Name string
+	// glob patterns
+	Host       string
+	Repository string
+	// eviction starts above MaxSize and stops at TargetSize
+	MaxSize    int64
+	TargetSize int64
+}
+
+// Tracker is an eviction policy tracking the usage of every quota owner,
+// the files of the owners above their quota are evicted first
+type Tracker struct {
+	next   eviction.Policy
+	quotas []*Quota
+	// per quota eviction policy, to choose the victim among the files of an owner
+	policies map[string]eviction.Policy
+	usage    map[string]int64
+	// owners being evicted down to their target size
+	draining map[string]bool
+	// quota and size of the tracked files
+	owners map[string]string
+	sizes  map[string]int64
+	index  cache.Index
+	lock   sync.Mutex
+}
@@ -0,0 +1,256 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+func NewCache(client *http.Client) *Cache {
+	return &Cache{
+		client: client,
+		realms: make(map[string]string),
+		tokens: make(map[key]*Token),
+		log:    logrus.WithField("name", "token"),
+	}
+}
+
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("token service returned %d", e.StatusCode)
+}
+
+// Realm of the token service of an upstream registry
+func (c *Cache) SetRealm(host, realm string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.realms[host] = realm
+}
+
+// Realm learned from the challenges of the upstream, or discovered from its /v2/ endpoint
+func (c *Cache) Realm(scheme, host string) (string, error) {
+
+	c.lock.RLock()
+	realm, ok := c.realms[host]
+	c.lock.RUnlock()
+	if ok {
+		return realm, nil
+	}
+
+	resp, err := c.client.Get(fmt.Sprintf("%s://%s/v2/", scheme, host))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	challenge, ok := ParseChallenge(resp.Header.Get(HEADER_WWW_AUTHENTICATE))
+	if resp.StatusCode != http.StatusUnauthorized || !ok {
+		return "", fmt.Errorf("upstream %s doesn't use token authentication", host)
+	}
+
+	c.SetRealm(host, challenge.Realm)
+	return challenge.Realm, nil
+}
+
+// Token for the challenge of an upstream, issued for the credentials of the client
+func (c *Cache) Token(challenge *Challenge, authorization string) (string, error) {
+
+	query := url.Values{}
+	if challenge.Service != "" {
+		query.Set("service", challenge.Service)
+	}
+	if challenge.Scope != "" {
+		query.Set("scope", challenge.Scope)
+	}
+
+	t, err := c.Fetch(challenge.Realm, query, authorization)
+	if err != nil {
+		return "", err
+	}
+	return t.Token, nil
+}
+
+// Get a token from the token service, tokens are cached per credential and query until they expire
+func (c *Cache) Fetch(realm string, query url.Values, authorization string) (*Token, error) {
+
+	k := key{
+		authKey: cache.ComputeAuthKey(authorization),
+		realm:   realm,
+		query:   query.Encode(),
+	}
+
+	c.lock.RLock()
+	t, ok := c.tokens[k]
+	c.lock.RUnlock()
+	if ok && time.Now().Before(t.Expires) {
+		metrics.TokenRequests.WithLabelValues("hit").Inc()
+		return t, nil
+	}
+
+	t, err := c.request(realm, query, authorization)
+	if err != nil {
+		metrics.TokenRequests.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	metrics.TokenRequests.WithLabelValues("issued").Inc()
+
+	c.store(k, t)
+	return t, nil
+}
+
+func (c *Cache) request(realm string, query url.Values, authorization string) (*Token, error) {
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, err
+	}
+	// the realm can have its own parameters
+	values := u.Query()
+	for name, v := range query {
+		values[name] = v
+	}
+	u.RawQuery = values.Encode()
+
+	var req *http.Request
+	if IsIdentityToken(authorization) {
+		req, err = refreshTokenRequest(realm, query, strings.TrimPrefix(authorization, IDENTITY_TOKEN_SCHEME+" "))
+	} else {
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" && !IsIdentityToken(authorization) {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_TOKEN_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MAX_TOKEN_RESPONSE_SIZE {
+		return nil, fmt.Errorf("token response larger than %d bytes", MAX_TOKEN_RESPONSE_SIZE)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ServiceError{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	}
+
+	return parseToken(body)
+}
+
+// OAuth2 request exchanging an identity token for an access token
+func refreshTokenRequest(realm string, query url.Values, identityToken string) (*http.Request, error) {
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", identityToken)
+	form.Set("client_id", OAUTH_CLIENT_ID)
+	form.Set("service", query.Get("service"))
+	if scopes := query["scope"]; len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func parseToken(body []byte) (*Token, error) {
+
+	tr := &tokenResponse{}
+	err := json.Unmarshal(body, tr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+
+	t := &Token{Body: body, Token: tr.Token}
+	if t.Token == "" {
+		t.Token = tr.AccessToken
+	}
+	if t.Token == "" {
+		return nil, fmt.Errorf("token response without token")
+	}
+
+	expiresIn := DEFAULT_EXPIRES_IN
+	if tr.ExpiresIn > 0 {
+		expiresIn = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	// don't trust the clock of the token service
+	issuedAt := time.Now()
+	if !tr.IssuedAt.IsZero() && tr.IssuedAt.Before(issuedAt) && issuedAt.Sub(tr.IssuedAt) < expiresIn {
+		issuedAt = tr.IssuedAt
+	}
+	t.Expires = issuedAt.Add(expiresIn - EXPIRY_MARGIN)
+
+	return t, nil
+}
+
+func (c *Cache) store(k key, t *Token) {
+
+	if !time.Now().Before(t.Expires) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.tokens) >= MAX_ENTRIES {
+		now := time.Now()
+		for k, t := range c.tokens {
+			if now.After(t.Expires) {
+				delete(c.tokens, k)
+			}
+		}
+	}
+	if len(c.tokens) >= MAX_ENTRIES {
+		c.log.Debugln("token cache full, not caching token")
+		return
+	}
+	c.tokens[k] = t
+}
+
+// Forward a request to the token service as is, e.g.: OAuth2 POST requests
+func (c *Cache) Forward(realm string, r *http.Request) (*http.Response, error) {
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(r.Method, u.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Authorization", "Content-Type", "Accept", "User-Agent"} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	req.ContentLength = r.ContentLength
+
+	return c.client.Do(req)
+}
+
+func (c *Cache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.tokens)
+}
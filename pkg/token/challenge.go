@@ -0,0 +1,81 @@
+package token
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parse a Bearer challenge, e.g.: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func ParseChallenge(header string) (*Challenge, bool) {
+
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	c := &Challenge{}
+	for _, p := range parseParams(params) {
+		switch strings.ToLower(p[0]) {
+		case "realm":
+			c.Realm = p[1]
+		case "service":
+			c.Service = p[1]
+		case "scope":
+			c.Scope = p[1]
+		}
+	}
+	if c.Realm == "" {
+		return nil, false
+	}
+	return c, true
+}
+
+// Replace the realm of a Bearer challenge, the other parameters are kept
+func RewriteRealm(header, realm string) string {
+
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+
+	values := []string{}
+	for _, p := range parseParams(params) {
+		if strings.EqualFold(p[0], "realm") {
+			p[1] = realm
+		}
+		values = append(values, fmt.Sprintf("%s=%q", p[0], p[1]))
+	}
+	return scheme + " " + strings.Join(values, ",")
+}
+
+// Parameters of a challenge in order, values can be quoted and contain commas, e.g.: scopes
+func parseParams(s string) [][2]string {
+
+	params := [][2]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			// skip the closing quote
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+
+		params = append(params, [2]string{strings.TrimSpace(name), value})
+	}
+}
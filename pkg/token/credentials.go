@@ -0,0 +1,162 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func NewBasicCredentials(username, password string) *BasicCredentials {
+	return &BasicCredentials{authorization: basicAuthorization(username, password)}
+}
+
+func (c *BasicCredentials) Authorization(host string) (string, error) {
+	return c.authorization, nil
+}
+
+func NewFileCredentials(path, username string) *FileCredentials {
+	return &FileCredentials{path: path, username: username}
+}
+
+// The file is read on the first use, then by Reload
+func (c *FileCredentials) Authorization(host string) (string, error) {
+
+	c.lock.RLock()
+	authorization := c.authorization
+	c.lock.RUnlock()
+	if authorization != "" {
+		return authorization, nil
+	}
+
+	err := c.Reload()
+	if err != nil {
+		return "", err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.authorization, nil
+}
+
+// Read the file again if it changed, called periodically by the config reloader.
+// The token read before is kept if the file is missing or empty
+func (c *FileCredentials) Reload() error {
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.authorization != "" && info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return nil
+	}
+
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return fmt.Errorf("token file %s is empty", c.path)
+	}
+
+	c.authorization = "Bearer " + secret
+	if c.username != "" {
+		c.authorization = basicAuthorization(c.username, secret)
+	}
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+
+	return nil
+}
+
+// The helper is run as `<command> get` with the upstream host on stdin, e.g.: docker-credential-ecr-login
+func NewHelperCredentials(command string) *HelperCredentials {
+	return &HelperCredentials{
+		command: command,
+		entries: make(map[string]helperEntry),
+		calls:   make(map[string]*helperCall),
+	}
+}
+
+// The helper runs once at a time per host, outside of the lock. Failures are cached briefly
+func (c *HelperCredentials) Authorization(host string) (string, error) {
+
+	c.lock.Lock()
+	if entry, ok := c.entries[host]; ok && time.Now().Before(entry.expires) {
+		c.lock.Unlock()
+		return entry.authorization, entry.err
+	}
+	call, running := c.calls[host]
+	if !running {
+		call = &helperCall{done: make(chan struct{})}
+		c.calls[host] = call
+	}
+	c.lock.Unlock()
+
+	if running {
+		<-call.done
+		return call.authorization, call.err
+	}
+
+	call.authorization, call.err = c.run(host)
+	ttl := CREDENTIAL_HELPER_TTL
+	if call.err != nil {
+		ttl = CREDENTIAL_HELPER_FAILURE_TTL
+	}
+
+	c.lock.Lock()
+	c.entries[host] = helperEntry{authorization: call.authorization, err: call.err, expires: time.Now().Add(ttl)}
+	delete(c.calls, host)
+	c.lock.Unlock()
+	close(call.done)
+
+	return call.authorization, call.err
+}
+
+// Identity tokens (username <token>) are exchanged for tokens by the token service, they're never sent to the registry
+func (c *HelperCredentials) run(host string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), CREDENTIAL_HELPER_TIMEOUT)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, c.command, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s failed: %v: %s", c.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := &helperResponse{}
+	err = json.Unmarshal(out, resp)
+	if err != nil {
+		return "", fmt.Errorf("invalid response of credential helper %s: %v", c.command, err)
+	}
+	if resp.Secret == "" {
+		return "", fmt.Errorf("credential helper %s returned no secret for %s", c.command, host)
+	}
+
+	if resp.Username == HELPER_IDENTITY_TOKEN_USERNAME {
+		return IDENTITY_TOKEN_SCHEME + " " + resp.Secret, nil
+	}
+	return basicAuthorization(resp.Username, resp.Secret), nil
+}
+
+// Identity tokens are OAuth2 refresh tokens, used only with the token services
+func IsIdentityToken(authorization string) bool {
+	return strings.HasPrefix(authorization, IDENTITY_TOKEN_SCHEME+" ")
+}
+
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
@@ -0,0 +1,157 @@
+package token
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChallenge(t *testing.T) {
+	header := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull,push",error="insufficient_scope"`
+
+	c, ok := ParseChallenge(header)
+	assert.True(t, ok)
+	assert.Equal(t, &Challenge{
+		Realm:   "https://auth.docker.io/token",
+		Service: "registry.docker.io",
+		Scope:   "repository:library/alpine:pull,push",
+	}, c)
+
+	assert.Equal(t,
+		`Bearer realm="https://cache.local/token",service="registry.docker.io",scope="repository:library/alpine:pull,push",error="insufficient_scope"`,
+		RewriteRealm(header, "https://cache.local/token"),
+	)
+
+	_, ok = ParseChallenge(`Basic realm="registry"`)
+	assert.False(t, ok)
+}
+
+func TestTokenCache(t *testing.T) {
+	issued := &atomic.Int32{}
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := issued.Add(1)
+		fmt.Fprintf(w, `{"token": "token-%d", "expires_in": 300}`, n)
+	}))
+	defer service.Close()
+
+	c := NewCache(service.Client())
+	challenge := &Challenge{Realm: service.URL, Service: "registry", Scope: "repository:app:pull"}
+
+	token, err := c.Token(challenge, "Basic dXNlcjpwYXNz")
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// cached per credential and scope
+	token, _ = c.Token(challenge, "Basic dXNlcjpwYXNz")
+	assert.Equal(t, "token-1", token)
+	token, _ = c.Token(challenge, "Basic b3RoZXI6cGFzcw==")
+	assert.Equal(t, "token-2", token)
+	c.Fetch(service.URL, url.Values{"service": {"registry"}, "scope": {"repository:other:pull"}}, "Basic dXNlcjpwYXNz")
+	assert.Equal(t, int32(3), issued.Load())
+
+	// failures are returned to the clients and not cached
+	_, err = c.Token(challenge, "")
+	serr, ok := err.(*ServiceError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, serr.StatusCode)
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("first\n"), 0600)
+
+	c := NewFileCredentials(path, "")
+	authorization, err := c.Authorization("registry")
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer first", authorization)
+
+	// re-read on reload when rotated
+	os.WriteFile(path, []byte("second-token\n"), 0600)
+	authorization, _ = c.Authorization("registry")
+	assert.Equal(t, "Bearer first", authorization)
+	assert.Nil(t, c.Reload())
+	authorization, _ = c.Authorization("registry")
+	assert.Equal(t, "Bearer second-token", authorization)
+
+	authorization, _ = NewFileCredentials(path, "user").Authorization("registry")
+	assert.Equal(t, basicAuthorization("user", "second-token"), authorization)
+}
+
+func TestHelperCredentials(t *testing.T) {
+	helper := filepath.Join(t.TempDir(), "docker-credential-test")
+	script := "#!/bin/sh\nread host\necho \"{\\\"Username\\\": \\\"user\\\", \\\"Secret\\\": \\\"$host\\\"}\"\n"
+	os.WriteFile(helper, []byte(script), 0700)
+
+	authorization, err := NewHelperCredentials(helper).Authorization("registry.local")
+	assert.Nil(t, err)
+	assert.Equal(t, basicAuthorization("user", "registry.local"), authorization)
+
+	_, err = NewHelperCredentials(filepath.Join(t.TempDir(), "missing")).Authorization("registry.local")
+	assert.NotNil(t, err)
+}
+
+func TestHelperCredentialsRunOncePerHost(t *testing.T) {
+	dir := t.TempDir()
+	helper := filepath.Join(dir, "docker-credential-test")
+	// the helper is slow and counts its runs
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %s\nsleep 0.2\nexit 1\n", filepath.Join(dir, "runs"))
+	os.WriteFile(helper, []byte(script), 0700)
+
+	c := NewHelperCredentials(helper)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Authorization("registry.local")
+			assert.NotNil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// the failure is cached too
+	_, err := c.Authorization("registry.local")
+	assert.NotNil(t, err)
+
+	runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.Equal(t, "run\n", string(runs))
+}
+
+func TestHelperIdentityToken(t *testing.T) {
+	helper := filepath.Join(t.TempDir(), "docker-credential-test")
+	script := "#!/bin/sh\necho '{\"Username\": \"<token>\", \"Secret\": \"refresh-token\"}'\n"
+	os.WriteFile(helper, []byte(script), 0700)
+
+	authorization, err := NewHelperCredentials(helper).Authorization("registry.local")
+	assert.Nil(t, err)
+	assert.True(t, IsIdentityToken(authorization))
+
+	// exchanged with an OAuth2 refresh token grant
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "" ||
+			r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "%s", "expires_in": 300}`, r.PostForm.Get("scope"))
+	}))
+	defer service.Close()
+
+	token, err := NewCache(service.Client()).Token(&Challenge{Realm: service.URL, Service: "registry", Scope: "repository:app:pull"}, authorization)
+	assert.Nil(t, err)
+	assert.Equal(t, "repository:app:pull", token)
+}
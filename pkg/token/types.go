@@ -0,0 +1,132 @@
+package token
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// path of the token endpoint of the proxy, advertised in the rewritten challenges
+	TOKEN_PATH = "/token"
+
+	HEADER_WWW_AUTHENTICATE = "WWW-Authenticate"
+
+	// lifetime of the tokens without expires_in, as per the token spec
+	DEFAULT_EXPIRES_IN = 60 * time.Second
+	// tokens are dropped a bit before they expire, so that they're still valid when they reach the upstream
+	EXPIRY_MARGIN = 5 * time.Second
+
+	MAX_TOKEN_RESPONSE_SIZE = 1 << 20
+	// tokens kept in memory, the expired ones are dropped when it's full
+	MAX_ENTRIES = 10000
+
+	// credentials returned by the credential helpers are cached, helpers can be slow
+	CREDENTIAL_HELPER_TTL     = 5 * time.Minute
+	CREDENTIAL_HELPER_TIMEOUT = 10 * time.Second
+	// failures aren't retried for a while, so that a broken helper isn't run on every request
+	CREDENTIAL_HELPER_FAILURE_TTL = 10 * time.Second
+
+	// username returned by the credential helpers with an identity token as secret
+	HELPER_IDENTITY_TOKEN_USERNAME = "<token>"
+	// internal scheme of the identity tokens, they're sent to the token services as OAuth2 refresh tokens
+	IDENTITY_TOKEN_SCHEME = "IdentityToken"
+	OAUTH_CLIENT_ID       = "registry-cache"
+)
+
+// Credentials of an upstream owned by the proxy, sent in place of the ones of the clients
+type Credentials interface {
+	// value of the Authorization header for an upstream host
+	Authorization(host string) (string, error)
+}
+
+type BasicCredentials struct {
+	authorization string
+}
+
+// Token read from a file, re-read by Reload when the file changes (e.g.: rotated by another process).
+// Sent as password of the username if set, as Bearer token otherwise
+type FileCredentials struct {
+	path          string
+	username      string
+	modTime       time.Time
+	size          int64
+	authorization string
+	lock          sync.RWMutex
+}
+
+// Credentials returned by an executable implementing the docker credential helpers protocol, per upstream host
+type HelperCredentials struct {
+	command string
+	entries map[string]helperEntry
+	// helpers running, per host
+	calls map[string]*helperCall
+	lock  sync.Mutex
+}
+
+type helperEntry struct {
+	authorization string
+	err           error
+	expires       time.Time
+}
+
+// Run of a helper, the requests for the same host wait for its result
+type helperCall struct {
+	done          chan struct{}
+	authorization string
+	err           error
+}
+
+type helperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// Bearer challenge of the WWW-Authenticate header returned by the upstream registries
+type Challenge struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+// Tokens issued by the token services of the upstream registries, cached per credential until they expire.
+// The realms of the upstream registries are learned from their challenges
+type Cache struct {
+	client *http.Client
+	realms map[string]string
+	tokens map[key]*Token
+	lock   sync.RWMutex
+	log    *logrus.Entry
+}
+
+// Tokens are cached per credential and token request, e.g.: service and scopes
+type key struct {
+	authKey cache.AuthKey
+	realm   string
+	query   string
+}
+
+type Token struct {
+	// response of the token service, returned as is to the clients
+	Body    []byte
+	Token   string
+	Expires time.Time
+}
+
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// Non-200 response of a token service, relayed to the clients
+type ServiceError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
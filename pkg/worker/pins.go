@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+)
+
+// Tags aren't cached, resolve the manifests of the pinned tags pulled through the proxy
+func (w *Worker) checkPinnedTag(cr *cache.CacheRequest, resp *http.Response) {
+
+	if w.pins == nil || resp.StatusCode != http.StatusOK || !strings.Contains(cr.Request.URL.Path, "/manifests/") {
+		return
+	}
+	if cr.Request.Method != http.MethodGet && cr.Request.Method != http.MethodHead {
+		return
+	}
+
+	reference := path.Base(cr.Request.URL.Path)
+	if strings.HasPrefix(reference, pin.DIGEST_PREFIX) {
+		return
+	}
+
+	pattern := w.pins.Match(cr.Repository, reference)
+	if pattern == "" {
+		return
+	}
+
+	digest := resp.Header.Get(HEADER_DOCKER_DIGEST)
+	ckey := cache.CacheKey(strings.TrimPrefix(digest, pin.DIGEST_PREFIX))
+	if !cache.REGEX_DIGEST_HEX.MatchString(string(ckey)) {
+		w.log.Warningf("can't pin %s:%s, digest not returned by the upstream", cr.Repository, reference)
+		return
+	}
+
+	// already resolved
+	if w.pins.IsPinned(ckey) {
+		return
+	}
+
+	go w.resolvePinnedManifest(cr, ckey, pattern)
+}
+
+// Pin a manifest and what it references, manifests of image indexes are resolved too
+func (w *Worker) resolvePinnedManifest(cr *cache.CacheRequest, ckey cache.CacheKey, pattern string) {
+
+	queue := []cache.CacheKey{ckey}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+
+		content, err := w.fetchManifest(cr, key)
+		if err != nil {
+			w.log.Warningf("failed to resolve pinned manifest %s: %v", key, err)
+			continue
+		}
+
+		children, err := w.pins.PinManifest(key, pattern, content)
+		if err != nil {
+			w.log.Warningln(err)
+			continue
+		}
+		queue = append(queue, children...)
+	}
+
+	w.log.Infof("pinned %s:%s (%s)", cr.Repository, path.Base(cr.Request.URL.Path), pattern)
+}
+
+// Fetch a manifest by digest from the upstream, with the headers of the client request
+func (w *Worker) fetchManifest(cr *cache.CacheRequest, ckey cache.CacheKey) ([]byte, error) {
+
+	r := cr.Request.Clone(context.TODO())
+	r.Method = http.MethodGet
+	r.URL.Path = fmt.Sprintf("/v2/%s/manifests/%s%s", cr.Repository, pin.DIGEST_PREFIX, ckey)
+	r.URL.RawPath = ""
+
+	resp, err := w.doWithToken(r, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned a non-200 response: %v", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, pin.MAX_MANIFEST_SIZE))
+}
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+)
+
+// Fetch in background what a cached manifest references, clients request it right after the manifest.
+// Manifests are stored only after checkPerms, so the authorization of the client can be reused
+func (w *Worker) prefetchReferences(cr *cache.CacheRequest) {
+
+	if w.prefetch == nil || cr.ItemType != "manifest" {
+		return
+	}
+
+	content, err := w.readManifest(cr.DataFile)
+	if err != nil {
+		w.log.Warningf("failed to read manifest %s for prefetch: %v", cr.DataFile, err)
+		return
+	}
+
+	m := &cache.Manifest{}
+	err = json.Unmarshal(content, m)
+	if err != nil {
+		w.log.Debugf("manifest %s can't be parsed, skipping prefetch: %v", cr.CacheKey, err)
+		return
+	}
+
+	// the manifests of an image index are prefetched when they're stored
+	for _, d := range m.Manifests {
+		if w.matchPlatforms(d) {
+			w.prefetchFile(cr, "manifests", d.Digest)
+		}
+	}
+
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, d := range blobs {
+		w.prefetchFile(cr, "blobs", d.Digest)
+	}
+}
+
+func (w *Worker) matchPlatforms(d cache.Descriptor) bool {
+	if len(w.prefetch.Platforms) == 0 {
+		return true
+	}
+	for _, p := range w.prefetch.Platforms {
+		if p.Match(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Worker) readManifest(df cache.DataFile) ([]byte, error) {
+
+	f, err := w.cache.Open(df)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, pin.MAX_MANIFEST_SIZE))
+}
+
+// Enqueue a background request for a file of the repository, unless it's cached or already being fetched
+func (w *Worker) prefetchFile(cr *cache.CacheRequest, kind, digest string) {
+
+	ckey, ok := cache.ComputeDigestKey(digest)
+	if !ok || w.index.GetStatus(ckey) != cache.STATUS_NOT_FOUND {
+		return
+	}
+	if _, loaded := w.prefetching.LoadOrStore(ckey, true); loaded {
+		return
+	}
+
+	r := cr.Request.Clone(context.TODO())
+	r.Method = http.MethodGet
+	r.URL.Path = fmt.Sprintf("/v2/%s/%s/%s", cr.Repository, kind, digest)
+	r.URL.RawPath = ""
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+
+	go w.runPrefetch(cache.NewCacheRequest(r, w.cache.GetDataPath()))
+}
+
+func (w *Worker) runPrefetch(cr *cache.CacheRequest) {
+
+	defer w.prefetching.Delete(cr.CacheKey)
+
+	w.prefetchSem <- struct{}{}
+	defer func() { <-w.prefetchSem }()
+
+	w.background <- cr
+	cresp := <-cr.Response
+	defer cresp.Response.Body.Close()
+
+	// wait for the download, so that the concurrency is bounded
+	_, err := io.Copy(io.Discard, cresp.Response.Body)
+	// redirects to the storage backend are served from the cache
+	status := cresp.Response.StatusCode
+	if err != nil || (status != http.StatusOK && status != http.StatusTemporaryRedirect) || cresp.Origin != cache.ORIGIN_CACHE {
+		metrics.BackgroundPrefetches.WithLabelValues(cr.ItemType, "failed").Inc()
+		w.log.Debugf("failed to prefetch %s (%d): %v", cr.Request.URL.Path, status, err)
+		return
+	}
+
+	metrics.BackgroundPrefetches.WithLabelValues(cr.ItemType, "done").Inc()
+	w.log.Debugf("prefetched %s", cr.Request.URL.Path)
+}
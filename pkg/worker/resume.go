@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+)
+
+// Request the content from offset with a Range request.
+// Returns the full response if the upstream doesn't support ranges
+func (w *Worker) getRangeFromUpstream(cr *cache.CacheRequest, offset int64) (*http.Response, error) {
+
+	r := cr.Request.Clone(context.TODO())
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	r.Header.Del("If-Range")
+
+	resp, err := w.doWithToken(r, true)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusPartialContent:
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range '%s'", resp.Header.Get("Content-Range"))
+		}
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	return nil, fmt.Errorf("upstream returned %d to range request", resp.StatusCode)
+}
+
+// Read from the upstream response body,
+// when the connection drops resume the download from the current offset
+func (b *resumableBody) Read(p []byte) (int, error) {
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	if b.retries >= MAX_RESUME_RETRIES {
+		return n, err
+	}
+	b.retries++
+
+	b.worker.log.Warningf(
+		"upstream connection dropped while downloading %s at offset %d (%v), resuming (attempt %d)",
+		b.cr.DataFile, b.offset, err, b.retries,
+	)
+
+	resp, rerr := b.worker.getRangeFromUpstream(b.cr, b.offset)
+	if rerr == nil && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		rerr = fmt.Errorf("upstream doesn't support ranges")
+	}
+	if rerr != nil {
+		return n, fmt.Errorf("%v, resume failed: %v", err, rerr)
+	}
+
+	b.body.Close()
+	b.body = resp.Body
+
+	return n, nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// Parse Content-Range header value (e.g.: bytes 100-199/1000),
+// total is -1 if the size is unknown
+func parseContentRange(value string) (int64, int64, error) {
+
+	value, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, -1, fmt.Errorf("invalid unit in content range")
+	}
+
+	byteRange, size, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, -1, fmt.Errorf("invalid content range")
+	}
+
+	startStr, _, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, -1, fmt.Errorf("invalid content range")
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, -1, err
+	}
+
+	if size == "*" {
+		return start, -1, nil
+	}
+
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, -1, err
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,198 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/metrics"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+)
+
+// Serve a tag from the manifest cached for its digest, after the ttl the tag is revalidated with the upstream.
+// Tags not cached yet, or moved, are fetched from the upstream and their manifest is stored
+func (w *Worker) handleTag(ctx context.Context, cr *cache.CacheRequest) {
+
+	key := cache.TagKey{
+		Host:       cr.Host,
+		Repository: cr.Repository,
+		Tag:        cr.Tag,
+		Accept:     cache.ComputeAcceptKey(cr.Request.Header),
+	}
+
+	if entry, ok := w.tags.Get(key); ok {
+		resp, err := w.serveTag(cr, key, entry)
+		if err == nil {
+			cr.Response <- &cache.CacheResponse{Response: resp, Origin: cache.ORIGIN_CACHE}
+			return
+		}
+		w.log.Debugf("tag %s:%s not served from cache: %v", cr.Repository, cr.Tag, err)
+	}
+
+	metrics.TagRequests.WithLabelValues("miss").Inc()
+	if cr.Request.Method != http.MethodGet {
+		w.handleFromUpstream(cr)
+		return
+	}
+	w.fetchTag(ctx, cr, key)
+}
+
+func (w *Worker) serveTag(cr *cache.CacheRequest, key cache.TagKey, entry cache.TagEntry) (*http.Response, error) {
+
+	dcr := w.digestRequest(cr, entry.Digest)
+	if w.index.GetStatus(dcr.CacheKey) != cache.STATUS_AVAILABLE {
+		w.tags.Delete(key)
+		return nil, fmt.Errorf("manifest %s not cached", entry.Digest)
+	}
+
+	result := "hit"
+	if w.tags.Fresh(entry) {
+		err := w.checkPerms(cr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the HEAD request checks the permissions too
+		moved, err := w.revalidateTag(cr, entry)
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			w.tags.Delete(key)
+			return nil, fmt.Errorf("tag moved")
+		}
+		w.tags.Validate(key)
+		result = "revalidated"
+	}
+
+	resp, err := w.getResponseFromCache(dcr)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = cr.Request.Clone(context.TODO())
+
+	metrics.TagRequests.WithLabelValues(result).Inc()
+	return resp, nil
+}
+
+// Check with a HEAD request if the tag still points to the cached manifest,
+// comparing the Docker-Content-Digest header or the ETag if the upstream doesn't return it
+func (w *Worker) revalidateTag(cr *cache.CacheRequest, entry cache.TagEntry) (bool, error) {
+
+	r := cr.Request.Clone(context.TODO())
+	r.Method = http.MethodHead
+	r.Body = nil
+	r.ContentLength = 0
+
+	resp, err := w.doWithToken(r, true)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("upstream returned a non-200 response: %v", resp.StatusCode)
+	}
+	if digest := resp.Header.Get(HEADER_DOCKER_DIGEST); digest != "" {
+		return digest != entry.Digest, nil
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag != entry.ETag, nil
+	}
+	return true, nil
+}
+
+// Fetch the tag from the upstream for the client, storing its manifest by digest
+func (w *Worker) fetchTag(ctx context.Context, cr *cache.CacheRequest, key cache.TagKey) {
+
+	resp, err := w.getResponseFromUpstream(cr, false)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		w.checkPinnedTag(cr, resp)
+		cr.Response <- &cache.CacheResponse{Response: resp, Origin: cache.ORIGIN_UPSTREAM}
+		return
+	}
+
+	body := resp.Body
+	content, err := io.ReadAll(io.LimitReader(body, pin.MAX_MANIFEST_SIZE+1))
+	if err != nil {
+		body.Close()
+		metrics.UpstreamConn.Add(-1)
+		w.log.Warningf("failed to read tag %s:%s: %v", cr.Repository, cr.Tag, err)
+		w.handleFromUpstream(cr)
+		return
+	}
+
+	// too large to be a manifest, stream it without caching it
+	if len(content) > pin.MAX_MANIFEST_SIZE {
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(content), body), Closer: body}
+		cr.Response <- &cache.CacheResponse{Response: resp, Origin: cache.ORIGIN_UPSTREAM}
+		return
+	}
+	body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+
+	err = w.storeTag(ctx, cr, key, resp.Header, content)
+	if err != nil {
+		w.log.Warningf("failed to cache tag %s:%s: %v", cr.Repository, cr.Tag, err)
+	}
+
+	w.checkPinnedTag(cr, resp)
+	cr.Response <- &cache.CacheResponse{Response: resp, Origin: cache.ORIGIN_UPSTREAM}
+}
+
+// Store the manifest of a tag by digest, if it isn't cached yet, and cache the tag
+func (w *Worker) storeTag(ctx context.Context, cr *cache.CacheRequest, key cache.TagKey, header http.Header, content []byte) error {
+
+	digest := fmt.Sprintf("%s%x", cache.DIGEST_PREFIX, sha256.Sum256(content))
+	if upstreamDigest := header.Get(HEADER_DOCKER_DIGEST); upstreamDigest != "" && upstreamDigest != digest {
+		return fmt.Errorf("digest mismatch: upstream returned %s, content is %s", upstreamDigest, digest)
+	}
+
+	dcr := w.digestRequest(cr, digest)
+	if w.index.GetStatus(dcr.CacheKey) == cache.STATUS_NOT_FOUND {
+		err := w.index.Put(dcr.CacheKey, dcr.DataFile)
+		if err != nil {
+			return err
+		}
+
+		// another worker is storing it
+		id := ctx.Value(ContextKey("id")).(int)
+		w.index.SetWorker(dcr.CacheKey, id, false)
+		if w.index.GetWorker(dcr.CacheKey) != id {
+			return nil
+		}
+
+		err = w.index.SetStatus(dcr.CacheKey, cache.STATUS_IN_PROGRESS)
+		if err != nil {
+			w.index.SetWorker(dcr.CacheKey, cache.NO_WORKER, true)
+			return err
+		}
+
+		respfile := cache.NewResponseFile(len(content), http.StatusOK, header.Clone(), dcr.CacheKey)
+		respfile.Host = dcr.Host
+		respfile.Repository = dcr.Repository
+
+		err = w.writeCache(dcr, respfile, io.NopCloser(bytes.NewReader(content)), 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.index.GetStatus(dcr.CacheKey) == cache.STATUS_AVAILABLE {
+		w.tags.Set(key, digest, header.Get("ETag"))
+	}
+	return nil
+}
+
+// Cache request of the manifest of a tag by digest
+func (w *Worker) digestRequest(cr *cache.CacheRequest, digest string) *cache.CacheRequest {
+	r := cr.Request.Clone(context.TODO())
+	r.Method = http.MethodGet
+	r.URL.Path = fmt.Sprintf("/v2/%s/manifests/%s", cr.Repository, digest)
+	r.URL.RawPath = ""
+	return cache.NewCacheRequest(r, w.cache.GetDataPath())
+}
@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ish-xyz/registry-cache/pkg/token"
+)
+
+// Send a request to the upstream, exchanging the credentials of the client (e.g.: basic auth)
+// for a token when the upstream challenges them. Tokens are cached per credential until they expire.
+// Identity tokens are only sent to the token service.
+// Redirects aren't followed if redirect is false, e.g.: responses relayed to the clients as they are
+func (w *Worker) doWithToken(r *http.Request, redirect bool) (*http.Response, error) {
+
+	send := w.client.Do
+	if !redirect {
+		send = w.client.Transport.RoundTrip
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if token.IsIdentityToken(authorization) {
+		r.Header.Del("Authorization")
+	}
+
+	resp, err := send(r)
+	if err != nil || w.tokens == nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// the body of the request can't be sent again
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return resp, nil
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return resp, nil
+	}
+
+	challenge, ok := token.ParseChallenge(resp.Header.Get(token.HEADER_WWW_AUTHENTICATE))
+	if !ok {
+		return resp, nil
+	}
+	t, err := w.tokens.Token(challenge, authorization)
+	if err != nil {
+		w.log.Debugf("token for %s not issued: %v", r.URL.Path, err)
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	r.Header.Set("Authorization", "Bearer "+t)
+	return send(r)
+}
@@ -1,10 +1,14 @@
 package worker
 
 import (
+	"io"
 	"net/http"
+	"sync"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
 	"github.com/ish-xyz/registry-cache/pkg/gc"
+	"github.com/ish-xyz/registry-cache/pkg/pin"
+	"github.com/ish-xyz/registry-cache/pkg/token"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,10 +16,29 @@ const (
 	REQUEST_USED_FOR_CACHE = "used-for-cache"
 	CACHE_READ_ERROR       = "CacheReadError"
 	UPSTREAM_ERROR         = "UpstreamError"
+	HEADER_DOCKER_DIGEST   = "Docker-Content-Digest"
+
+	MAX_RESUME_RETRIES = 5
+
+	DEFAULT_PREFETCH_CONCURRENCY = 4
 )
 
 type ContextKey string
 
+// Optional dependencies of the worker, disabled if nil
+type Options struct {
+	GC   *gc.GarbageCollector
+	Pins *pin.Pinner
+	// fetch of the files referenced by the manifests
+	Prefetch *Prefetch
+	// digests of the tags, revalidated after their ttl
+	Tags *cache.TagCache
+	// authorization of the clients for the cached files
+	Auth *cache.AuthCache
+	// tokens requested on the challenges of the upstreams
+	Tokens *token.Cache
+}
+
 type Worker struct {
 	queue  chan *cache.CacheRequest
 	cache  cache.Cache
@@ -23,4 +46,37 @@ type Worker struct {
 	client *http.Client
 	log    *logrus.Entry
 	gc     *gc.GarbageCollector
+	pins   *pin.Pinner
+
+	// background requests, popped when there are no client requests
+	background  chan *cache.CacheRequest
+	prefetch    *Prefetch
+	prefetchSem chan struct{}
+	// cache keys being prefetched
+	prefetching sync.Map
+	tags        *cache.TagCache
+	auth        *cache.AuthCache
+	tokens      *token.Cache
+}
+
+// Background fetch of the files referenced by the manifests stored in the cache
+type Prefetch struct {
+	Concurrency int
+	// platforms of the manifests of image indexes, all if empty
+	Platforms []*cache.Platform
+}
+
+// body read partially into memory
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// upstream response body resuming the download when the connection drops
+type resumableBody struct {
+	worker  *Worker
+	cr      *cache.CacheRequest
+	body    io.ReadCloser
+	offset  int64
+	retries int
 }
@@ -3,64 +3,119 @@ package worker
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/ish-xyz/registry-cache/pkg/cache"
-	"github.com/ish-xyz/registry-cache/pkg/gc"
 	"github.com/ish-xyz/registry-cache/pkg/metrics"
 	"github.com/sirupsen/logrus"
 )
 
-func NewWorker(ch cache.Cache, idx cache.Index, cl *http.Client, gc *gc.GarbageCollector) *Worker {
-	return &Worker{
-		cache:  ch,
-		index:  idx,
-		queue:  make(chan *cache.CacheRequest, 100),
-		client: cl,
-		log:    logrus.WithField("name", "worker"),
-		gc:     gc,
+// Background prefetch, tags caching and authorization caching are disabled if prefetch, tags and auth are nil.
+// Without tokens the credentials of the clients are sent as they are to the upstreams
+func NewWorker(ch cache.Cache, idx cache.Index, cl *http.Client, opts Options) *Worker {
+
+	w := &Worker{
+		cache:      ch,
+		index:      idx,
+		queue:      make(chan *cache.CacheRequest, 100),
+		background: make(chan *cache.CacheRequest),
+		client:     cl,
+		log:        logrus.WithField("name", "worker"),
+		gc:         opts.GC,
+		pins:       opts.Pins,
+		prefetch:   opts.Prefetch,
+		tags:       opts.Tags,
+		auth:       opts.Auth,
+		tokens:     opts.Tokens,
 	}
+
+	if opts.Prefetch != nil {
+		concurrency := opts.Prefetch.Concurrency
+		if concurrency <= 0 {
+			concurrency = DEFAULT_PREFETCH_CONCURRENCY
+		}
+		w.prefetchSem = make(chan struct{}, concurrency)
+	}
+
+	return w
+}
+
+// Apply the ttls of a reloaded config, the caches disabled at startup stay disabled
+func (w *Worker) SetTTLs(tagsTTL, authTTL, authNegativeTTL time.Duration) {
+	if w.tags != nil {
+		w.tags.SetTTL(tagsTTL)
+	}
+	w.auth.SetTTL(authTTL, authNegativeTTL)
 }
 
 func (w *Worker) Push(cr *cache.CacheRequest) {
 	w.queue <- cr
 }
 
+// Client requests are popped before the background ones
 func (w *Worker) Pop() *cache.CacheRequest {
-	return <-w.queue
+	select {
+	case cr := <-w.queue:
+		return cr
+	default:
+	}
+
+	select {
+	case cr := <-w.queue:
+		return cr
+	case cr := <-w.background:
+		return cr
+	}
 }
 
 // Send HEAD request to check authn and authz to the upstream resource
-func (w *Worker) authRequest(r *http.Request) bool {
+func (w *Worker) authRequest(r *http.Request) (int, error) {
 
 	r.Method = http.MethodHead
 	r.Body = nil
 	r.ContentLength = 0
-	resp, err := w.client.Do(r)
+	resp, err := w.doWithToken(r, true)
 
 	if err != nil {
 		w.log.Errorln("head request failed:", err)
-		return false
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	w.log.Tracef(
-		"checkAuth()  status: '%d', path: '%s', auth: '%s'",
-		resp.StatusCode, r.URL.Path, r.Header.Get("Authorization"),
-	)
-	return resp.StatusCode == http.StatusOK
+	w.log.Tracef("checkAuth()  status: '%d', path: '%s'", resp.StatusCode, r.URL.Path)
+	return resp.StatusCode, nil
 }
 
+// Permissions are checked per credential and repository, the results are cached if enabled
 func (w *Worker) checkPerms(cr *cache.CacheRequest) error {
 
-	isAuthorised := w.authRequest(cr.Request.Clone(context.TODO()))
-	if !isAuthorised {
-		return fmt.Errorf("authentication HEAD request failed")
+	key := cache.AuthCacheKey{AuthKey: cr.AuthKey, Host: cr.Host, Repository: cr.Repository}
+	if allowed, ok := w.auth.Get(key); ok {
+		if !allowed {
+			metrics.AuthCacheRequests.WithLabelValues("denied").Inc()
+			return fmt.Errorf("authentication HEAD request failed (cached)")
+		}
+		metrics.AuthCacheRequests.WithLabelValues("allowed").Inc()
+		return nil
+	}
+	if w.auth != nil {
+		metrics.AuthCacheRequests.WithLabelValues("miss").Inc()
 	}
 
+	status, err := w.authRequest(cr.Request.Clone(context.TODO()))
+	if err != nil {
+		return fmt.Errorf("authentication HEAD request failed: %v", err)
+	}
+	w.auth.Set(key, status)
+
+	if status != http.StatusOK {
+		return fmt.Errorf("authentication HEAD request failed")
+	}
 	return nil
 }
 
@@ -82,10 +137,13 @@ func (w *Worker) getResponseFromUpstream(cr *cache.CacheRequest, usedForCache bo
 	metrics.UpstreamConn.Add(1)
 
 	if usedForCache {
-		resp, err = w.client.Do(r)
+		// the cache always stores the full content, ranges are served from the cache
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+		resp, err = w.doWithToken(r, true)
 	} else {
 		// let the real client handle the request and act as reverse proxy
-		resp, err = w.client.Transport.RoundTrip(r)
+		resp, err = w.doWithToken(r, false)
 	}
 	if err != nil {
 		metrics.FailedRequests.WithLabelValues(UPSTREAM_ERROR, cr.Request.URL.Path).Inc()
@@ -97,6 +155,25 @@ func (w *Worker) getResponseFromUpstream(cr *cache.CacheRequest, usedForCache bo
 
 func (w *Worker) getResponseFromCache(cr *cache.CacheRequest) (*http.Response, error) {
 
+	// let the client download the content from the storage backend
+	if r, ok := w.cache.(cache.Redirector); ok {
+		location, err := r.RedirectURL(cr)
+		if err != nil {
+			w.log.Warningf("can't redirect to %s, streaming it: %v", cr.DataFile, err)
+		} else if location != "" {
+			w.log.Tracef("serving from cache. Redirect to %s", location)
+			return &http.Response{
+				Status:        http.StatusText(http.StatusTemporaryRedirect),
+				StatusCode:    http.StatusTemporaryRedirect,
+				Proto:         cache.DEFAULT_PROTO,
+				Body:          http.NoBody,
+				ContentLength: 0,
+				Header:        http.Header{"Location": []string{location}},
+				Request:       cr.Request.Clone(context.TODO()),
+			}, nil
+		}
+	}
+
 	w.log.Tracef("serving from cache. Load data file %s", cr.DataFile)
 	freader, meta, err := w.cache.Read(cr)
 	if err != nil {
@@ -132,63 +209,175 @@ func (w *Worker) storeFile(ctx context.Context, cr *cache.CacheRequest) error {
 		return nil
 	}
 
-	respForCache, err := w.getResponseFromUpstream(cr, true)
-	if respForCache.StatusCode != http.StatusOK {
-		return fmt.Errorf("upstream returned a non-200 response: %v", respForCache.StatusCode)
+	// the file is in the lower tier, promote it instead of downloading it
+	if tiered, ok := w.cache.(cache.Tiered); ok {
+		body, respfile, err := tiered.OpenLower(cr)
+		if err == nil {
+			err = w.index.SetStatus(cr.CacheKey, cache.STATUS_IN_PROGRESS)
+			if err != nil {
+				body.Close()
+				w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
+				return fmt.Errorf("failed to set status for cache request: %v", err)
+			}
+
+			go w.promoteFile(tiered, cr, respfile, body)
+			return nil
+		}
 	}
 
-	if err != nil {
-		return fmt.Errorf("error while requesting upstream: %v", err)
+	// resume a download interrupted in a previous run
+	var respForCache *http.Response
+	offset := w.cache.PartialSize(cr)
+	if offset > 0 {
+		metrics.UpstreamConn.Add(1)
+		respForCache, err = w.getRangeFromUpstream(cr, offset)
+		if err != nil {
+			metrics.UpstreamConn.Add(-1)
+			w.log.Warningf("can't resume download of %s from offset %d: %v", cr.DataFile, offset, err)
+		} else if respForCache.StatusCode == http.StatusOK {
+			// ranges aren't supported by the upstream, start from scratch
+			offset = 0
+		} else if _, total, _ := parseContentRange(respForCache.Header.Get("Content-Range")); total < 0 {
+			// the size of the full response is unknown, start from scratch
+			respForCache.Body.Close()
+			metrics.UpstreamConn.Add(-1)
+			w.log.Warningf("can't resume download of %s, the upstream didn't send its size", cr.DataFile)
+			respForCache = nil
+		}
+	}
+
+	if respForCache == nil {
+		offset = 0
+		respForCache, err = w.getResponseFromUpstream(cr, true)
+		if err != nil {
+			metrics.UpstreamConn.Add(-1)
+			w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
+			return fmt.Errorf("error while requesting upstream: %v", err)
+		}
+
+		if respForCache.StatusCode != http.StatusOK {
+			respForCache.Body.Close()
+			metrics.UpstreamConn.Add(-1)
+			w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
+			return fmt.Errorf("upstream returned a non-200 response: %v", respForCache.StatusCode)
+		}
 	}
-	defer respForCache.Body.Close()
 
 	err = w.index.SetStatus(cr.CacheKey, cache.STATUS_IN_PROGRESS)
 	if err != nil {
+		respForCache.Body.Close()
+		metrics.UpstreamConn.Add(-1)
+		w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
 		return fmt.Errorf("failed to set status for cache request: %v", err)
 	}
 
+	contentLength := respForCache.ContentLength
+	header := respForCache.Header
+	if offset > 0 {
+		// store the headers of the full response
+		_, contentLength, _ = parseContentRange(header.Get("Content-Range"))
+		header = header.Clone()
+		header.Del("Content-Range")
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
 	respfile := cache.NewResponseFile(
-		int(respForCache.ContentLength),
-		respForCache.StatusCode,
-		respForCache.Header,
+		int(contentLength),
+		http.StatusOK,
+		header,
 		cr.CacheKey,
 	)
-	err = w.cache.Create(cr, respfile, respForCache.Body)
+	respfile.Host = cr.Host
+	respfile.Repository = cr.Repository
+
+	body := &resumableBody{
+		worker: w,
+		cr:     cr,
+		body:   respForCache.Body,
+		offset: offset,
+	}
+
+	// download in background, requests for the same cache key
+	// 	(including this one) stream the file while it's being written
+	go w.fillCache(cr, respfile, body, offset, now)
+
+	return nil
+}
+
+// Write content into the cache and update the index when done
+func (w *Worker) writeCache(cr *cache.CacheRequest, respfile *cache.ResponseFile, body io.ReadCloser, offset int64) error {
+
+	defer body.Close()
+
+	defer w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
+
+	err := w.cache.Create(cr, respfile, body, offset)
 	if err != nil {
+		var writeErr *cache.WriteError
+		if errors.As(err, &writeErr) {
+			metrics.CacheWriteFailures.WithLabelValues(writeErr.Reason, cr.ItemType).Inc()
+		}
+
 		// reset status if download/write failed
 		w.index.SetStatus(cr.CacheKey, cache.STATUS_NOT_FOUND)
-		return fmt.Errorf("error while writing file to disk: %v", err)
+		return fmt.Errorf("error while writing file %s to disk: %w", cr.DataFile, err)
 	}
 
 	err = w.index.SetStatus(cr.CacheKey, cache.STATUS_AVAILABLE)
 	if err != nil {
-		return fmt.Errorf("error while setting status in index for cachekey %v", err)
+		return fmt.Errorf("error while setting status in index for cachekey %s: %v", cr.CacheKey, err)
 	}
 
-	w.index.SetWorker(cr.CacheKey, cache.NO_WORKER, true)
-	if err != nil {
-		return fmt.Errorf("failed to remove allocated worker: %v", err)
-	}
+	w.pins.Observe(cr)
+	w.prefetchReferences(cr)
 
-	// Update metrics
+	return nil
+}
+
+// Write upstream response into the cache and update the index when done
+func (w *Worker) fillCache(cr *cache.CacheRequest, respfile *cache.ResponseFile, body io.ReadCloser, offset int64, start time.Time) {
 
 	// Bump connections counter by -1
-	metrics.UpstreamConn.Add(-1)
+	defer metrics.UpstreamConn.Add(-1)
+
+	err := w.writeCache(cr, respfile, body, offset)
+	if err != nil {
+		w.log.Warningln(err)
+		return
+	}
 
 	// Update Pull Speed metric
-	bytesPerSecond := float64(respForCache.ContentLength) / time.Since(now).Seconds()
+	bytesPerSecond := float64(int64(respfile.ContentLength)-offset) / time.Since(start).Seconds()
 	metrics.UpstreamPullSpeed.WithLabelValues(
 		string(cr.CacheKey),
 		cr.ItemType,
 	).Set(bytesPerSecond / 1024 / 1024 * 8) //calculate mbps
 
 	w.log.Infof("file %s stored locally", cr.DataFile)
+}
 
-	return nil
+// Copy file from the lower tier of the cache and update the index when done
+func (w *Worker) promoteFile(tiered cache.Tiered, cr *cache.CacheRequest, respfile *cache.ResponseFile, body io.ReadCloser) {
+
+	err := w.writeCache(cr, respfile, body, 0)
+	if err != nil {
+		w.log.Warningln(err)
+
+		// don't promote a corrupted file again
+		var writeErr *cache.WriteError
+		if errors.As(err, &writeErr) && (writeErr.Reason == cache.WRITE_ERROR_DIGEST_MISMATCH || writeErr.Reason == cache.WRITE_ERROR_SIZE_MISMATCH) {
+			tiered.RemoveLower(cr.DataFile)
+		}
+		return
+	}
+
+	metrics.TieredPromotions.WithLabelValues(cr.ItemType).Inc()
+	w.log.Infof("file %s promoted from lower tier", cr.DataFile)
 }
 
 func (w *Worker) handleFromUpstream(cr *cache.CacheRequest) {
 	resp, _ := w.getResponseFromUpstream(cr, false)
+	w.checkPinnedTag(cr, resp)
 	cacheResponse := &cache.CacheResponse{Response: resp, Origin: cache.ORIGIN_UPSTREAM}
 	cr.Response <- cacheResponse
 }
@@ -216,9 +405,20 @@ func (w *Worker) Run(ctx context.Context) {
 
 		// wait for messages from the queue
 		cr := w.Pop()
+		if cr.Tag != "" && w.tags != nil && !cr.NoStore {
+			w.handleTag(ctx, cr)
+			continue
+		}
+
 		if cr.CacheEnabled {
 
+			permsChecked := false
 			ckeystatus := w.index.GetStatus(cr.CacheKey)
+			if ckeystatus == cache.STATUS_NOT_FOUND && cr.NoStore {
+				w.handleFromUpstream(cr)
+				continue
+			}
+
 			if ckeystatus == cache.STATUS_NOT_FOUND {
 
 				// no perms no party
@@ -227,6 +427,7 @@ func (w *Worker) Run(ctx context.Context) {
 					w.handleFromUpstream(cr)
 					continue
 				}
+				permsChecked = true
 
 				// we need the entry in the index
 				// 	before selecting the workers/etc
@@ -251,21 +452,23 @@ func (w *Worker) Run(ctx context.Context) {
 				}
 			}
 
-			// if another thread is downloading the data, push the request back into the queue
-			if ckeystatus == cache.STATUS_IN_PROGRESS {
-				w.log.Traceln("pushing CR back into queue:", cr)
-				w.Push(cr)
-				continue
-			}
-
-			if ckeystatus == cache.STATUS_AVAILABLE {
-				err := w.checkPerms(cr)
-				if err != nil {
-					w.handleFromUpstream(cr)
-					continue
+			// the file is available or another thread is downloading it, stream it from the cache
+			if ckeystatus == cache.STATUS_AVAILABLE || ckeystatus == cache.STATUS_IN_PROGRESS {
+				if !permsChecked {
+					err := w.checkPerms(cr)
+					if err != nil {
+						w.handleFromUpstream(cr)
+						continue
+					}
 				}
 
 				resp, err := w.getResponseFromCache(cr)
+				if err != nil && ckeystatus == cache.STATUS_IN_PROGRESS {
+					// the download hasn't started yet or has just been completed
+					w.log.Traceln("pushing CR back into queue:", cr)
+					w.Push(cr)
+					continue
+				}
 				if err != nil {
 					w.log.Warningln("failed to fetch data from cache:", err)
 
@@ -0,0 +1,317 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/registry-cache/pkg/cache"
+	"github.com/ish-xyz/registry-cache/pkg/eviction"
+	"github.com/ish-xyz/registry-cache/pkg/token"
+	"github.com/stretchr/testify/assert"
+)
+
+var testBlob = bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+// upstream registry dropping the connection in the middle of the first full download
+func newFlakyUpstream(ranges *atomic.Int32) *httptest.Server {
+	dropped := &atomic.Bool{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		} else if r.Method == http.MethodGet && !dropped.Swap(true) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testBlob)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(testBlob[:len(testBlob)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testBlob))
+	}))
+}
+
+func newTestWorker(t *testing.T, upstream *httptest.Server) (*Worker, *cache.CacheRequest) {
+	dataPath := t.TempDir()
+	indexObj := cache.NewMemoryIndex()
+	cacheObj := cache.NewCache(indexObj, dataPath, eviction.NewLRU())
+
+	digest := fmt.Sprintf("%x", sha256.Sum256(testBlob))
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/v2/myimage/blobs/sha256:"+digest, nil)
+	req.RequestURI = ""
+	cr := cache.NewCacheRequest(req, dataPath)
+	indexObj.Put(cr.CacheKey, cr.DataFile)
+
+	return NewWorker(cacheObj, indexObj, upstream.Client(), Options{}), cr
+}
+
+func waitForStatus(w *Worker, ckey cache.CacheKey) int {
+	for x := 0; x < 500; x++ {
+		status := w.index.GetStatus(ckey)
+		if status != cache.STATUS_IN_PROGRESS {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cache.STATUS_IN_PROGRESS
+}
+
+func TestResumeDroppedConnection(t *testing.T) {
+	ranges := &atomic.Int32{}
+	upstream := newFlakyUpstream(ranges)
+	defer upstream.Close()
+
+	w, cr := newTestWorker(t, upstream)
+	ctx := context.WithValue(context.TODO(), ContextKey("id"), 0)
+
+	err := w.storeFile(ctx, cr)
+	assert.Nil(t, err)
+	assert.Equal(t, cache.STATUS_AVAILABLE, waitForStatus(w, cr.CacheKey))
+
+	stored, _ := os.ReadFile(string(cr.DataFile))
+	assert.Equal(t, int32(1), ranges.Load())
+	assert.Equal(t, testBlob, stored)
+}
+
+func TestResumePartialFile(t *testing.T) {
+	ranges := &atomic.Int32{}
+	upstream := newFlakyUpstream(ranges)
+	defer upstream.Close()
+
+	w, cr := newTestWorker(t, upstream)
+	ctx := context.WithValue(context.TODO(), ContextKey("id"), 0)
+
+	// partial file left by a previous run
+	os.MkdirAll(filepath.Dir(string(cr.DataFile)), 0777)
+	os.WriteFile(string(cr.DataFile)+cache.SUFFIX_PARTIAL_FILE, testBlob[:1000], 0644)
+
+	err := w.storeFile(ctx, cr)
+	assert.Nil(t, err)
+	assert.Equal(t, cache.STATUS_AVAILABLE, waitForStatus(w, cr.CacheKey))
+
+	stored, _ := os.ReadFile(string(cr.DataFile))
+	respfile, _ := w.index.GetResponseFile(cr.CacheKey)
+	assert.Equal(t, int32(1), ranges.Load())
+	assert.Equal(t, testBlob, stored)
+	assert.Equal(t, len(testBlob), respfile.ContentLength)
+	assert.Equal(t, http.StatusOK, respfile.StatusCode)
+	assert.Empty(t, http.Header(respfile.Header).Get("Content-Range"))
+}
+
+func TestResumePartialFileUnknownSize(t *testing.T) {
+	ranges := &atomic.Int32{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 1000-%d/*", len(testBlob)-1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testBlob[1000:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(testBlob)))
+		w.Write(testBlob)
+	}))
+	defer upstream.Close()
+
+	w, cr := newTestWorker(t, upstream)
+	ctx := context.WithValue(context.TODO(), ContextKey("id"), 0)
+	os.MkdirAll(filepath.Dir(string(cr.DataFile)), 0777)
+	os.WriteFile(string(cr.DataFile)+cache.SUFFIX_PARTIAL_FILE, testBlob[:1000], 0644)
+
+	// downloaded again from the start
+	err := w.storeFile(ctx, cr)
+	assert.Nil(t, err)
+	assert.Equal(t, cache.STATUS_AVAILABLE, waitForStatus(w, cr.CacheKey))
+
+	stored, _ := os.ReadFile(string(cr.DataFile))
+	respfile, _ := w.index.GetResponseFile(cr.CacheKey)
+	assert.Equal(t, int32(1), ranges.Load())
+	assert.Equal(t, testBlob, stored)
+	assert.Equal(t, len(testBlob), respfile.ContentLength)
+}
+
+func TestPromoteFromLowerTier(t *testing.T) {
+	ranges := &atomic.Int32{}
+	upstream := newFlakyUpstream(ranges)
+	defer upstream.Close()
+
+	w, cr := newTestWorker(t, upstream)
+	lowerPath := t.TempDir()
+	tiered := cache.NewTieredCache(w.cache, lowerPath, 0, 0)
+	w.cache = tiered
+
+	// file demoted by another replica
+	lowerFile := filepath.Join(lowerPath, strings.TrimPrefix(string(cr.DataFile), w.cache.GetDataPath()))
+	os.MkdirAll(filepath.Dir(lowerFile), 0777)
+	os.WriteFile(lowerFile, testBlob, 0644)
+	cache.NewResponseFile(len(testBlob), http.StatusOK, nil, cr.CacheKey).Dump(cache.ComputeResponseFilePath(lowerFile))
+
+	// the upstream is closed, the file must come from the lower tier
+	upstream.Close()
+	ctx := context.WithValue(context.TODO(), ContextKey("id"), 0)
+	err := w.storeFile(ctx, cr)
+	assert.Nil(t, err)
+	assert.Equal(t, cache.STATUS_AVAILABLE, waitForStatus(w, cr.CacheKey))
+
+	stored, _ := os.ReadFile(string(cr.DataFile))
+	assert.Equal(t, testBlob, stored)
+}
+
+func TestPrefetchReferences(t *testing.T) {
+	digestOf := func(content string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	}
+
+	layer, armLayer := "layer", "arm layer"
+	manifest := fmt.Sprintf(`{"layers": [{"digest": "%s"}]}`, digestOf(layer))
+	armManifest := fmt.Sprintf(`{"layers": [{"digest": "%s"}]}`, digestOf(armLayer))
+	index := fmt.Sprintf(
+		`{"manifests": [{"digest": "%s", "platform": {"os": "linux", "architecture": "amd64"}}, {"digest": "%s", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		digestOf(manifest), digestOf(armManifest),
+	)
+	contents := map[string]string{}
+	for _, c := range []string{index, manifest, armManifest} {
+		contents["/v2/app/manifests/"+digestOf(c)] = c
+	}
+	for _, c := range []string{layer, armLayer} {
+		contents["/v2/app/blobs/"+digestOf(c)] = c
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := contents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	dataPath := t.TempDir()
+	indexObj := cache.NewMemoryIndex()
+	cacheObj := cache.NewCache(indexObj, dataPath, eviction.NewLRU())
+	platform, _ := cache.ParsePlatform("linux/amd64")
+	w := NewWorker(cacheObj, indexObj, upstream.Client(), Options{Prefetch: &Prefetch{Platforms: []*cache.Platform{platform}}})
+	w.Start(2)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/v2/app/manifests/"+digestOf(index), nil)
+	req.RequestURI = ""
+	cr := cache.NewCacheRequest(req, dataPath)
+	w.Push(cr)
+	resp := (<-cr.Response).Response
+	resp.Body.Close()
+
+	keyOf := func(content string) cache.CacheKey {
+		return cache.CacheKey(strings.TrimPrefix(digestOf(content), cache.DIGEST_PREFIX))
+	}
+	for x := 0; x < 200 && indexObj.GetStatus(keyOf(layer)) != cache.STATUS_AVAILABLE; x++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, cache.STATUS_AVAILABLE, indexObj.GetStatus(keyOf(manifest)))
+	assert.Equal(t, cache.STATUS_AVAILABLE, indexObj.GetStatus(keyOf(layer)))
+	assert.Equal(t, cache.STATUS_NOT_FOUND, indexObj.GetStatus(keyOf(armManifest)))
+	assert.Equal(t, cache.STATUS_NOT_FOUND, indexObj.GetStatus(keyOf(armLayer)))
+}
+
+func TestTagRevalidation(t *testing.T) {
+	var current atomic.Value
+	current.Store(`{"layers": []}`)
+	gets := &atomic.Int32{}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := current.Load().(string)
+		if strings.HasSuffix(r.URL.Path, "/manifests/v1") && r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		w.Header().Set(HEADER_DOCKER_DIGEST, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content))))
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	dataPath := t.TempDir()
+	indexObj := cache.NewMemoryIndex()
+	cacheObj := cache.NewCache(indexObj, dataPath, eviction.NewLRU())
+	w := NewWorker(cacheObj, indexObj, upstream.Client(), Options{Tags: cache.NewTagCache(100 * time.Millisecond)})
+	w.Start(1)
+
+	pull := func(accept string) (string, string) {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/v2/app/manifests/v1", nil)
+		req.RequestURI = ""
+		req.Header.Set("Accept", accept)
+		cr := cache.NewCacheRequest(req, dataPath)
+		w.Push(cr)
+		cresp := <-cr.Response
+		defer cresp.Response.Body.Close()
+		body, _ := io.ReadAll(cresp.Response.Body)
+		return string(body), cresp.Origin
+	}
+
+	body, origin := pull(cache.MEDIA_TYPE_DOCKER_MANIFEST)
+	assert.Equal(t, `{"layers": []}`, body)
+	assert.Equal(t, cache.ORIGIN_UPSTREAM, origin)
+
+	_, origin = pull(cache.MEDIA_TYPE_DOCKER_MANIFEST)
+	assert.Equal(t, cache.ORIGIN_CACHE, origin)
+	assert.Equal(t, int32(1), gets.Load())
+
+	// variants are cached per media type
+	_, origin = pull(cache.MEDIA_TYPE_OCI_MANIFEST)
+	assert.Equal(t, cache.ORIGIN_UPSTREAM, origin)
+
+	// not moved after the ttl
+	time.Sleep(150 * time.Millisecond)
+	_, origin = pull(cache.MEDIA_TYPE_DOCKER_MANIFEST)
+	assert.Equal(t, cache.ORIGIN_CACHE, origin)
+	assert.Equal(t, int32(2), gets.Load())
+
+	// moved after the ttl
+	current.Store(`{"layers": [], "annotations": {}}`)
+	time.Sleep(150 * time.Millisecond)
+	body, origin = pull(cache.MEDIA_TYPE_DOCKER_MANIFEST)
+	assert.Equal(t, `{"layers": [], "annotations": {}}`, body)
+	assert.Equal(t, cache.ORIGIN_UPSTREAM, origin)
+}
+
+func TestCheckPermsWithToken(t *testing.T) {
+	issued := &atomic.Int32{}
+
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			issued.Add(1)
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set(token.HEADER_WWW_AUTHENTICATE, fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	w, cr := newTestWorker(t, upstream)
+	cr.Request.SetBasicAuth("user", "pass")
+
+	// the credentials are sent as they are without tokens
+	assert.NotNil(t, w.checkPerms(cr))
+
+	w.tokens = token.NewCache(upstream.Client())
+	assert.Nil(t, w.checkPerms(cr))
+	assert.Nil(t, w.checkPerms(cr))
+	assert.Equal(t, int32(1), issued.Load())
+}